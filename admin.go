@@ -0,0 +1,666 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Roles rank what staff may do: support can look things up and resend
+// verification texts, admins can also change bets and users. Every user
+// without a role is a plain user.
+var Roles = map[string]int{
+    "user": 0,
+    "support": 1,
+    "admin": 2,
+}
+
+// maxAuditBody is how much of a request body is kept in the admin audit log.
+const maxAuditBody = 2048
+
+// An AdminUser is a user as staff see them, deleted or not.
+type AdminUser struct {
+    User
+    PhoneNumber string      `json:"phone_number"`
+    IsVerified bool         `json:"is_verified"`
+    IsDeleted bool          `json:"is_deleted"`
+    Role string             `json:"role"`
+    Ban *Ban                `json:"ban,omitempty"`
+    Limits *UserLimits      `json:"limits"`
+}
+
+// An AdminBet is a bet as staff see them, deleted or not, with its audit
+// trail and any review of its payouts.
+type AdminBet struct {
+    Bet
+    IsDeleted bool          `json:"is_deleted"`
+    History []BetChange     `json:"history"`
+    Review *Review          `json:"review,omitempty"`
+}
+
+// A Ban keeps a user from using the API.
+type Ban struct {
+    Reason string            `json:"reason"`
+    BannedBy int             `json:"banned_by"`
+    BannedOn time.Time       `json:"banned_on"`
+}
+
+// An AdminAction is an entry of the audit log of requests to the admin API.
+type AdminAction struct {
+    Id int64                `json:"id"`
+    ActorId int             `json:"actor_id"`
+    Role string             `json:"role"`
+    Method string           `json:"method"`
+    Path string             `json:"path"`
+    Body string             `json:"body,omitempty"`
+    Status int              `json:"status"`
+    CreatedOn time.Time     `json:"created_on"`
+}
+
+/* Middleware */
+
+// RequireRole lets only users with at least a role through to a handler,
+// and records every request it lets through or refuses to an authenticated
+// user in the admin audit log.
+func (db *MyDB) RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+        userId, err := db.AuthenticatedUser(r)
+        if err != nil {
+            WriteError(rw, 401, err.Error())
+            return
+        }
+
+        has, err := db.GetRole(r.Context(), userId)
+        if err != nil {
+            WriteError(rw, 500, err.Error())
+            return
+        }
+
+        // keep the body for the log, and hand the handler a fresh copy
+        var body []byte
+        if r.Body != nil {
+            body, _ = io.ReadAll(io.LimitReader(r.Body, 1 << 20))
+            r.Body.Close()
+            r.Body = io.NopCloser(bytes.NewReader(body))
+        }
+
+        sr := &statusRecorder{ ResponseWriter: rw }
+        if Roles[has] < Roles[role] {
+            WriteError(sr, 403, "This requires the " + role + " role")
+        } else {
+            next(sr, r)
+        }
+
+        if sr.status == 0 {
+            sr.status = 200
+        }
+        if len(body) > maxAuditBody {
+            body = body[:maxAuditBody]
+        }
+
+        err = db.LogAdminAction(r.Context(), AdminAction{
+            ActorId: userId,
+            Role: has,
+            Method: r.Method,
+            Path: r.URL.Path,
+            Body: string(body),
+            Status: sr.status,
+        })
+        if err != nil {
+            Logger(r.Context()).Error("failed to log admin action", "error", err)
+        }
+    }
+}
+
+/* Store */
+
+// GetRole returns a user's role. Users listed in ADMIN_USER_IDS are always
+// admins, so the first admin can be set up.
+func (db *MyDB) GetRole(ctx context.Context, userId int) (string, error) {
+    for _, id := range EnvList("ADMIN_USER_IDS", nil) {
+        if id == strconv.Itoa(userId) {
+            return "admin", nil
+        }
+    }
+
+    var role string
+    err := db.QueryRowContext(ctx, "select role from user_roles where user_id = ?", userId).Scan(&role)
+    if err == sql.ErrNoRows {
+        return "user", nil
+    }
+    if err != nil {
+        return "", errors.New("Failed to load role: " + err.Error())
+    }
+
+    return role, nil
+}
+
+// SetRole gives a user a role on behalf of an admin.
+func (db *MyDB) SetRole(ctx context.Context, actorId int, userId int, role string) error {
+    if _, ok := Roles[role]; !ok {
+        return errors.New("Role must be user, support or admin")
+    }
+
+    var err error
+    if role == "user" {
+        _, err = db.ExecContext(ctx, "delete from user_roles where user_id = ?", userId)
+    } else {
+        _, err = db.ExecContext(ctx, "insert into user_roles (user_id, role, granted_by) values (?, ?, ?) " +
+                                     "on duplicate key update role = values(role), granted_by = values(granted_by), " +
+                                     "granted_on = current_timestamp", userId, role, actorId)
+    }
+    if err != nil {
+        return errors.New("Failed to set role: " + err.Error())
+    }
+
+    Logger(ctx).Info("role changed", "user_id", userId, "role", role, "actor_id", actorId)
+
+    return nil
+}
+
+// LogAdminAction appends a request to the admin audit log.
+func (db *MyDB) LogAdminAction(ctx context.Context, a AdminAction) error {
+    _, err := db.ExecContext(ctx, "insert into admin_actions (actor_id, role, method, path, body, status) values (?, ?, ?, ?, nullif(?, ''), ?)",
+                             a.ActorId, a.Role, a.Method, a.Path, a.Body, a.Status)
+    if err != nil {
+        return errors.New("Failed to log admin action: " + err.Error())
+    }
+    return nil
+}
+
+// GetAdminActions returns a page of the admin audit log, newest first,
+// starting before cursor, or from the newest when cursor is 0. An actorId
+// above 0 only returns that user's actions.
+func (db *MyDB) GetAdminActions(ctx context.Context, actorId int, cursor int64, limit int) ([]AdminAction, string, error) {
+    rows, err := db.QueryContext(ctx, "select id, actor_id, role, method, path, coalesce(body, ''), status, created_on from admin_actions " +
+                                      "where (? = 0 or actor_id = ?) and (? = 0 or id < ?) order by id desc limit ?",
+                                 actorId, actorId, cursor, cursor, limit + 1)
+    if err != nil {
+        return nil, "", errors.New("Failed query for admin actions: " + err.Error())
+    }
+    defer rows.Close()
+
+    actions := make([]AdminAction, 0)
+    for rows.Next() {
+        var a AdminAction
+        if err := rows.Scan(&a.Id, &a.ActorId, &a.Role, &a.Method, &a.Path, &a.Body, &a.Status, &a.CreatedOn); err != nil {
+            return nil, "", errors.New("Failed to scan admin action: " + err.Error())
+        }
+        actions = append(actions, a)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, "", errors.New("Failed while iterating over admin actions: " + err.Error())
+    }
+
+    // the extra row only tells us there is a next page
+    next := ""
+    if len(actions) > limit {
+        actions = actions[:limit]
+        next = strconv.FormatInt(actions[limit - 1].Id, 10)
+    }
+
+    return actions, next, nil
+}
+
+// GetAdminUser returns a user, deleted or not, with their role, ban and limits.
+func (db *MyDB) GetAdminUser(ctx context.Context, id int) (*AdminUser, error) {
+    var u AdminUser
+    err := db.QueryRowContext(ctx, "select id, first_name, last_name, email, profile_pic_url, created_on, venmo_id, " +
+                                   "coalesce(phone_number, ''), is_verified, is_deleted from users where id = ?", id).
+              Scan(&u.Id, &u.FirstName, &u.LastName, &u.Email, &u.ProfilePicUrl, &u.CreatedOn, &u.VenmoId,
+                   &u.PhoneNumber, &u.IsVerified, &u.IsDeleted)
+    if err != nil {
+        return nil, errors.New("No user found with id " + strconv.Itoa(id))
+    }
+
+    if u.Role, err = db.GetRole(ctx, id); err != nil {
+        return nil, err
+    }
+
+    var ban Ban
+    err = db.QueryRowContext(ctx, "select reason, banned_by, banned_on from user_bans where user_id = ?", id).
+              Scan(&ban.Reason, &ban.BannedBy, &ban.BannedOn)
+    if err == nil {
+        u.Ban = &ban
+    } else if err != sql.ErrNoRows {
+        return nil, errors.New("Failed to load ban: " + err.Error())
+    }
+
+    if u.Limits, err = db.GetLimits(ctx, id); err != nil {
+        return nil, err
+    }
+
+    return &u, nil
+}
+
+// GetAdminBet returns a bet, deleted or not, with its audit trail and review.
+func (db *MyDB) GetAdminBet(ctx context.Context, id int) (*AdminBet, error) {
+    b, err := db.GetBet(ctx, id)
+    if err != nil {
+        return nil, errors.New("No bet found with id " + strconv.Itoa(id))
+    }
+
+    ab := &AdminBet{ Bet: *b }
+    if err = db.QueryRowContext(ctx, "select is_deleted from bets where id = ?", id).Scan(&ab.IsDeleted); err != nil {
+        return nil, errors.New("Failed to load bet: " + err.Error())
+    }
+
+    if ab.History, err = db.GetBetHistory(ctx, id); err != nil {
+        return nil, err
+    }
+
+    review := Review{ BetId: id }
+    err = db.QueryRowContext(ctx, "select status, coalesce(reviewer_id, 0), coalesce(note, ''), created_on, reviewed_on " +
+                                  "from bet_reviews where bet_id = ?", id).
+             Scan(&review.Status, &review.ReviewerId, &review.Note, &review.CreatedOn, &review.ReviewedOn)
+    if err == nil {
+        if err = loadReview(ctx, db, &review); err != nil {
+            return nil, err
+        }
+        ab.Review = &review
+    } else if err != sql.ErrNoRows {
+        return nil, errors.New("Failed to load review: " + err.Error())
+    }
+
+    return ab, nil
+}
+
+// BanUser keeps a user from using the API, on behalf of staff.
+func (db *MyDB) BanUser(ctx context.Context, actorId int, userId int, reason string) error {
+    _, err := db.ExecContext(ctx, "insert into user_bans (user_id, reason, banned_by) values (?, ?, ?) " +
+                                  "on duplicate key update reason = values(reason), banned_by = values(banned_by)",
+                             userId, reason, actorId)
+    if err != nil {
+        return errors.New("Failed to ban user: " + err.Error())
+    }
+
+    Logger(ctx).Info("user banned", "user_id", userId, "actor_id", actorId)
+
+    return nil
+}
+
+// UnbanUser lets a banned user use the API again.
+func (db *MyDB) UnbanUser(ctx context.Context, actorId int, userId int) error {
+    if _, err := db.ExecContext(ctx, "delete from user_bans where user_id = ?", userId); err != nil {
+        return errors.New("Failed to unban user: " + err.Error())
+    }
+
+    Logger(ctx).Info("user unbanned", "user_id", userId, "actor_id", actorId)
+
+    return nil
+}
+
+// ResendVerification texts a user their verification token again.
+func (db *MyDB) ResendVerification(ctx context.Context, userId int) error {
+    var phone string
+    var verified bool
+    err := db.QueryRowContext(ctx, "select coalesce(phone_number, ''), is_verified from users where id = ?", userId).
+              Scan(&phone, &verified)
+    if err != nil {
+        return errors.New("No user found with id " + strconv.Itoa(userId))
+    }
+
+    if verified {
+        return errors.New("User " + strconv.Itoa(userId) + " is already verified")
+    }
+    if phone == "" {
+        return errors.New("User " + strconv.Itoa(userId) + " has no phone number")
+    }
+
+    return db.InTx(ctx, func(tx *Tx) error {
+        return tx.Enqueue(ctx, "sms.verification", VerificationSMS{ UserId: userId, PhoneNumber: phone })
+    })
+}
+
+// ForceBetStatus moves a bet to a status on behalf of staff, skipping the
+// checks users are held to. The reason is recorded in the audit trail.
+// Bets are settled by resolving them instead.
+func (db *MyDB) ForceBetStatus(ctx context.Context, actorId int, id int, status string, reason string) error {
+    switch status {
+    case "pending", "active", "declined", "disputed":
+    default:
+        return errors.New("Status must be pending, active, declined or disputed; settle bets by resolving them")
+    }
+
+    typ, ok := betEventTypes[status]
+    if !ok {
+        typ = "bet.updated"
+    }
+
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var oldStatus string
+        err := tx.QueryRowContext(ctx, "select status from bets where id = ? for update", id).Scan(&oldStatus)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(id))
+        }
+
+        if oldStatus == "settled" {
+            return errors.New("Settled bets have been paid out and can't change status")
+        }
+
+        if _, err = tx.ExecContext(ctx, "update bets set status = ? where id = ?", status, id); err != nil {
+            return errors.New("Failed to update bet status: " + err.Error())
+        }
+
+        err = tx.RecordBetChange(ctx, BetChange{
+            BetId: id,
+            ActorId: actorId,
+            Action: "status",
+            OldStatus: oldStatus,
+            NewStatus: status,
+            Reason: "forced by staff: " + reason,
+        })
+        if err != nil {
+            return err
+        }
+
+        b, err := getBet(ctx, tx, id)
+        if err != nil {
+            return err
+        }
+        return tx.Event(ctx, typ, id, b.Participants(), b)
+    })
+    if err != nil {
+        return err
+    }
+
+    db.countBetStatus(ctx, id, status)
+    Logger(ctx).Info("bet status forced", "bet_id", id, "status", status, "actor_id", actorId)
+
+    return nil
+}
+
+// ResolveDispute settles a disputed bet on behalf of staff: on a side, or as
+// a push that gives every player their stake back.
+func (db *MyDB) ResolveDispute(ctx context.Context, actorId int, id int, side string, reason string) error {
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var status string
+        err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", id).Scan(&status)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(id))
+        }
+        if status != "disputed" {
+            return errors.New("Only disputed bets can be resolved by staff")
+        }
+
+        b, err := getBet(ctx, tx, id)
+        if err != nil {
+            return err
+        }
+
+        picked := ""
+        for _, o := range b.Outcomes() {
+            if strings.EqualFold(o, side) {
+                picked = o
+            }
+        }
+        if picked == "" && side != "push" {
+            return errors.New("Side must be one of " + strings.Join(b.Outcomes(), ", ") + ", or push")
+        }
+
+        return tx.settle(ctx, b, picked, actorId, "dispute resolved by staff: " + reason)
+    })
+    if err != nil {
+        return err
+    }
+
+    db.countBetStatus(ctx, id, "settled")
+    Logger(ctx).Info("dispute resolved", "bet_id", id, "side", side, "actor_id", actorId)
+
+    return nil
+}
+
+/* Handlers */
+
+// readAdminParams reads the JSON object body of an admin request, checking
+// the parameters in required are given.
+func readAdminParams(r *http.Request, required ...string) (map[string]string, error) {
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return nil, errors.New("Failed to parse body: " + err.Error())
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        return nil, errors.New("Body must be a JSON object: " + err.Error())
+    }
+
+    for _, p := range required {
+        if strings.TrimSpace(params[p]) == "" {
+            return nil, errors.New("Missing parameter " + p)
+        }
+    }
+    return params, nil
+}
+
+// adminTarget returns the id in the path of an admin request, and the staff member making it.
+func (db *MyDB) adminTarget(r *http.Request) (int, int) {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    actorId, _ := db.AuthenticatedUser(r)
+    return id, actorId
+}
+
+// AdminUserHandler looks up a user, deleted or not.
+// Handles GET to /admin/users/{id}.
+func (db *MyDB) AdminUserHandler(rw http.ResponseWriter, r *http.Request) {
+    id, _ := db.adminTarget(r)
+
+    u, err := db.GetAdminUser(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 404, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, u)
+}
+
+// AdminUserRoleHandler gives a user a role.
+// Handles PUT to /admin/users/{id}/role with a "role".
+func (db *MyDB) AdminUserRoleHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    params, err := readAdminParams(r, "role")
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if id == actorId {
+        WriteError(rw, 400, "Staff can't change their own role")
+        return
+    }
+    if !db.UserExists(r.Context(), id) {
+        WriteError(rw, 404, "No user found with id " + strconv.Itoa(id))
+        return
+    }
+
+    if err = db.SetRole(r.Context(), actorId, id, params["role"]); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminUserBanHandler bans a user.
+// Handles POST to /admin/users/{id}/ban with a "reason".
+func (db *MyDB) AdminUserBanHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    params, err := readAdminParams(r, "reason")
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if id == actorId {
+        WriteError(rw, 400, "Staff can't ban themselves")
+        return
+    }
+    if !db.UserExists(r.Context(), id) {
+        WriteError(rw, 404, "No user found with id " + strconv.Itoa(id))
+        return
+    }
+
+    if err = db.BanUser(r.Context(), actorId, id, params["reason"]); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminUserUnbanHandler lifts a user's ban.
+// Handles DELETE to /admin/users/{id}/ban.
+func (db *MyDB) AdminUserUnbanHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    if err := db.UnbanUser(r.Context(), actorId, id); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminUserVerificationHandler texts a user their verification token again.
+// Handles POST to /admin/users/{id}/verification.
+func (db *MyDB) AdminUserVerificationHandler(rw http.ResponseWriter, r *http.Request) {
+    id, _ := db.adminTarget(r)
+
+    if err := db.ResendVerification(r.Context(), id); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminBetHandler looks up a bet, deleted or not, with its audit trail and review.
+// Handles GET to /admin/bets/{id}.
+func (db *MyDB) AdminBetHandler(rw http.ResponseWriter, r *http.Request) {
+    id, _ := db.adminTarget(r)
+
+    b, err := db.GetAdminBet(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 404, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, b)
+}
+
+// AdminBetStatusHandler forces a bet into a status.
+// Handles POST to /admin/bets/{id}/status with a "status" and a "reason".
+func (db *MyDB) AdminBetStatusHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    params, err := readAdminParams(r, "status", "reason")
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if err = db.ForceBetStatus(r.Context(), actorId, id, params["status"], params["reason"]); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminBetResolveHandler settles a disputed bet.
+// Handles POST to /admin/bets/{id}/resolve with the winning "side", or push, and a "reason".
+func (db *MyDB) AdminBetResolveHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    params, err := readAdminParams(r, "side", "reason")
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if err = db.ResolveDispute(r.Context(), actorId, id, params["side"], params["reason"]); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminReviewsHandler lists the bets flagged by the fraud rules.
+// Handles GET to /admin/reviews, with a "status" of pending (the default), released or voided.
+func (db *MyDB) AdminReviewsHandler(rw http.ResponseWriter, r *http.Request) {
+    status := r.URL.Query().Get("status")
+    if status == "" {
+        status = "pending"
+    }
+    if status != "pending" && status != "released" && status != "voided" {
+        WriteError(rw, 400, "Parameter 'status' must be pending, released or voided")
+        return
+    }
+
+    cursor, err := PageCursor(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    reviews, next, err := db.GetReviews(r.Context(), status, cursor, PageLimit(r, 20, 100))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WritePage(rw, reviews, next)
+}
+
+// AdminReviewHandler releases or voids the held payouts of a flagged bet.
+// Handles POST to /admin/reviews/{id} with a "decision" of release or void, and an optional "note".
+func (db *MyDB) AdminReviewHandler(rw http.ResponseWriter, r *http.Request) {
+    id, actorId := db.adminTarget(r)
+
+    params, err := readAdminParams(r, "decision")
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if err = db.ReviewBet(r.Context(), id, actorId, params["decision"], params["note"]); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// AdminActionsHandler shows the admin audit log.
+// Handles GET to /admin/actions, optionally for one "actor_id".
+func (db *MyDB) AdminActionsHandler(rw http.ResponseWriter, r *http.Request) {
+    actorId, _ := strconv.Atoi(r.URL.Query().Get("actor_id"))
+
+    cursor, err := PageCursor(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    actions, next, err := db.GetAdminActions(r.Context(), actorId, cursor, PageLimit(r, 50, 200))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WritePage(rw, actions, next)
+}
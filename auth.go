@@ -0,0 +1,54 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// AccessToken returns the Venmo access token a request was made with, read from
+// an "Authorization: Bearer" header or the access_token query parameter.
+func AccessToken(r *http.Request) string {
+    if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+        return strings.TrimSpace(h[7:])
+    }
+    return r.URL.Query().Get("access_token")
+}
+
+// AuthenticatedUser returns the id of the user a request was made by.
+// The user is remembered for the rest of the request.
+func (db *MyDB) AuthenticatedUser(r *http.Request) (int, error) {
+    if info := getRequestInfo(r.Context()); info != nil && info.UserId != 0 {
+        return info.UserId, nil
+    }
+
+    accessToken := AccessToken(r)
+    if accessToken == "" {
+        return -1, errors.New("An access token is required")
+    }
+
+    id, err := db.GetIdByAccessToken(r.Context(), accessToken)
+    if err != nil {
+        return -1, err
+    }
+    SetRequestUser(r, id)
+
+    return id, nil
+}
+
+// ClientIP returns the address a request came from.
+// X-Forwarded-For is only trusted when TRUST_PROXY is set.
+func ClientIP(r *http.Request) string {
+    if EnvBool("TRUST_PROXY", false) {
+        if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+            return strings.TrimSpace(strings.Split(fwd, ",")[0])
+        }
+    }
+
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-    "database/sql"
+    "context"
     "errors"
-    "fmt"
+    "strconv"
     "time"
 
     _ "github.com/go-sql-driver/mysql"
@@ -20,173 +20,463 @@ type Bet struct {
     Desc string           `json:"desc"`
     CreatedOn time.Time   `json:"created_on"`
     Status string         `json:"status"`
-    Amount int            `json:"amount"` // in cents
+    Amount int            `json:"amount"` // the bettor's stake, in cents
+    BettedStake int       `json:"betted_stake,omitempty"`   // in cents, when it differs from the amount
+    Odds *Odds            `json:"odds,omitempty"`
+    Deadline *time.Time   `json:"deadline,omitempty"`
+    BetPrivacy
+    BetLabels
+    Kind string           `json:"kind,omitempty"`           // pair or group
+    Sides []string        `json:"outcomes,omitempty"`       // the named sides of a group bet
+    WinningSide string    `json:"winning_side,omitempty"`
+    Members []Participant `json:"participants,omitempty"`
+    Evidence []Evidence   `json:"evidence,omitempty"`
 }
 
-// CreateBet creates a bet.
-func (db *MyDB) CreateBet(bettorId int,
+// betColumns are the columns of bets, in the order of the Bet fields they scan into.
+const betColumns = "id, bettor_id, betted_id, witness_id, winner_id, title, description, created_on, status, amount"
+
+// Participants returns the ids of the users involved in a bet.
+func (b *Bet) Participants() []int {
+    if len(b.Members) == 0 {
+        return []int{b.BettorId, b.BettedId, b.WitnessId}
+    }
+
+    ids := make([]int, len(b.Members))
+    for i, m := range b.Members {
+        ids[i] = m.UserId
+    }
+    return ids
+}
+
+// IsParticipant reports whether a user is involved in a bet.
+func (b *Bet) IsParticipant(userId int) bool {
+    for _, id := range b.Participants() {
+        if id == userId && id > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// CreateBet creates a bet and returns its id. The bettor stakes amount and
+// the betted user bettedStake, which odds, if given, were used to work out.
+// The terms are also the bettor's first offer, which the betted user can accept or counter.
+func (db *MyDB) CreateBet(ctx context.Context,
+                            bettorId int,
                             bettedId int,
                             witnessId int,
                             winnerId int,
                             title string,
                             description string,
                             status string,
-                            amount int) error {
+                            amount int,
+                            bettedStake int,
+                            odds *Odds,
+                            deadline *time.Time,
+                            privacy BetPrivacy,
+                            labels BetLabels) (int, error) {
+
+    var id int
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var err error
+        id, err = tx.createBet(ctx,
+                               bettorId,
+                               bettedId,
+                               witnessId,
+                               winnerId,
+                               title,
+                               description,
+                               status,
+                               amount,
+                               bettedStake,
+                               odds,
+                               deadline,
+                               privacy,
+                               labels)
+        return err
+    })
+    if err != nil {
+        return -1, err
+    }
+
+    betsCreated.Inc()
+    Logger(ctx).Info("bet created", "bet_id", id, "bettor_id", bettorId, "betted_id", bettedId, "witness_id", witnessId)
 
-    q := "insert into bet (id, bettor_id, betted_id, witness_id, " +
-         "winner_id, title, description, created,_on, expire_on, " +
-         "status, amount values (?)"
+    return id, nil
+}
 
-    query, err := db.Prepare(q)
+// createBet creates a bet in a transaction and returns its id.
+func (tx *Tx) createBet(ctx context.Context,
+                         bettorId int,
+                         bettedId int,
+                         witnessId int,
+                         winnerId int,
+                         title string,
+                         description string,
+                         status string,
+                         amount int,
+                         bettedStake int,
+                         odds *Odds,
+                         deadline *time.Time,
+                         privacy BetPrivacy,
+                         labels BetLabels) (int, error) {
+
+    if err := tx.checkLimits(ctx, bettorId, 0, amount); err != nil {
+        return -1, err
+    }
+    if status == "active" {
+        if err := tx.checkLimits(ctx, bettedId, 0, bettedStake); err != nil {
+            return -1, err
+        }
+    }
+
+    q := "insert into bets (bettor_id, betted_id, witness_id, " +
+         "winner_id, title, description, status, amount) " +
+         "values (?, ?, ?, ?, ?, ?, ?, ?)"
+
+    res, err := tx.ExecContext(ctx, q,
+                               bettorId,
+                               bettedId,
+                               witnessId,
+                               winnerId,
+                               title,
+                               description,
+                               status,
+                               amount)
     if err != nil {
-        return errors.New("Error when preparing the CreateBet query")
+        return -1, errors.New("Error when executing the CreateBet query")
     }
 
-    values := fmt.Sprintf("%s, %s, %s, %s, %s, %s, %s, %s, %s", bettorId,
-                                                           bettedId,
-                                                           witnessId,
-                                                           winnerId,
-                                                           title,
-                                                           description,
-                                                           status,
-                                                           amount)
+    id, err := res.LastInsertId()
+    if err != nil {
+        return -1, errors.New("Error when reading the id of the created bet")
+    }
 
-    _, err = query.Exec(values)
-    if err != nil{
-        return errors.New("Error when executing the CreateBet query")
+    // the two-person bet is a bet between the bettor and betted sides
+    participants := []Participant{
+        { UserId: bettorId, Role: "player", Side: SideBettor, Stake: amount },
+        { UserId: bettedId, Role: "player", Side: SideBetted, Stake: bettedStake },
+        { UserId: witnessId, Role: "witness" },
+    }
+    for _, p := range participants {
+        if p.UserId <= 0 {
+            continue
+        }
+        if err = tx.addParticipant(ctx, int(id), p); err != nil {
+            return -1, err
+        }
     }
 
-    return nil
-}
+    if odds != nil {
+        if err = tx.saveOdds(ctx, int(id), odds); err != nil {
+            return -1, err
+        }
+    }
 
-// GetBets retrieves a list of bets by specific query parameters.
-func (db *MyDB) GetBets(params map[string] string) ([]Bet, error){
-    bets := make([]Bet, 0)
-    var b Bet
+    if err = tx.saveVisibility(ctx, int(id), privacy); err != nil {
+        return -1, err
+    }
 
-    query := "select * from bets where is_deleted = 0 and "
-    for k, v := range params {
-        query += fmt.Sprintf("%s = '%s' and ", k, v)
+    if err = tx.saveLabels(ctx, int(id), labels); err != nil {
+        return -1, err
     }
 
-    query = query[:len(query) - 5]
+    err = tx.insertOffer(ctx, Offer{
+        BetId: int(id),
+        Version: 1,
+        ProposerId: bettorId,
+        Amount: amount,
+        BettedStake: bettedStake,
+        Title: title,
+        Description: description,
+        WitnessId: witnessId,
+        Deadline: deadline,
+    })
+    if err != nil {
+        return -1, err
+    }
 
-    stmt, err := db.Prepare(query)
-    if err != nil{
-        return nil, errors.New("Error when preparing the bet query")
+    err = tx.RecordBetChange(ctx, BetChange{ BetId: int(id), ActorId: bettorId, Action: "created", NewStatus: status })
+    if err != nil {
+        return -1, err
     }
-    defer stmt.Close()
 
-    rows, err := stmt.Query()
-    if err != nil{
-        return nil, errors.New("Error when executing the bet query")
+    if err = tx.BetEvent(ctx, "bet.created", int(id)); err != nil {
+        return -1, err
     }
-    defer rows.Close()
 
-    for rows.Next() {
-        err = rows.Scan(&b.Id,
-                        &b.BettorId,
-                        &b.BettedId,
-                        &b.WitnessId,
-                        &b.WinnerId,
-                        &b.Title,
-                        &b.Desc,
-                        &b.CreatedOn,
-                        &b.Status,
-                        &b.Amount)
+    return int(id), nil
+}
 
-        bets = append(bets, b)
-    }
-    if err = rows.Err(); err != nil{
-        return nil, errors.New("Error when scanning the RetrieveBets query")
+// betFilters are the columns bets can be listed by.
+var betFilters = map[string]bool{
+    "bettor_id": true,
+    "betted_id": true,
+    "witness_id": true,
+    "winner_id": true,
+    "status": true,
+}
+
+// GetBets retrieves the bets a viewer may see, filtered by bet columns, a
+// "category" and a "tag". Other parameters are ignored.
+func (db *MyDB) GetBets(ctx context.Context, viewerId int, params map[string] string) ([]Bet, error){
+
+    where := "1 = 1"
+    args := make([]interface{}, 0)
+    for k, v := range params {
+        switch {
+        case betFilters[k]:
+            where += " and b." + k + " = ?"
+        case k == "category":
+            where += " and b.id in (select bet_id from bet_categories where category = ?)"
+        case k == "tag":
+            where += " and b.id in (select bet_id from bet_tags where tag = ?)"
+        default:
+            continue
+        }
+        args = append(args, v)
     }
 
-    return bets[0:], nil
+    return db.queryBets(ctx, viewerId, where, args...)
 }
 
 // GetBet retrieves a specific bet by it's id in the database.
-func (db *MyDB) GetBet(id int) (*Bet, error){
+func (db *MyDB) GetBet(ctx context.Context, id int) (*Bet, error){
+    return getBet(ctx, db, id)
+}
+
+func getBet(ctx context.Context, q Queryer, id int) (*Bet, error) {
     var b Bet
-    err := db.QueryRow("select * from bet where id = ?", id).Scan(&b.Id,
-                                                                  &b.BettorId,
-                                                                  &b.BettedId,
-                                                                  &b.WitnessId,
-                                                                  &b.WinnerId,
-                                                                  &b.Title,
-                                                                  &b.Desc,
-                                                                  &b.CreatedOn,
-                                                                  &b.Status,
-                                                                  &b.Amount)
+
+    row := q.QueryRowContext(ctx, "select " + betColumns + " from bets where id = ?", id)
+    err := row.Scan(&b.Id,
+                    &b.BettorId,
+                    &b.BettedId,
+                    &b.WitnessId,
+                    &b.WinnerId,
+                    &b.Title,
+                    &b.Desc,
+                    &b.CreatedOn,
+                    &b.Status,
+                    &b.Amount)
     if err != nil{
         return nil, errors.New("Error when executing the RetrieveBet query")
     }
 
+    if err = loadParticipants(ctx, q, &b); err != nil {
+        return nil, err
+    }
+
+    if err = loadOdds(ctx, q, &b); err != nil {
+        return nil, err
+    }
+
+    if err = loadDeadline(ctx, q, &b); err != nil {
+        return nil, err
+    }
+
+    if err = loadVisibility(ctx, q, &b); err != nil {
+        return nil, err
+    }
+
+    if err = loadLabels(ctx, q, &b); err != nil {
+        return nil, err
+    }
+
+    if m, ok := b.Member(b.BettedId); ok && m.Role == "player" && m.Stake != b.Amount {
+        b.BettedStake = m.Stake
+    }
+
     return &b, nil
 }
 
-// DeleteBet deletes a bet.
+// DeleteBet deletes a bet on behalf of its bettor.
 // Doesn't delete the row from the actual table. 
 // Toggles the is_deleted attribute in the database.
-func (db *MyDB) DeleteBet(id int) error{
+func (db *MyDB) DeleteBet(ctx context.Context, actorId int, id int) error{
 
-    query, err := db.Prepare("update bets set is_deleted = 1 where id = ?")
-    if err != nil{
-        return errors.New("Error when preparing the DeleteBet query")
-    }
+    return db.InTx(ctx, func(tx *Tx) error {
+        var status string
+        var bettorId int
+        err := tx.QueryRowContext(ctx, "select status, bettor_id from bets where id = ? and is_deleted = 0 for update", id).
+                  Scan(&status, &bettorId)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(id))
+        }
 
-    _, err = query.Exec(id)
-    if err != nil{
-        return errors.New("Error when executing the DeleteBet query")
-    }
+        if actorId != bettorId {
+            return errors.New("Only the bettor can delete a bet")
+        }
 
-    return nil
+        _, err = tx.ExecContext(ctx, "update bets set is_deleted = 1 where id = ?", id)
+        if err != nil{
+            return errors.New("Error when executing the DeleteBet query")
+        }
+
+        err = tx.RecordBetChange(ctx, BetChange{ BetId: id, ActorId: actorId, Action: "deleted", OldStatus: status, NewStatus: status })
+        if err != nil {
+            return err
+        }
+
+        return tx.BetEvent(ctx, "bet.deleted", id)
+    })
 }
 
-// UpdateBetStatus updates the status of a bet.
-// Status can only set to "declined", "pending", "active", and "settled".
-// Status "settled" charges
-func (db *MyDB) UpdateBetStatus(id int, status string, winnerId int) error {
+// betTransitions are the statuses a bet may move to from each status through
+// UpdateBetStatus. Disputed bets are settled by their witnesses' votes or by staff.
+var betTransitions = map[string]map[string]bool{
+    "pending": { "active": true, "declined": true },
+    "active": { "disputed": true, "settled": true },
+}
+
+// UpdateBetStatus updates the status of a bet on behalf of an actor.
+// Pending bets can become "active" or "declined", by the betted user, and
+// active bets "disputed", by a player, or "settled".
+// Settling a two-person bet pays the pool to the winner, who must be the
+// bettor or the betted user, and can only be done by its witness; group bets
+// are settled by their witnesses' votes instead.
+// The change is recorded in the bet's history under the actor, with an optional reason.
+func (db *MyDB) UpdateBetStatus(ctx context.Context, actorId int, id int, status string, winnerId int, reason string) error {
 
     settled := status == "settled"
-    q := "update bets set status=?"
 
-    if settled {
-        q += ", winner_id=?"
+    typ, ok := betEventTypes[status]
+    if !ok {
+        typ = "bet.updated"
     }
 
-    q += " where id = ? and is_deleted = 0"
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var oldStatus string
+        err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", id).Scan(&oldStatus)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(id))
+        }
 
-    query, err := db.Prepare(q)
-    if err != nil {
-        return errors.New("Failed to update bet status")
-    }
+        if !betTransitions[oldStatus][status] {
+            return errors.New("A bet that is " + oldStatus + " can't become " + status)
+        }
 
-    if settled {
-        _, err := query.Exec(status, winnerId, id)
+        b, err := getBet(ctx, tx, id)
         if err != nil {
+            return err
+        }
+
+        if settled {
+            if m, ok := b.Member(actorId); !ok || m.Role != "witness" {
+                return errors.New("Only the witness of a bet can settle it")
+            }
+            if b.Kind == "group" {
+                return errors.New("Group bets are settled by their witnesses")
+            }
+
+            winner, ok := b.Member(winnerId)
+            if !ok || winner.Role != "player" {
+                return errors.New("The winner must be the bettor or the betted user")
+            }
+            return tx.settle(ctx, b, winner.Side, actorId, reason)
+        }
+
+        // a bet that starts has to fit within the limits of everyone playing
+        if oldStatus == "pending" && status == "active" {
+            for _, m := range b.Members {
+                if m.Role != "player" {
+                    continue
+                }
+                if err = tx.checkLimits(ctx, m.UserId, id, m.Stake); err != nil {
+                    return err
+                }
+            }
+        }
+
+        // the betted user answers a bet, or the creator starts a group bet;
+        // either player can dispute the witness's call
+        switch status {
+        case "active", "declined":
+            responder := b.BettedId
+            if b.Kind == "group" {
+                responder = b.BettorId
+            }
+            if actorId != responder {
+                return errors.New("Only the betted user can accept or decline a bet")
+            }
+        case "disputed":
+            if m, ok := b.Member(actorId); !ok || m.Role != "player" {
+                return errors.New("Only the players of a bet can dispute it")
+            }
+        }
+
+        // accepting or declining a bet answers its open offer
+        if oldStatus == "pending" && (status == "active" || status == "declined") {
+            if err = tx.answerOpenOffer(ctx, b, actorId, status); err != nil {
+                return err
+            }
+        }
+
+        if _, err := tx.ExecContext(ctx, "update bets set status = ? where id = ?", status, id); err != nil {
             return errors.New("Failed to update bet status")
         }
-    } else {
-        _, err := query.Exec(status, id)
+
+        if b, err = getBet(ctx, tx, id); err != nil {
+            return err
+        }
+
+        // disputes carry the evidence they are about
+        if status == "disputed" {
+            if b.Evidence, err = getBetEvidence(ctx, tx, id); err != nil {
+                return err
+            }
+        }
+
+        err = tx.RecordBetChange(ctx, BetChange{
+            BetId: id,
+            ActorId: actorId,
+            Action: "status",
+            OldStatus: oldStatus,
+            NewStatus: status,
+            WinnerId: b.WinnerId,
+            Reason: reason,
+        })
         if err != nil {
-            return errors.New("Failed to update bet status")
+            return err
         }
-    }
-    if err != nil{
-        return errors.New("Failed to update bet status")
+
+        return tx.Event(ctx, typ, id, b.Participants(), b)
+    })
+    if err != nil {
+        return err
     }
 
-    // if settled {
-    //     // 
-    // }
+    db.countBetStatus(ctx, id, status)
+    Logger(ctx).Info("bet status updated", "bet_id", id, "status", status)
 
     return nil
 
 }
 
+// countBetStatus updates the business metrics for a bet moving to a new status.
+func (db *MyDB) countBetStatus(ctx context.Context, id int, status string) {
+    switch status {
+    case "active":
+        betsAccepted.Inc()
+    case "disputed":
+        betsDisputed.Inc()
+    case "settled":
+        betsSettled.Inc()
+
+        // the cents that change hands: what the winners get beyond their stakes
+        var amount int
+        err := db.QueryRowContext(ctx, "select coalesce(sum(payout - stake), 0) from bet_participants " +
+                                       "where bet_id = ? and payout > stake", id).Scan(&amount)
+        if err == nil {
+            betsSettledCents.Add(float64(amount))
+        }
+    }
+}
+
 // BetExists checks if a bet with the given id exists.
-func (db *MyDB) BetExists(id int) bool {
+func (db *MyDB) BetExists(ctx context.Context, id int) bool {
     var tmp int
-    err := db.QueryRow("select id from bets where id = ? and is_deleted = 0", id).Scan(&tmp)
-    return err == sql.ErrNoRows
+    err := db.QueryRowContext(ctx, "select id from bets where id = ? and is_deleted = 0", id).Scan(&tmp)
+    return err == nil
 }
\ No newline at end of file
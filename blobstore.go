@@ -0,0 +1,339 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// ErrBlobNotFound is returned by a BlobStore for a key it doesn't hold.
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// A BlobStore keeps uploaded files by key. Keys are slash separated paths.
+type BlobStore interface {
+    // Put stores data under key, replacing anything already there.
+    Put(ctx context.Context, key string, data []byte, contentType string) error
+
+    // Get opens the data stored under key.
+    Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+    // Delete removes the data stored under key, if any.
+    Delete(ctx context.Context, key string) error
+}
+
+// BlobStoreFromEnv builds the blob store selected by BLOB_STORE: "local"
+// (the default) keeps files under BLOB_DIR, and "s3" uses an S3-compatible
+// service configured by the S3_* variables.
+func BlobStoreFromEnv() (BlobStore, error) {
+    switch EnvString("BLOB_STORE", "local") {
+    case "local":
+        return NewLocalBlobStore(EnvString("BLOB_DIR", "blobs"))
+    case "s3":
+        return &S3BlobStore{
+            Endpoint: EnvString("S3_ENDPOINT", "https://s3.amazonaws.com"),
+            Bucket: EnvString("S3_BUCKET", ""),
+            Region: EnvString("S3_REGION", "us-east-1"),
+            AccessKey: EnvString("S3_ACCESS_KEY_ID", ""),
+            SecretKey: EnvString("S3_SECRET_ACCESS_KEY", ""),
+        }, nil
+    }
+    return nil, errors.New("BLOB_STORE must be local or s3")
+}
+
+/* Local */
+
+// A LocalBlobStore keeps blobs as files under a directory.
+type LocalBlobStore struct {
+    Dir string
+}
+
+// NewLocalBlobStore creates a blob store in dir, creating the directory if needed.
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+    if err := os.MkdirAll(dir, 0750); err != nil {
+        return nil, errors.New("Failed to create blob directory: " + err.Error())
+    }
+    return &LocalBlobStore{ Dir: dir }, nil
+}
+
+// path maps a key to a file, refusing keys that would escape the directory.
+func (s *LocalBlobStore) path(key string) (string, error) {
+    clean := filepath.Clean("/" + key)
+    if clean == "/" || strings.Contains(key, "..") {
+        return "", errors.New("Invalid blob key " + key)
+    }
+    return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+// Put writes data to a temporary file and renames it into place, so readers
+// never see a partial blob.
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+    path, err := s.path(key)
+    if err != nil {
+        return err
+    }
+
+    if err = os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+        return errors.New("Failed to create blob directory: " + err.Error())
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+    if err != nil {
+        return errors.New("Failed to create blob: " + err.Error())
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err = tmp.Write(data); err != nil {
+        tmp.Close()
+        return errors.New("Failed to write blob: " + err.Error())
+    }
+    if err = tmp.Close(); err != nil {
+        return errors.New("Failed to write blob: " + err.Error())
+    }
+
+    if err = os.Rename(tmp.Name(), path); err != nil {
+        return errors.New("Failed to store blob: " + err.Error())
+    }
+    return nil
+}
+
+// Get opens the file of a blob.
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+    path, err := s.path(key)
+    if err != nil {
+        return nil, err
+    }
+
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil, ErrBlobNotFound
+    }
+    if err != nil {
+        return nil, errors.New("Failed to open blob: " + err.Error())
+    }
+    return f, nil
+}
+
+// Delete removes the file of a blob.
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+    path, err := s.path(key)
+    if err != nil {
+        return err
+    }
+
+    if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+        return errors.New("Failed to delete blob: " + err.Error())
+    }
+    return nil
+}
+
+/* S3 */
+
+// An S3BlobStore keeps blobs in a bucket of an S3-compatible service, such as
+// AWS S3 or MinIO, addressed path-style and signed with Signature Version 4.
+type S3BlobStore struct {
+    Endpoint string         // e.g. https://s3.amazonaws.com or http://localhost:9000
+    Bucket string
+    Region string
+    AccessKey string
+    SecretKey string
+    Client *http.Client     // http.DefaultClient if nil
+}
+
+// emptyHash is the SHA-256 of an empty payload.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3BlobStore) do(ctx context.Context, method string, key string, body []byte, contentType string) (resp *http.Response, err error) {
+
+    defer func(start time.Time) { ObserveOutbound("s3", start, err) }(time.Now())
+
+    u := strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + strings.TrimLeft(key, "/")
+    req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+    if err != nil {
+        return nil, errors.New("Unable to create S3 request: " + err.Error())
+    }
+
+    payloadHash := emptyHash
+    if len(body) > 0 {
+        sum := sha256.Sum256(body)
+        payloadHash = hex.EncodeToString(sum[:])
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+
+    SignV4(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, "s3", time.Now())
+
+    client := s.Client
+    if client == nil {
+        client = http.DefaultClient
+    }
+
+    resp, err = client.Do(req)
+    if err != nil {
+        return nil, errors.New("S3 request failed: " + err.Error())
+    }
+    return resp, nil
+}
+
+// Put uploads an object.
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+    resp, err := s.do(ctx, "PUT", key, data, contentType)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return errors.New("S3 rejected the upload: " + resp.Status)
+    }
+    return nil
+}
+
+// Get downloads an object.
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+    resp, err := s.do(ctx, "GET", key, nil, "")
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode == 404 {
+        resp.Body.Close()
+        return nil, ErrBlobNotFound
+    }
+    if resp.StatusCode >= 300 {
+        resp.Body.Close()
+        return nil, errors.New("S3 rejected the download: " + resp.Status)
+    }
+    return resp.Body, nil
+}
+
+// Delete removes an object. Deleting a missing object succeeds.
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+    resp, err := s.do(ctx, "DELETE", key, nil, "")
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 && resp.StatusCode != 404 {
+        return errors.New("S3 rejected the delete: " + resp.Status)
+    }
+    return nil
+}
+
+// SignV4 signs a request with AWS Signature Version 4, covering the host and
+// every header already set on the request.
+func SignV4(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, service string, now time.Time) {
+    now = now.UTC()
+    amzDate := now.Format("20060102T150405Z")
+    day := now.Format("20060102")
+
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    host := req.Host
+    if host == "" {
+        host = req.URL.Host
+    }
+
+    // canonical headers, sorted by lowercase name
+    headers := map[string]string{ "host": host }
+    for name, values := range req.Header {
+        headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+    }
+    names := make([]string, 0, len(headers))
+    for name := range headers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        canonicalPath(req.URL.EscapedPath()),
+        canonicalQuery(req.URL.Query()),
+        canonicalHeaders.String(),
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+
+    scope := day + "/" + region + "/" + service + "/aws4_request"
+    hashed := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+    key := hmacSHA256([]byte("AWS4" + secretKey), day)
+    key = hmacSHA256(key, region)
+    key = hmacSHA256(key, service)
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + scope +
+                                    ", SignedHeaders=" + signedHeaders + ", Signature=" + signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// canonicalPath re-encodes a path the way SigV4 expects: every byte but
+// unreserved characters and slashes percent-encoded.
+func canonicalPath(escaped string) string {
+    if escaped == "" {
+        return "/"
+    }
+
+    path, err := url.PathUnescape(escaped)
+    if err != nil {
+        path = escaped
+    }
+
+    segments := strings.Split(path, "/")
+    for i, seg := range segments {
+        segments[i] = sigV4Escape(seg)
+    }
+    return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts and encodes query parameters the way SigV4 expects.
+func canonicalQuery(values url.Values) string {
+    pairs := make([]string, 0)
+    for k, vs := range values {
+        for _, v := range vs {
+            pairs = append(pairs, sigV4Escape(k) + "=" + sigV4Escape(v))
+        }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
+
+func sigV4Escape(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+           c == '-' || c == '_' || c == '.' || c == '~' {
+            b.WriteByte(c)
+        } else {
+            b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+        }
+    }
+    return b.String()
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// A Category is a kind of bet from the fixed taxonomy bets are grouped by.
+type Category struct {
+    Slug string     `json:"slug"`
+    Name string     `json:"name"`
+}
+
+// Categories is the taxonomy of bets.
+var Categories = []Category{
+    { "sports", "Sports" },
+    { "fitness", "Fitness" },
+    { "trivia", "Trivia" },
+    { "games", "Games" },
+    { "entertainment", "Entertainment" },
+    { "politics", "Politics" },
+    { "weather", "Weather" },
+    { "food", "Food & drink" },
+    { "personal", "Personal goals" },
+    { "other", "Other" },
+}
+
+const (
+    // MaxTags is how many tags a bet can have.
+    MaxTags = 10
+
+    maxTagLength = 32
+)
+
+// BetLabels are how a bet is grouped: a category and free-form tags.
+type BetLabels struct {
+    Category string   `json:"category,omitempty"`
+    Tags []string     `json:"tags,omitempty"`
+}
+
+// ValidCategory reports whether slug is a category of the taxonomy.
+func ValidCategory(slug string) bool {
+    for _, c := range Categories {
+        if c.Slug == slug {
+            return true
+        }
+    }
+    return false
+}
+
+// NormalizeTags lowercases tags, joins their words with dashes and drops
+// duplicates, checking each is a short run of letters, digits and dashes.
+func NormalizeTags(tags []string) ([]string, error) {
+    seen := make(map[string]bool)
+    normalized := make([]string, 0, len(tags))
+
+    for _, t := range tags {
+        t = strings.Join(strings.Fields(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), "#"))), "-")
+        if t == "" || seen[t] {
+            continue
+        }
+        if len(t) > maxTagLength || strings.IndexFunc(t, func(r rune) bool {
+            return !(r == '-' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+        }) >= 0 {
+            return nil, errors.New("Tags must be at most 32 letters, digits and dashes: " + t)
+        }
+        seen[t] = true
+        normalized = append(normalized, t)
+    }
+
+    if len(normalized) > MaxTags {
+        return nil, errors.New("A bet can have at most " + strconv.Itoa(MaxTags) + " tags")
+    }
+    return normalized, nil
+}
+
+// ParseLabels reads a category and comma separated tags.
+func ParseLabels(category string, tags string) (BetLabels, error) {
+    var l BetLabels
+
+    if category != "" && !ValidCategory(category) {
+        return l, errors.New("Unknown category " + category)
+    }
+    l.Category = category
+
+    var err error
+    if tags != "" {
+        if l.Tags, err = NormalizeTags(strings.Split(tags, ",")); err != nil {
+            return l, err
+        }
+    }
+
+    return l, nil
+}
+
+// A Template pre-fills a new bet. Built-in templates belong to nobody; users
+// can also keep their own.
+type Template struct {
+    Id int               `json:"id"`
+    OwnerId int          `json:"owner_id,omitempty"`
+    Name string          `json:"name"`
+    Title string         `json:"title"`
+    Description string   `json:"description,omitempty"`
+    Amount int           `json:"amount,omitempty"`          // in cents
+    DurationDays int     `json:"duration_days,omitempty"`   // from creation to the deadline
+    BetLabels
+}
+
+// Validate checks a template can be saved.
+func (t *Template) Validate() error {
+    t.Name = strings.TrimSpace(t.Name)
+    t.Title = strings.TrimSpace(t.Title)
+    if t.Name == "" || len(t.Name) > 64 {
+        return errors.New("Templates need a name of at most 64 characters")
+    }
+    if t.Title == "" || len(t.Title) > 255 {
+        return errors.New("Templates need a title of at most 255 characters")
+    }
+    if t.Amount < 0 || t.DurationDays < 0 || t.DurationDays > 366 {
+        return errors.New("A template's amount can't be negative and its duration is at most a year")
+    }
+    if t.Category != "" && !ValidCategory(t.Category) {
+        return errors.New("Unknown category " + t.Category)
+    }
+
+    var err error
+    t.Tags, err = NormalizeTags(t.Tags)
+    return err
+}
+
+// Apply fills in the bet parameters a request left out from the template.
+func (t *Template) Apply(params map[string]string) {
+    defaults := map[string]string{
+        "title": t.Title,
+        "description": t.Description,
+        "category": t.Category,
+        "tags": strings.Join(t.Tags, ","),
+    }
+    if t.Amount > 0 {
+        defaults["amount"] = strconv.Itoa(t.Amount)
+    }
+    if t.DurationDays > 0 {
+        defaults["deadline"] = time.Now().UTC().AddDate(0, 0, t.DurationDays).Format(time.RFC3339)
+    }
+
+    for k, v := range defaults {
+        if _, ok := params[k]; !ok && v != "" {
+            params[k] = v
+        }
+    }
+}
+
+// CategoryStats are totals over the bets in a category. The user's results
+// are only there when the stats are for a user.
+type CategoryStats struct {
+    Category string   `json:"category"`
+    Bets int          `json:"bets"`
+    Active int        `json:"active"`
+    Settled int       `json:"settled"`
+    Volume int        `json:"volume"`            // cents staked, over bets without hidden amounts
+    Wins *int         `json:"wins,omitempty"`
+    Losses *int       `json:"losses,omitempty"`
+    Net *int          `json:"net,omitempty"`     // in cents
+}
+
+/* Store */
+
+// saveLabels sets the category and tags of a bet.
+func (tx *Tx) saveLabels(ctx context.Context, betId int, l BetLabels) error {
+    if l.Category != "" {
+        _, err := tx.ExecContext(ctx, "insert into bet_categories (bet_id, category) values (?, ?) " +
+                                      "on duplicate key update category = values(category)", betId, l.Category)
+        if err != nil {
+            return errors.New("Failed to store bet category: " + err.Error())
+        }
+    }
+
+    for _, t := range l.Tags {
+        if _, err := tx.ExecContext(ctx, "insert ignore into bet_tags (bet_id, tag) values (?, ?)", betId, t); err != nil {
+            return errors.New("Failed to store bet tag: " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+// loadLabels fills in the category and tags of a bet.
+func loadLabels(ctx context.Context, q Queryer, b *Bet) error {
+    err := q.QueryRowContext(ctx, "select category from bet_categories where bet_id = ?", b.Id).Scan(&b.Category)
+    if err != nil && err != sql.ErrNoRows {
+        return errors.New("Failed to load bet category: " + err.Error())
+    }
+
+    rows, err := q.QueryContext(ctx, "select tag from bet_tags where bet_id = ? order by tag", b.Id)
+    if err != nil {
+        return errors.New("Failed to load bet tags: " + err.Error())
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var t string
+        if err := rows.Scan(&t); err != nil {
+            return errors.New("Failed to scan bet tag: " + err.Error())
+        }
+        b.Tags = append(b.Tags, t)
+    }
+
+    return rows.Err()
+}
+
+const templateColumns = "id, owner_id, name, title, coalesce(description, ''), amount, duration_days, coalesce(category, ''), tags"
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (*Template, error) {
+    var t Template
+    var tags string
+
+    err := row.Scan(&t.Id, &t.OwnerId, &t.Name, &t.Title, &t.Description, &t.Amount, &t.DurationDays, &t.Category, &tags)
+    if err != nil {
+        return nil, err
+    }
+    if tags != "" {
+        t.Tags = strings.Split(tags, ",")
+    }
+
+    return &t, nil
+}
+
+// GetTemplates returns the built-in templates and a user's own, built-in first.
+func (db *MyDB) GetTemplates(ctx context.Context, userId int) ([]Template, error) {
+    rows, err := db.QueryContext(ctx, "select " + templateColumns + " from bet_templates " +
+                                      "where owner_id in (0, ?) order by owner_id, name", userId)
+    if err != nil {
+        return nil, errors.New("Failed query for templates: " + err.Error())
+    }
+    defer rows.Close()
+
+    templates := make([]Template, 0)
+    for rows.Next() {
+        t, err := scanTemplate(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan template row: " + err.Error())
+        }
+        templates = append(templates, *t)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over template rows: " + err.Error())
+    }
+
+    return templates, nil
+}
+
+// GetTemplate returns a template a user can use: a built-in one or their own.
+func (db *MyDB) GetTemplate(ctx context.Context, id int, userId int) (*Template, error) {
+    t, err := scanTemplate(db.QueryRowContext(ctx, "select " + templateColumns + " from bet_templates " +
+                                                   "where id = ? and owner_id in (0, ?)", id, userId))
+    if err != nil {
+        return nil, errors.New("No template found with id " + strconv.Itoa(id))
+    }
+    return t, nil
+}
+
+// CreateTemplate saves one of a user's own templates.
+func (db *MyDB) CreateTemplate(ctx context.Context, t Template) (*Template, error) {
+    res, err := db.ExecContext(ctx, "insert into bet_templates (owner_id, name, title, description, amount, duration_days, category, tags) " +
+                                    "values (?, ?, ?, nullif(?, ''), ?, ?, nullif(?, ''), ?)",
+                               t.OwnerId, t.Name, t.Title, t.Description, t.Amount, t.DurationDays, t.Category, strings.Join(t.Tags, ","))
+    if err != nil {
+        return nil, errors.New("Failed to save template: " + err.Error())
+    }
+
+    id, err := res.LastInsertId()
+    if err != nil {
+        return nil, errors.New("Failed to get template id: " + err.Error())
+    }
+
+    return db.GetTemplate(ctx, int(id), t.OwnerId)
+}
+
+// DeleteTemplate deletes one of a user's own templates.
+func (db *MyDB) DeleteTemplate(ctx context.Context, id int, userId int) error {
+    res, err := db.ExecContext(ctx, "delete from bet_templates where id = ? and owner_id = ? and owner_id != 0", id, userId)
+    if err != nil {
+        return errors.New("Failed to delete template: " + err.Error())
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errors.New("No template of yours found with id " + strconv.Itoa(id))
+    }
+    return nil
+}
+
+// GetCategoryStats returns totals for every category, with a user's results
+// in each when userId is set. A user's results only count the bets the viewer
+// may see, and leave out the amounts of those whose amount is hidden from them.
+func (db *MyDB) GetCategoryStats(ctx context.Context, userId int, viewerId int) ([]CategoryStats, error) {
+    byCategory := make(map[string]*CategoryStats)
+    for _, c := range Categories {
+        byCategory[c.Slug] = &CategoryStats{ Category: c.Slug }
+    }
+
+    rows, err := db.QueryContext(ctx, "select c.category, count(*), sum(b.status = 'active'), sum(b.status = 'settled'), " +
+                                      "coalesce(sum(if(coalesce(v.hide_amount, 0), 0, " +
+                                      "(select coalesce(sum(p.stake), 0) from bet_participants p where p.bet_id = b.id))), 0) " +
+                                      "from bet_categories c join bets b on b.id = c.bet_id and b.is_deleted = 0 " +
+                                      "left join bet_visibility v on v.bet_id = b.id group by c.category")
+    if err != nil {
+        return nil, errors.New("Failed query for category stats: " + err.Error())
+    }
+    for rows.Next() {
+        var s CategoryStats
+        if err := rows.Scan(&s.Category, &s.Bets, &s.Active, &s.Settled, &s.Volume); err != nil {
+            rows.Close()
+            return nil, errors.New("Failed to scan category stats: " + err.Error())
+        }
+        if c, ok := byCategory[s.Category]; ok {
+            *c = s
+        }
+    }
+    rows.Close()
+
+    if userId > 0 {
+        for _, s := range byCategory {
+            s.Wins, s.Losses, s.Net = new(int), new(int), new(int)
+        }
+
+        rows, err := db.QueryContext(ctx, "select c.category, sum(p.payout > p.stake), sum(p.payout < p.stake), " +
+                                          "coalesce(sum(if(coalesce(v.hide_amount, 0) and not exists (select 1 from bet_participants hp " +
+                                          "where hp.bet_id = b.id and hp.user_id = ?), 0, p.payout - p.stake)), 0) " +
+                                          "from bet_participants p join bet_categories c on c.bet_id = p.bet_id " +
+                                          "join bets b on b.id = p.bet_id and b.is_deleted = 0 " +
+                                          "left join bet_visibility v on v.bet_id = b.id " +
+                                          "where p.user_id = ? and p.role = 'player' and p.payout is not null and " + visibleTo + " " +
+                                          "group by c.category", viewerId, userId, viewerId, viewerId)
+        if err != nil {
+            return nil, errors.New("Failed query for user category stats: " + err.Error())
+        }
+        for rows.Next() {
+            var category string
+            var wins, losses, net int
+            if err := rows.Scan(&category, &wins, &losses, &net); err != nil {
+                rows.Close()
+                return nil, errors.New("Failed to scan user category stats: " + err.Error())
+            }
+            if s, ok := byCategory[category]; ok {
+                *s.Wins, *s.Losses, *s.Net = wins, losses, net
+            }
+        }
+        rows.Close()
+    }
+
+    stats := make([]CategoryStats, 0, len(Categories))
+    for _, c := range Categories {
+        stats = append(stats, *byCategory[c.Slug])
+    }
+
+    // the busiest categories first, keeping the taxonomy order among equals
+    sort.SliceStable(stats, func(i, j int) bool {
+        return stats[i].Bets > stats[j].Bets
+    })
+
+    return stats, nil
+}
+
+/* Handlers */
+
+// CategoriesHandler lists the bet categories.
+// Handles GET to /categories.
+func (db *MyDB) CategoriesHandler(rw http.ResponseWriter, r *http.Request) {
+    WriteData(rw, 200, Categories)
+}
+
+// CategoryStatsHandler shows totals for every category, and a user's results in
+// each on the bets the authenticated user, if any, may see.
+// Handles GET to /categories/stats, with an optional "user_id".
+func (db *MyDB) CategoryStatsHandler(rw http.ResponseWriter, r *http.Request) {
+    userId := 0
+    if v := r.URL.Query().Get("user_id"); v != "" {
+        var err error
+        if userId, err = strconv.Atoi(v); err != nil || !db.UserExists(r.Context(), userId) {
+            WriteError(rw, 404, "No user found with id " + v)
+            return
+        }
+    }
+
+    stats, err := db.GetCategoryStats(r.Context(), userId, db.Viewer(r))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, stats)
+}
+
+// TemplatesShowHandler lists the built-in templates and the authenticated user's own.
+// Handles GET to /templates.
+func (db *MyDB) TemplatesShowHandler(rw http.ResponseWriter, r *http.Request) {
+    templates, err := db.GetTemplates(r.Context(), db.Viewer(r))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, templates)
+}
+
+// TemplatesCreateHandler saves a template of the authenticated user's.
+// Handles POST to /templates.
+func (db *MyDB) TemplatesCreateHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var t Template
+    if err = json.Unmarshal(body, &t); err != nil {
+        WriteError(rw, 400, "Body must be a template: " + err.Error())
+        return
+    }
+    t.OwnerId = userId
+
+    if err = t.Validate(); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    saved, err := db.CreateTemplate(r.Context(), t)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, saved)
+}
+
+// TemplateDeleteHandler deletes a template of the authenticated user's.
+// Handles DELETE to /templates/{id}.
+func (db *MyDB) TemplateDeleteHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    if err = db.DeleteTemplate(r.Context(), id, userId); err != nil {
+        WriteError(rw, 404, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
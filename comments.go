@@ -0,0 +1,411 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+const (
+    // MaxCommentLength is the longest comment body, in characters.
+    MaxCommentLength = 2000
+
+    // defaultCommentEditWindow is how long authors can edit a comment, overridable with COMMENT_EDIT_WINDOW.
+    defaultCommentEditWindow = 15 * time.Minute
+)
+
+// A Comment is a message on a bet's thread. Replies point at their parent.
+type Comment struct {
+    Id int                  `json:"id"`
+    BetId int               `json:"bet_id"`
+    UserId int              `json:"user_id"`
+    ParentId int            `json:"parent_id,omitempty"`
+    Body string             `json:"body"`
+    Mentions []int          `json:"mentions,omitempty"`
+    CreatedOn time.Time     `json:"created_on"`
+    EditedOn *time.Time     `json:"edited_on,omitempty"`
+    Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Editable reports whether a comment can still be edited at a time.
+func (c *Comment) Editable(now time.Time) bool {
+    return !c.Deleted && now.Before(c.CreatedOn.Add(EnvDuration("COMMENT_EDIT_WINDOW", defaultCommentEditWindow)))
+}
+
+var mentionPattern = regexp.MustCompile(`@([0-9]+)\b`)
+
+// Mentions returns the participants of a bet mentioned in a comment body as
+// @<user id>, other than the author. Anyone else can't see the thread, so isn't notified.
+func Mentions(body string, b *Bet, authorId int) []int {
+    mentions := make([]int, 0)
+    seen := make(map[int]bool)
+
+    for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+        id, err := strconv.Atoi(m[1])
+        if err != nil || id == authorId || seen[id] || !b.IsParticipant(id) {
+            continue
+        }
+        seen[id] = true
+        mentions = append(mentions, id)
+    }
+
+    return mentions
+}
+
+/* Store */
+
+const commentColumns = "id, bet_id, user_id, coalesce(parent_id, 0), body, created_on, edited_on, is_deleted"
+
+func scanComment(row interface{ Scan(...interface{}) error }) (*Comment, error) {
+    var c Comment
+    var edited sql.NullTime
+
+    if err := row.Scan(&c.Id, &c.BetId, &c.UserId, &c.ParentId, &c.Body, &c.CreatedOn, &edited, &c.Deleted); err != nil {
+        return nil, err
+    }
+    if edited.Valid {
+        c.EditedOn = &edited.Time
+    }
+    if c.Deleted {
+        c.Body = ""
+    }
+
+    return &c, nil
+}
+
+// GetComment returns a comment. Deleted comments come back without their body.
+func (db *MyDB) GetComment(ctx context.Context, id int) (*Comment, error) {
+    return getComment(ctx, db, id)
+}
+
+func getComment(ctx context.Context, q Queryer, id int) (*Comment, error) {
+    c, err := scanComment(q.QueryRowContext(ctx, "select " + commentColumns + " from bet_comments where id = ?", id))
+    if err != nil {
+        return nil, errors.New("Failed to get comment: " + err.Error())
+    }
+    return c, nil
+}
+
+// GetComments returns a page of a bet's comments, oldest first, after the
+// comment id in cursor, along with the cursor of the next page.
+func (db *MyDB) GetComments(ctx context.Context, b *Bet, cursor int, limit int) ([]Comment, string, error) {
+    rows, err := db.QueryContext(ctx, "select " + commentColumns + " from bet_comments " +
+                                      "where bet_id = ? and id > ? order by id limit ?", b.Id, cursor, limit + 1)
+    if err != nil {
+        return nil, "", errors.New("Failed query for comments: " + err.Error())
+    }
+    defer rows.Close()
+
+    comments := make([]Comment, 0)
+    for rows.Next() {
+        c, err := scanComment(rows)
+        if err != nil {
+            return nil, "", errors.New("Failed to scan comment row: " + err.Error())
+        }
+        c.Mentions = Mentions(c.Body, b, c.UserId)
+        comments = append(comments, *c)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, "", errors.New("Failed while iterating over comment rows: " + err.Error())
+    }
+
+    // the extra row only tells us there is a next page
+    next := ""
+    if len(comments) > limit {
+        comments = comments[:limit]
+        next = strconv.Itoa(comments[limit - 1].Id)
+    }
+
+    return comments, next, nil
+}
+
+// CreateComment posts a comment on a bet, as a reply if parentId is set, and
+// notifies the participants and anyone mentioned.
+func (db *MyDB) CreateComment(ctx context.Context, b *Bet, userId int, parentId int, body string) (*Comment, error) {
+
+    var c *Comment
+    err := db.InTx(ctx, func(tx *Tx) error {
+        if parentId > 0 {
+            parent, err := getComment(ctx, tx, parentId)
+            if err != nil || parent.BetId != b.Id {
+                return errors.New("No comment found with id " + strconv.Itoa(parentId) + " on this bet")
+            }
+        }
+
+        res, err := tx.ExecContext(ctx, "insert into bet_comments (bet_id, user_id, parent_id, body) values (?, ?, ?, ?)",
+                                   b.Id, userId, nullId(parentId), body)
+        if err != nil {
+            return errors.New("Failed to insert comment: " + err.Error())
+        }
+
+        id, err := res.LastInsertId()
+        if err != nil {
+            return errors.New("Failed to get comment id: " + err.Error())
+        }
+
+        if c, err = getComment(ctx, tx, int(id)); err != nil {
+            return err
+        }
+        c.Mentions = Mentions(c.Body, b, userId)
+
+        return tx.commentEvents(ctx, "comment.created", b, c, c.Mentions)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    Logger(ctx).Info("comment created", "comment_id", c.Id, "bet_id", b.Id, "user_id", userId)
+
+    return c, nil
+}
+
+// EditComment changes the body of a comment. Only users newly mentioned are notified.
+func (db *MyDB) EditComment(ctx context.Context, b *Bet, c *Comment, body string) (*Comment, error) {
+
+    before := make(map[int]bool)
+    for _, id := range Mentions(c.Body, b, c.UserId) {
+        before[id] = true
+    }
+
+    var edited *Comment
+    err := db.InTx(ctx, func(tx *Tx) error {
+        _, err := tx.ExecContext(ctx, "update bet_comments set body = ?, edited_on = utc_timestamp() where id = ? and is_deleted = 0", body, c.Id)
+        if err != nil {
+            return errors.New("Failed to update comment: " + err.Error())
+        }
+
+        if edited, err = getComment(ctx, tx, c.Id); err != nil {
+            return err
+        }
+        edited.Mentions = Mentions(edited.Body, b, edited.UserId)
+
+        added := make([]int, 0)
+        for _, id := range edited.Mentions {
+            if !before[id] {
+                added = append(added, id)
+            }
+        }
+
+        return tx.commentEvents(ctx, "comment.edited", b, edited, added)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return edited, nil
+}
+
+// DeleteComment deletes a comment. Its replies stay in the thread.
+func (db *MyDB) DeleteComment(ctx context.Context, b *Bet, c *Comment) error {
+    return db.InTx(ctx, func(tx *Tx) error {
+        if _, err := tx.ExecContext(ctx, "update bet_comments set is_deleted = 1 where id = ?", c.Id); err != nil {
+            return errors.New("Failed to delete comment: " + err.Error())
+        }
+
+        deleted, err := getComment(ctx, tx, c.Id)
+        if err != nil {
+            return err
+        }
+
+        return tx.commentEvents(ctx, "comment.deleted", b, deleted, nil)
+    })
+}
+
+// commentEvents stores a comment event for the participants of its bet, and a
+// comment.mentioned event for each user in mentions.
+func (tx *Tx) commentEvents(ctx context.Context, typ string, b *Bet, c *Comment, mentions []int) error {
+    if err := tx.Event(ctx, typ, b.Id, b.Participants(), c); err != nil {
+        return err
+    }
+
+    for _, id := range mentions {
+        if err := tx.Event(ctx, "comment.mentioned", b.Id, []int{id}, c); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+/* Handlers */
+
+// participantBet loads the bet in the path, checking the authenticated user takes part in it.
+func (db *MyDB) participantBet(rw http.ResponseWriter, r *http.Request) (*Bet, int, bool) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return nil, 0, false
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    if !db.BetExists(r.Context(), id) {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
+        return nil, 0, false
+    }
+
+    b, err := db.GetBet(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 500, "Unable to retrieve bet")
+        return nil, 0, false
+    }
+
+    if !b.IsParticipant(userId) {
+        WriteError(rw, 403, "Only the bettor, betted user and witness can see a bet's comments")
+        return nil, 0, false
+    }
+
+    return b, userId, true
+}
+
+// commentBody reads the "body" and optional "parent_id" of a comment request.
+func commentBody(r *http.Request) (string, int, error) {
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return "", 0, errors.New("Failed to parse body: " + err.Error())
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        return "", 0, errors.New("Body must be a JSON object: " + err.Error())
+    }
+
+    text := strings.TrimSpace(params["body"])
+    if text == "" {
+        return "", 0, errors.New("Required parameter 'body' is not present")
+    }
+    if len([]rune(text)) > MaxCommentLength {
+        return "", 0, errors.New("Comments are limited to " + strconv.Itoa(MaxCommentLength) + " characters")
+    }
+
+    parentId := 0
+    if p, ok := params["parent_id"]; ok {
+        if parentId, err = strconv.Atoi(p); err != nil {
+            return "", 0, errors.New("Parameter 'parent_id' must be an integer")
+        }
+    }
+
+    return text, parentId, nil
+}
+
+// BetCommentsShowHandler lists a page of a bet's comments, oldest first.
+// Handles GET to /bets/{id}/comments.
+func (db *MyDB) BetCommentsShowHandler(rw http.ResponseWriter, r *http.Request) {
+    b, _, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    cursor, err := PageCursor(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    comments, next, err := db.GetComments(r.Context(), b, int(cursor), PageLimit(r, 50, 200))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WritePage(rw, comments, next)
+}
+
+// BetCommentsCreateHandler posts a comment on a bet.
+// Handles POST to /bets/{id}/comments.
+func (db *MyDB) BetCommentsCreateHandler(rw http.ResponseWriter, r *http.Request) {
+    b, userId, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    body, parentId, err := commentBody(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    c, err := db.CreateComment(r.Context(), b, userId, parentId, body)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, c)
+}
+
+// ownComment loads the comment in the path, checking the authenticated user wrote it.
+func (db *MyDB) ownComment(rw http.ResponseWriter, r *http.Request) (*Bet, *Comment, bool) {
+    b, userId, ok := db.participantBet(rw, r)
+    if !ok {
+        return nil, nil, false
+    }
+
+    commentId, _ := strconv.Atoi(mux.Vars(r)["comment_id"])
+    c, err := db.GetComment(r.Context(), commentId)
+    if err != nil || c.BetId != b.Id || c.Deleted {
+        WriteError(rw, 404, "No comment found with id " + strconv.Itoa(commentId))
+        return nil, nil, false
+    }
+
+    if c.UserId != userId {
+        WriteError(rw, 403, "Only the author can change a comment")
+        return nil, nil, false
+    }
+
+    return b, c, true
+}
+
+// BetCommentUpdateHandler edits a comment, within the edit window.
+// Handles PUT and POST to /bets/{id}/comments/{comment_id}.
+func (db *MyDB) BetCommentUpdateHandler(rw http.ResponseWriter, r *http.Request) {
+    b, c, ok := db.ownComment(rw, r)
+    if !ok {
+        return
+    }
+
+    if !c.Editable(time.Now()) {
+        WriteError(rw, 403, "Comments can only be edited shortly after they are posted")
+        return
+    }
+
+    body, _, err := commentBody(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    edited, err := db.EditComment(r.Context(), b, c, body)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, edited)
+}
+
+// BetCommentDeleteHandler deletes a comment.
+// Handles DELETE to /bets/{id}/comments/{comment_id}.
+func (db *MyDB) BetCommentDeleteHandler(rw http.ResponseWriter, r *http.Request) {
+    b, c, ok := db.ownComment(rw, r)
+    if !ok {
+        return
+    }
+
+    if err := db.DeleteComment(r.Context(), b, c); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
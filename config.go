@@ -0,0 +1,68 @@
+package main
+
+import (
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/* Environment */
+
+// EnvString returns the value of an environment variable, or def if it is unset.
+func EnvString(key string, def string) string {
+    if v, ok := os.LookupEnv(key); ok {
+        return v
+    }
+    return def
+}
+
+// EnvList returns a comma separated environment variable as a list, or def if it is unset.
+func EnvList(key string, def []string) []string {
+    v, ok := os.LookupEnv(key)
+    if !ok {
+        return def
+    }
+
+    list := make([]string, 0)
+    for _, item := range strings.Split(v, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+
+    return list
+}
+
+// EnvBool returns a boolean environment variable, or def if it is unset or malformed.
+func EnvBool(key string, def bool) bool {
+    b, err := strconv.ParseBool(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return b
+}
+
+// EnvInt returns an integer environment variable, or def if it is unset or malformed.
+func EnvInt(key string, def int) int {
+    i, err := strconv.Atoi(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return i
+}
+
+// EnvDuration returns a duration environment variable, such as "10m", or def
+// if it is unset or malformed. Bare integers are read as seconds.
+func EnvDuration(key string, def time.Duration) time.Duration {
+    v := os.Getenv(key)
+    if secs, err := strconv.Atoi(v); err == nil {
+        return time.Duration(secs) * time.Second
+    }
+
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        return def
+    }
+    return d
+}
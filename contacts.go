@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "errors"
     "strconv"
 
@@ -20,7 +21,7 @@ type ContactPair struct{
     UserId int          `json:"user_id"`
 }
 
-func (db *MyDB) CheckPhoneNumbers(phoneNumbers []string) ([]ContactPair, error){
+func (db *MyDB) CheckPhoneNumbers(ctx context.Context, phoneNumbers []string) ([]ContactPair, error){
 
     contactpairs := make([]ContactPair, 0)
     var cp ContactPair
@@ -32,7 +33,7 @@ func (db *MyDB) CheckPhoneNumbers(phoneNumbers []string) ([]ContactPair, error){
     }
     query = query[:len(query) - 2]
 
-    rows, err := db.Query(query)
+    rows, err := db.QueryContext(ctx, query)
     if err != nil{
         return nil, errors.New("Error when executing the CheckPhoneNumbers query")
     }
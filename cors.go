@@ -0,0 +1,173 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// corsMethods are the methods a preflight can be answered for.
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// A CORSConfig describes which cross-origin requests the API accepts.
+type CORSConfig struct {
+    AllowedOrigins []string     // "*" allows any origin, unless credentials are allowed
+    AllowedMethods []string     // empty allows whatever the route serves
+    AllowedHeaders []string
+    ExposedHeaders []string
+    AllowCredentials bool
+    MaxAge time.Duration
+}
+
+// CORSConfigFromEnv reads the CORS configuration from the environment.
+// Allowing credentials requires CORS_ALLOWED_ORIGINS to list the origins:
+// with "*" every site could make requests as a signed in user.
+func CORSConfigFromEnv() (CORSConfig, error) {
+    cfg := CORSConfig{
+        AllowedOrigins: EnvList("CORS_ALLOWED_ORIGINS", []string{"*"}),
+        AllowedMethods: EnvList("CORS_ALLOWED_METHODS", nil),
+        AllowedHeaders: EnvList("CORS_ALLOWED_HEADERS", []string{"Origin",
+                                                                 "Content-Type",
+                                                                 "Accept",
+                                                                 "Authorization",
+                                                                 RequestIDHeader}),
+        ExposedHeaders: EnvList("CORS_EXPOSED_HEADERS", []string{RequestIDHeader}),
+        AllowCredentials: EnvBool("CORS_ALLOW_CREDENTIALS", false),
+        MaxAge: EnvDuration("CORS_MAX_AGE", 10 * time.Minute),
+    }
+
+    if cfg.AllowCredentials && cfg.wildcard() {
+        return cfg, errors.New("CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list origins rather than *")
+    }
+    return cfg, nil
+}
+
+// wildcard reports whether "*" is among the allowed origins.
+func (c CORSConfig) wildcard() bool {
+    for _, o := range c.AllowedOrigins {
+        if o == "*" {
+            return true
+        }
+    }
+    return false
+}
+
+// originAllowed checks an Origin header against the allowed origins. "*" is
+// ignored when credentials are allowed, so only listed origins get them.
+func (c CORSConfig) originAllowed(origin string) bool {
+    for _, o := range c.AllowedOrigins {
+        if (o == "*" && !c.AllowCredentials) || strings.EqualFold(o, origin) {
+            return true
+        }
+    }
+    return false
+}
+
+// methodAllowed checks a method against the allowed methods.
+func (c CORSConfig) methodAllowed(method string) bool {
+    if len(c.AllowedMethods) == 0 {
+        return true
+    }
+    for _, m := range c.AllowedMethods {
+        if strings.EqualFold(m, method) {
+            return true
+        }
+    }
+    return false
+}
+
+// RouteMethods lists the methods the router serves at the path of a request.
+func RouteMethods(router *mux.Router, r *http.Request) []string {
+    methods := make([]string, 0)
+
+    for _, m := range corsMethods {
+        probe := *r
+        probe.Method = m
+
+        var match mux.RouteMatch
+        if router.Match(&probe, &match) {
+            methods = append(methods, m)
+        }
+    }
+
+    return methods
+}
+
+// CORSMiddleware adds CORS headers to responses for allowed origins and answers
+// OPTIONS requests with the methods served by the matching route.
+func CORSMiddleware(cfg CORSConfig, router *mux.Router) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+            origin := r.Header.Get("Origin")
+            allowed := origin != "" && cfg.originAllowed(origin)
+
+            if origin != "" {
+                rw.Header().Add("Vary", "Origin")
+            }
+
+            if allowed {
+                if cfg.AllowCredentials || !cfg.wildcard() {
+                    rw.Header().Set("Access-Control-Allow-Origin", origin)
+                } else {
+                    rw.Header().Set("Access-Control-Allow-Origin", "*")
+                }
+                if cfg.AllowCredentials {
+                    rw.Header().Set("Access-Control-Allow-Credentials", "true")
+                }
+            }
+
+            if r.Method != "OPTIONS" {
+                if allowed && len(cfg.ExposedHeaders) > 0 {
+                    rw.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+                }
+                next.ServeHTTP(rw, r)
+                return
+            }
+
+            // answer preflights and plain OPTIONS per route
+            methods := make([]string, 0)
+            for _, m := range RouteMethods(router, r) {
+                if cfg.methodAllowed(m) {
+                    methods = append(methods, m)
+                }
+            }
+
+            if len(methods) == 0 {
+                WriteError(rw, 404, "No route found for " + r.URL.Path)
+                return
+            }
+
+            allow := strings.Join(append(methods, "OPTIONS"), ", ")
+            rw.Header().Set("Allow", allow)
+
+            requested := r.Header.Get("Access-Control-Request-Method")
+            if requested != "" {
+                if !allowed {
+                    WriteError(rw, 403, "Origin " + origin + " is not allowed")
+                    return
+                }
+
+                served := false
+                for _, m := range methods {
+                    served = served || m == strings.ToUpper(requested)
+                }
+                if !served {
+                    WriteError(rw, 405, "Method " + requested + " is not allowed on " + r.URL.Path)
+                    return
+                }
+
+                rw.Header().Set("Access-Control-Allow-Methods", allow)
+                rw.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+                if cfg.MaxAge > 0 {
+                    rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+                }
+            }
+
+            rw.WriteHeader(204)
+        })
+    }
+}
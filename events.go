@@ -0,0 +1,422 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// An Event is something that happened to a bet, pushed to the users involved.
+type Event struct {
+    Id int64                    `json:"id"`
+    Type string                 `json:"type"`
+    BetId int                   `json:"bet_id,omitempty"`
+    Data json.RawMessage        `json:"data,omitempty"`
+    CreatedOn time.Time         `json:"created_on"`
+    UserIds []int               `json:"-"`
+}
+
+// For reports whether the event is addressed to a user.
+func (e Event) For(userId int) bool {
+    for _, id := range e.UserIds {
+        if id == userId {
+            return true
+        }
+    }
+    return false
+}
+
+// betEventTypes maps a bet status to the event type of moving into it.
+var betEventTypes = map[string]string{
+    "pending": "bet.created",
+    "active": "bet.accepted",
+    "declined": "bet.declined",
+    "disputed": "bet.disputed",
+    "settled": "bet.settled",
+}
+
+/* Pub/sub */
+
+// A PubSub fans events out to every subscriber, across instances if the
+// implementation supports it.
+type PubSub interface {
+    // Publish delivers an event, already stored in the events table, to subscribers.
+    Publish(ctx context.Context, e Event) error
+
+    // Subscribe returns a channel of published events and a function to stop receiving them.
+    Subscribe() (<-chan Event, func())
+}
+
+// A LocalPubSub delivers events to subscribers in the same process.
+type LocalPubSub struct {
+    mu sync.Mutex
+    subs map[chan Event]bool
+}
+
+// NewLocalPubSub creates an in-process pub/sub.
+func NewLocalPubSub() *LocalPubSub {
+    return &LocalPubSub{ subs: make(map[chan Event]bool) }
+}
+
+// Publish delivers an event to every subscriber. Subscribers that have fallen
+// behind miss the event; they can catch up from the events table on reconnect.
+func (ps *LocalPubSub) Publish(ctx context.Context, e Event) error {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+
+    for ch := range ps.subs {
+        select {
+        case ch <- e:
+        default:
+            Logger(ctx).Warn("dropping event for slow subscriber", "event_id", e.Id)
+        }
+    }
+
+    return nil
+}
+
+// Subscribe registers a new subscriber.
+func (ps *LocalPubSub) Subscribe() (<-chan Event, func()) {
+    ch := make(chan Event, 64)
+
+    ps.mu.Lock()
+    ps.subs[ch] = true
+    ps.mu.Unlock()
+
+    var once sync.Once
+    return ch, func() {
+        once.Do(func() {
+            ps.mu.Lock()
+            delete(ps.subs, ch)
+            ps.mu.Unlock()
+        })
+    }
+}
+
+// defaultEventGapTimeout is how long a skipped event id is watched for, overridable
+// with EVENTS_GAP_TIMEOUT.
+const defaultEventGapTimeout = time.Minute
+
+// A SQLPubSub shares events between instances by polling the events table,
+// handing new rows to a local pub/sub.
+//
+// Ids are handed out when rows are inserted but become visible when their
+// transaction commits, so a row can show up after rows with higher ids. Ids
+// skipped over are polled for until they appear or gapTimeout passes, which
+// also covers ids that were never committed.
+type SQLPubSub struct {
+    db *MyDB
+    local *LocalPubSub
+    interval time.Duration
+    gapTimeout time.Duration
+}
+
+// NewSQLPubSub creates a pub/sub that polls the events table every interval.
+func NewSQLPubSub(db *MyDB, interval time.Duration) *SQLPubSub {
+    return &SQLPubSub{ db: db, local: NewLocalPubSub(), interval: interval,
+                       gapTimeout: EnvDuration("EVENTS_GAP_TIMEOUT", defaultEventGapTimeout) }
+}
+
+// Publish does nothing: every instance, this one included, picks the event up
+// from the events table on its next poll.
+func (ps *SQLPubSub) Publish(ctx context.Context, e Event) error {
+    return nil
+}
+
+// Subscribe registers a new subscriber.
+func (ps *SQLPubSub) Subscribe() (<-chan Event, func()) {
+    return ps.local.Subscribe()
+}
+
+// Run polls for new events until ctx is done.
+func (ps *SQLPubSub) Run(ctx context.Context) {
+    var last int64
+    ps.db.QueryRowContext(ctx, "select coalesce(max(id), 0) from events").Scan(&last)
+
+    // ids below last not seen yet, and when they were first skipped
+    missing := make(map[int64]time.Time)
+
+    ticker := time.NewTicker(ps.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        now := time.Now()
+        for id, since := range missing {
+            if now.Sub(since) > ps.gapTimeout {
+                delete(missing, id)
+            }
+        }
+
+        if len(missing) > 0 {
+            ids := make([]int64, 0, len(missing))
+            for id := range missing {
+                ids = append(ids, id)
+            }
+
+            late, err := ps.db.getEventsByIds(ctx, ids)
+            if err != nil {
+                Logger(ctx).Error("polling for late events failed", "error", err)
+                continue
+            }
+            for _, e := range late {
+                ps.local.Publish(ctx, e)
+                delete(missing, e.Id)
+            }
+        }
+
+        events, err := ps.db.GetEventsSince(ctx, last, 0)
+        if err != nil {
+            Logger(ctx).Error("polling for events failed", "error", err)
+            continue
+        }
+
+        for _, e := range events {
+            // a jump larger than any burst of concurrent writers isn't a gap
+            // worth watching, e.g. after auto_increment was moved
+            for id := max(last + 1, e.Id - 1000); id < e.Id; id++ {
+                missing[id] = now
+            }
+            ps.local.Publish(ctx, e)
+            last = e.Id
+        }
+    }
+}
+
+/* Store */
+
+// GetEventsSince returns events after the given id, oldest first. With a
+// user id, only the events addressed to that user are returned.
+func (db *MyDB) GetEventsSince(ctx context.Context, since int64, userId int) ([]Event, error) {
+
+    where := "e.id > ? "
+    args := []interface{}{since}
+
+    if userId > 0 {
+        where += "and e.id in (select event_id from event_recipients where user_id = ?) "
+        args = append(args, userId)
+    }
+
+    return db.queryEvents(ctx, where, args...)
+}
+
+// getEventsByIds returns those of the given events that exist, oldest first.
+func (db *MyDB) getEventsByIds(ctx context.Context, ids []int64) ([]Event, error) {
+    if len(ids) > 500 {
+        ids = ids[:500]
+    }
+
+    args := make([]interface{}, len(ids))
+    for i, id := range ids {
+        args[i] = id
+    }
+
+    return db.queryEvents(ctx, "e.id in (?" + strings.Repeat(", ?", len(ids) - 1) + ") ", args...)
+}
+
+// queryEvents returns up to 500 events matching a where clause, oldest first.
+func (db *MyDB) queryEvents(ctx context.Context, where string, args ...interface{}) ([]Event, error) {
+
+    q := "select e.id, e.type, e.bet_id, e.data, e.created_on, group_concat(r.user_id) " +
+         "from events e join event_recipients r on r.event_id = e.id " +
+         "where " + where +
+         "group by e.id order by e.id limit 500"
+
+    rows, err := db.QueryContext(ctx, q, args...)
+    if err != nil {
+        return nil, errors.New("Failed query for events: " + err.Error())
+    }
+    defer rows.Close()
+
+    events := make([]Event, 0)
+    for rows.Next() {
+        var e Event
+        var betId sql.NullInt64
+        var data []byte
+        var recipients string
+
+        if err := rows.Scan(&e.Id, &e.Type, &betId, &data, &e.CreatedOn, &recipients); err != nil {
+            return nil, errors.New("Failed to scan event row: " + err.Error())
+        }
+
+        e.BetId = int(betId.Int64)
+        e.Data = json.RawMessage(data)
+        for _, s := range strings.Split(recipients, ",") {
+            if u, err := strconv.Atoi(s); err == nil {
+                e.UserIds = append(e.UserIds, u)
+            }
+        }
+
+        events = append(events, e)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over event rows: " + err.Error())
+    }
+
+    return events, nil
+}
+
+/* Handlers */
+
+// An eventWriter writes events to a client over a particular transport.
+type eventWriter interface {
+    WriteEvent(e Event) error
+    Heartbeat() error
+    Done() <-chan struct{}
+}
+
+// EventsHandler streams the bet events of the authenticated user as
+// Server-Sent Events, or over a WebSocket when the client asks to upgrade.
+// Clients resume after the id in Last-Event-ID (or the last_event_id parameter).
+// Handles GET to /events.
+func (db *MyDB) EventsHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    var last int64
+    lastId := r.Header.Get("Last-Event-ID")
+    if lastId == "" {
+        lastId = r.URL.Query().Get("last_event_id")
+    }
+    if lastId != "" {
+        if last, err = strconv.ParseInt(lastId, 10, 64); err != nil {
+            WriteError(rw, 400, "Last-Event-ID must be an integer")
+            return
+        }
+    }
+
+    // subscribe before catching up, so nothing published in between is missed
+    if db.Events == nil {
+        WriteError(rw, 503, "Events are not available")
+        return
+    }
+    live, unsubscribe := db.Events.Subscribe()
+    defer unsubscribe()
+
+    var w eventWriter
+    if IsWebSocketUpgrade(r) {
+        ws, err := UpgradeWebSocket(rw, r)
+        if err != nil {
+            WriteError(rw, 400, err.Error())
+            return
+        }
+        defer ws.Close()
+        w = ws
+    } else {
+        sse, err := newSSEWriter(rw, r)
+        if err != nil {
+            WriteError(rw, 500, err.Error())
+            return
+        }
+        w = sse
+    }
+
+    // catch up on what was missed, remembering what was sent so events that
+    // were published while catching up aren't sent twice
+    replayed := make(map[int64]bool)
+    for {
+        missed, err := db.GetEventsSince(r.Context(), last, userId)
+        if err != nil {
+            Logger(r.Context()).Error("failed to replay events", "error", err)
+            return
+        }
+        for _, e := range missed {
+            if err := w.WriteEvent(e); err != nil {
+                return
+            }
+            replayed[e.Id] = true
+            last = e.Id
+        }
+        if len(missed) < 500 {
+            break
+        }
+    }
+
+    heartbeat := time.NewTicker(25 * time.Second)
+    defer heartbeat.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-w.Done():
+            return
+        case <-heartbeat.C:
+            if err := w.Heartbeat(); err != nil {
+                return
+            }
+        case e := <-live:
+            // events can be published out of id order, so a lower id than the
+            // last one sent is still new unless the replay already sent it
+            if replayed[e.Id] || !e.For(userId) {
+                continue
+            }
+            if err := w.WriteEvent(e); err != nil {
+                return
+            }
+        }
+    }
+}
+
+// An sseWriter writes events in the text/event-stream format.
+type sseWriter struct {
+    rw http.ResponseWriter
+    rc *http.ResponseController
+    done chan struct{}
+}
+
+func newSSEWriter(rw http.ResponseWriter, r *http.Request) (*sseWriter, error) {
+    rc := http.NewResponseController(rw)
+
+    rw.Header().Set("Content-Type", "text/event-stream")
+    rw.Header().Set("Cache-Control", "no-cache")
+    rw.Header().Set("X-Accel-Buffering", "no")
+    rw.WriteHeader(200)
+
+    if err := rc.Flush(); err != nil {
+        return nil, errors.New("Streaming is not supported: " + err.Error())
+    }
+
+    return &sseWriter{ rw: rw, rc: rc, done: make(chan struct{}) }, nil
+}
+
+func (w *sseWriter) WriteEvent(e Event) error {
+    js, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+
+    if _, err = fmt.Fprintf(w.rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, js); err != nil {
+        return err
+    }
+    return w.rc.Flush()
+}
+
+func (w *sseWriter) Heartbeat() error {
+    if _, err := fmt.Fprint(w.rw, ": heartbeat\n\n"); err != nil {
+        return err
+    }
+    return w.rc.Flush()
+}
+
+// Done never fires: an SSE stream ends with the request context.
+func (w *sseWriter) Done() <-chan struct{} {
+    return w.done
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// EvidenceTypes are the content types accepted for uploaded evidence.
+var EvidenceTypes = map[string]bool{
+    "image/jpeg": true,
+    "image/png": true,
+    "image/gif": true,
+    "image/webp": true,
+}
+
+// defaultEvidenceMaxBytes is the largest upload, overridable with EVIDENCE_MAX_BYTES.
+const defaultEvidenceMaxBytes = 10 << 20
+
+// Evidence is a file or link attached to a bet to back up its outcome.
+type Evidence struct {
+    Id int                  `json:"id"`
+    BetId int               `json:"bet_id"`
+    UserId int              `json:"user_id"`
+    Kind string             `json:"kind"`     // file or link
+    Url string              `json:"url"`      // the link, or where to download the file
+    ContentType string      `json:"content_type,omitempty"`
+    Size int64              `json:"size,omitempty"`
+    Caption string          `json:"caption,omitempty"`
+    CreatedOn time.Time     `json:"created_on"`
+    BlobKey string          `json:"-"`
+}
+
+/* Store */
+
+const evidenceColumns = "id, bet_id, user_id, kind, coalesce(url, ''), coalesce(blob_key, ''), " +
+                        "coalesce(content_type, ''), size, coalesce(caption, ''), created_on"
+
+func scanEvidence(row interface{ Scan(...interface{}) error }) (*Evidence, error) {
+    var e Evidence
+
+    err := row.Scan(&e.Id, &e.BetId, &e.UserId, &e.Kind, &e.Url, &e.BlobKey,
+                    &e.ContentType, &e.Size, &e.Caption, &e.CreatedOn)
+    if err != nil {
+        return nil, err
+    }
+
+    if e.Kind == "file" {
+        e.Url = fmt.Sprintf("/%s/bets/%d/evidence/%d", CurrentVersion, e.BetId, e.Id)
+    }
+
+    return &e, nil
+}
+
+// GetEvidence returns a piece of evidence.
+func (db *MyDB) GetEvidence(ctx context.Context, id int) (*Evidence, error) {
+    return getEvidence(ctx, db, id)
+}
+
+func getEvidence(ctx context.Context, q Queryer, id int) (*Evidence, error) {
+    e, err := scanEvidence(q.QueryRowContext(ctx, "select " + evidenceColumns + " from bet_evidence where id = ?", id))
+    if err != nil {
+        return nil, errors.New("Failed to get evidence: " + err.Error())
+    }
+    return e, nil
+}
+
+// GetBetEvidence returns the evidence attached to a bet, oldest first.
+func (db *MyDB) GetBetEvidence(ctx context.Context, betId int) ([]Evidence, error) {
+    return getBetEvidence(ctx, db, betId)
+}
+
+func getBetEvidence(ctx context.Context, q Queryer, betId int) ([]Evidence, error) {
+    rows, err := q.QueryContext(ctx, "select " + evidenceColumns + " from bet_evidence where bet_id = ? order by id", betId)
+    if err != nil {
+        return nil, errors.New("Failed query for evidence: " + err.Error())
+    }
+    defer rows.Close()
+
+    evidence := make([]Evidence, 0)
+    for rows.Next() {
+        e, err := scanEvidence(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan evidence row: " + err.Error())
+        }
+        evidence = append(evidence, *e)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over evidence rows: " + err.Error())
+    }
+
+    return evidence, nil
+}
+
+// AddEvidence stores an uploaded file or a link as evidence on a bet and
+// notifies its participants. Files are written to the blob store first, so
+// a stored row always has its blob.
+func (db *MyDB) AddEvidence(ctx context.Context, b *Bet, e Evidence, data []byte) (*Evidence, error) {
+
+    if e.Kind == "file" {
+        if db.Blobs == nil {
+            return nil, errors.New("Uploads are not available")
+        }
+
+        name := make([]byte, 16)
+        if _, err := rand.Read(name); err != nil {
+            return nil, errors.New("Failed to name upload: " + err.Error())
+        }
+        e.BlobKey = fmt.Sprintf("bets/%d/%s", b.Id, hex.EncodeToString(name))
+
+        if err := db.Blobs.Put(ctx, e.BlobKey, data, e.ContentType); err != nil {
+            return nil, err
+        }
+    }
+
+    var added *Evidence
+    err := db.InTx(ctx, func(tx *Tx) error {
+        res, err := tx.ExecContext(ctx, "insert into bet_evidence (bet_id, user_id, kind, url, blob_key, content_type, size, caption) " +
+                                        "values (?, ?, ?, nullif(?, ''), nullif(?, ''), nullif(?, ''), ?, nullif(?, ''))",
+                                   b.Id, e.UserId, e.Kind, e.Url, e.BlobKey, e.ContentType, e.Size, e.Caption)
+        if err != nil {
+            return errors.New("Failed to insert evidence: " + err.Error())
+        }
+
+        id, err := res.LastInsertId()
+        if err != nil {
+            return errors.New("Failed to get evidence id: " + err.Error())
+        }
+
+        if added, err = getEvidence(ctx, tx, int(id)); err != nil {
+            return err
+        }
+
+        return tx.Event(ctx, "evidence.added", b.Id, b.Participants(), added)
+    })
+    if err != nil {
+        if e.BlobKey != "" {
+            db.Blobs.Delete(ctx, e.BlobKey)
+        }
+        return nil, err
+    }
+
+    Logger(ctx).Info("evidence added", "evidence_id", added.Id, "bet_id", b.Id, "kind", added.Kind)
+
+    return added, nil
+}
+
+/* Handlers */
+
+// readEvidence reads an evidence upload: either a multipart form with a
+// "file" and optional "caption", or a JSON body with a "url" and optional "caption".
+func readEvidence(rw http.ResponseWriter, r *http.Request) (Evidence, []byte, error) {
+    maxBytes := int64(EnvInt("EVIDENCE_MAX_BYTES", defaultEvidenceMaxBytes))
+    var e Evidence
+
+    // leave room for the form fields around the file
+    r.Body = http.MaxBytesReader(rw, r.Body, maxBytes + 64 << 10)
+    defer r.Body.Close()
+
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+        if err := r.ParseMultipartForm(maxBytes); err != nil {
+            return e, nil, errors.New("Uploads are limited to " + strconv.FormatInt(maxBytes, 10) + " bytes")
+        }
+        defer r.MultipartForm.RemoveAll()
+
+        f, header, err := r.FormFile("file")
+        if err != nil {
+            return e, nil, errors.New("Required file 'file' is not present")
+        }
+        defer f.Close()
+
+        if header.Size > maxBytes {
+            return e, nil, errors.New("Uploads are limited to " + strconv.FormatInt(maxBytes, 10) + " bytes")
+        }
+
+        data, err := io.ReadAll(f)
+        if err != nil {
+            return e, nil, errors.New("Failed to read upload: " + err.Error())
+        }
+
+        // trust the bytes, not the declared type
+        contentType := http.DetectContentType(data)
+        if !EvidenceTypes[contentType] {
+            return e, nil, errors.New("Evidence must be a JPEG, PNG, GIF or WebP image, not " + contentType)
+        }
+
+        e.Kind = "file"
+        e.ContentType = contentType
+        e.Size = int64(len(data))
+        e.Caption = r.FormValue("caption")
+
+        return e, data, nil
+    }
+
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return e, nil, errors.New("Failed to parse body: " + err.Error())
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        return e, nil, errors.New("Body must be a JSON object or a multipart upload: " + err.Error())
+    }
+
+    u, err := url.Parse(params["url"])
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+        return e, nil, errors.New("Parameter 'url' must be an absolute http or https url")
+    }
+
+    e.Kind = "link"
+    e.Url = u.String()
+    e.Caption = params["caption"]
+
+    return e, nil, nil
+}
+
+// BetEvidenceCreateHandler attaches evidence to a bet.
+// Handles POST to /bets/{id}/evidence.
+func (db *MyDB) BetEvidenceCreateHandler(rw http.ResponseWriter, r *http.Request) {
+    b, userId, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    e, data, err := readEvidence(rw, r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+    e.UserId = userId
+
+    if len(e.Caption) > 255 {
+        WriteError(rw, 400, "Captions are limited to 255 characters")
+        return
+    }
+
+    added, err := db.AddEvidence(r.Context(), b, e, data)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, added)
+}
+
+// BetEvidenceShowHandler downloads an uploaded piece of evidence.
+// Handles GET to /bets/{id}/evidence/{evidence_id}.
+func (db *MyDB) BetEvidenceShowHandler(rw http.ResponseWriter, r *http.Request) {
+    b, _, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    evidenceId, _ := strconv.Atoi(mux.Vars(r)["evidence_id"])
+    e, err := db.GetEvidence(r.Context(), evidenceId)
+    if err != nil || e.BetId != b.Id || e.Kind != "file" || db.Blobs == nil {
+        WriteError(rw, 404, "No uploaded evidence found with id " + strconv.Itoa(evidenceId))
+        return
+    }
+
+    rc, err := db.Blobs.Get(r.Context(), e.BlobKey)
+    if err != nil {
+        WriteError(rw, 500, "Failed to load evidence: " + err.Error())
+        return
+    }
+    defer rc.Close()
+
+    rw.Header().Set("Content-Type", e.ContentType)
+    rw.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+    rw.Header().Set("Content-Disposition", "inline")
+    rw.Header().Set("X-Content-Type-Options", "nosniff")
+    rw.Header().Set("Cache-Control", "private, max-age=86400")
+    rw.WriteHeader(200)
+    io.Copy(rw, rc)
+}
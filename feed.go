@@ -0,0 +1,160 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// FeedEventTypes are the bet events that show up in the feeds of the
+// participants' friends.
+var FeedEventTypes = map[string]bool{
+    "bet.created": true,
+    "bet.accepted": true,
+    "bet.settled": true,
+}
+
+// A FeedItem is a bet event in a user's feed, with the bet as it is now.
+type FeedItem struct {
+    Id int64            `json:"id"`
+    Type string         `json:"type"`
+    Bet *Bet            `json:"bet"`
+    CreatedOn time.Time `json:"created_on"`
+}
+
+// A FeedFanout copies a bet event into the feeds of everyone who may see it.
+type FeedFanout struct {
+    EventId int64       `json:"event_id"`
+    BetId int           `json:"bet_id"`
+    Type string         `json:"type"`
+}
+
+// friendsOfBet is a subquery for the participants of a bet and everyone they have shared a bet with.
+const friendsOfBet = "select f.user_id from bet_participants p " +
+                     "join bet_participants m on m.user_id = p.user_id " +
+                     "join bet_participants f on f.bet_id = m.bet_id where p.bet_id = ?"
+
+func fanOutEntry(ctx context.Context, db *MyDB, payload json.RawMessage) error {
+    var f FeedFanout
+    if err := json.Unmarshal(payload, &f); err != nil {
+        return errors.New("Bad feed fan-out entry: " + err.Error())
+    }
+    return db.FanOut(ctx, f)
+}
+
+/* Store */
+
+// FanOut writes a bet event into the feeds of the users who may see it:
+// only the participants for participants-only bets, otherwise the
+// participants and their friends. Running it again for an event is harmless.
+func (db *MyDB) FanOut(ctx context.Context, f FeedFanout) error {
+    b, err := db.GetBet(ctx, f.BetId)
+    if err != nil {
+        return err
+    }
+
+    recipients := friendsOfBet
+    if b.Visibility == "participants" {
+        recipients = "select user_id from bet_participants where bet_id = ?"
+    }
+
+    _, err = db.ExecContext(ctx, "insert ignore into feed_items (user_id, event_id, bet_id, type) " +
+                                 "select distinct r.user_id, ?, ?, ? from (" + recipients + ") r",
+                            f.EventId, f.BetId, f.Type, f.BetId)
+    if err != nil {
+        return errors.New("Failed to fan out feed item: " + err.Error())
+    }
+
+    return nil
+}
+
+// GetFeed returns a page of a user's feed, newest first, starting before
+// cursor, or from the newest item when cursor is 0. Items for bets that have
+// since been deleted or made participants-only are left out.
+func (db *MyDB) GetFeed(ctx context.Context, userId int, cursor int64, limit int) ([]FeedItem, string, error) {
+    q := "select f.id, f.type, f.bet_id, f.created_on from feed_items f " +
+         "join bets b on b.id = f.bet_id and b.is_deleted = 0 " +
+         "left join bet_visibility v on v.bet_id = f.bet_id " +
+         "where f.user_id = ? and (? = 0 or f.id < ?) " +
+         "and (coalesce(v.visibility, ?) != 'participants' or " +
+         "exists (select 1 from bet_participants p where p.bet_id = f.bet_id and p.user_id = f.user_id)) " +
+         "order by f.id desc limit ?"
+
+    rows, err := db.QueryContext(ctx, q, userId, cursor, cursor, DefaultVisibility, limit + 1)
+    if err != nil {
+        return nil, "", errors.New("Failed query for feed: " + err.Error())
+    }
+
+    items := make([]FeedItem, 0)
+    betIds := make([]int, 0)
+    for rows.Next() {
+        var item FeedItem
+        var betId int
+        if err := rows.Scan(&item.Id, &item.Type, &betId, &item.CreatedOn); err != nil {
+            rows.Close()
+            return nil, "", errors.New("Failed to scan feed row: " + err.Error())
+        }
+        items = append(items, item)
+        betIds = append(betIds, betId)
+    }
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return nil, "", errors.New("Failed while iterating over feed rows: " + err.Error())
+    }
+
+    // the extra row only tells us there is a next page
+    next := ""
+    if len(items) > limit {
+        items = items[:limit]
+        next = strconv.FormatInt(items[limit - 1].Id, 10)
+    }
+
+    // a bet shows up once per event, so load each one once
+    bets := make(map[int]*Bet)
+    for i := range items {
+        b, ok := bets[betIds[i]]
+        if !ok {
+            if b, err = db.GetBet(ctx, betIds[i]); err != nil {
+                return nil, "", err
+            }
+            if b.HideAmount && !b.IsParticipant(userId) {
+                b.Redact()
+            }
+            bets[betIds[i]] = b
+        }
+        items[i].Bet = b
+    }
+
+    return items, next, nil
+}
+
+/* Handlers */
+
+// FeedHandler shows the authenticated user's feed of their friends' bets.
+// Handles GET to /feed.
+func (db *MyDB) FeedHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    cursor, err := PageCursor(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    items, next, err := db.GetFeed(r.Context(), userId, cursor, PageLimit(r, 20, 100))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WritePage(rw, items, next)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "strconv"
+    "time"
+)
+
+// The defaults of the thresholds the fraud rules flag bets at. Each can be
+// changed with the environment variable of the same name in capitals.
+const (
+    defaultFraudHighValue = 10000       // cents in a bet's pool that make it high-value
+    defaultFraudBiasBets = 5            // bets a witness has decided for the same player before their wins count as bias
+    defaultFraudBiasPercent = 90        // share of those bets the player won
+    defaultFraudWitnessReuse = 3        // high-value bets a witness may decide in FRAUD_WINDOW_DAYS
+    defaultFraudNewAccountDays = 7      // age of accounts that count as new
+    defaultFraudNewAccountStake = 5000  // cents a new account may stake without being flagged
+    defaultFraudWindowDays = 30         // how far back the rules look
+)
+
+// A FraudFlag is a suspicious pattern a fraud rule found in a settled bet.
+type FraudFlag struct {
+    Rule string          `json:"rule"`
+    Detail string        `json:"detail"`
+    CreatedOn time.Time  `json:"created_on"`
+}
+
+// A Review is a flagged bet waiting for staff to release or void its held
+// payouts, or one they already decided.
+type Review struct {
+    BetId int               `json:"bet_id"`
+    Status string           `json:"status"`                 // pending, released or voided
+    Flags []FraudFlag       `json:"flags"`
+    Payouts []Payment       `json:"payouts"`
+    ReviewerId int          `json:"reviewer_id,omitempty"`
+    Note string             `json:"note,omitempty"`
+    CreatedOn time.Time     `json:"created_on"`
+    ReviewedOn *time.Time   `json:"reviewed_on,omitempty"`
+}
+
+// A FraudRule checks a bet that was just settled, with its payouts recorded,
+// and the transfers that would pay it out. It returns why the bet is
+// suspicious, or an empty string.
+type FraudRule func(ctx context.Context, tx *Tx, b *Bet, transfers []Payment) (string, error)
+
+// FraudRules are run in order on every settlement. A bet any of them flags
+// has its payouts held for review.
+var FraudRules = []struct {
+    Name string
+    Check FraudRule
+}{
+    { "witness_bias", witnessBias },
+    { "witness_reuse", witnessReuse },
+    { "new_account_stake", newAccountStake },
+    { "circular_flow", circularFlow },
+}
+
+// payouts returns what each player of a settled bet gets back, in cents.
+func (b *Bet) payouts() map[int]int {
+    payouts := make(map[int]int)
+    for _, m := range b.Members {
+        if m.Role == "player" && m.Payout != nil {
+            payouts[m.UserId] = *m.Payout
+        }
+    }
+    return payouts
+}
+
+// pool returns the sum of every player's stake in a bet.
+func (b *Bet) pool() int {
+    pool := 0
+    for _, m := range b.Members {
+        if m.Role == "player" {
+            pool += m.Stake
+        }
+    }
+    return pool
+}
+
+// witnessBias flags witnesses who keep deciding for the same player.
+func witnessBias(ctx context.Context, tx *Tx, b *Bet, transfers []Payment) (string, error) {
+    minBets := EnvInt("FRAUD_BIAS_BETS", defaultFraudBiasBets)
+    percent := EnvInt("FRAUD_BIAS_PERCENT", defaultFraudBiasPercent)
+
+    for _, w := range b.Witnesses() {
+        for _, m := range b.Members {
+            if m.Role != "player" || m.Payout == nil || *m.Payout <= m.Stake {
+                continue
+            }
+
+            var decided, won int
+            err := tx.QueryRowContext(ctx, "select count(*), coalesce(sum(p.payout > p.stake), 0) from bet_participants w " +
+                                           "join bet_participants p on p.bet_id = w.bet_id and p.user_id = ? and p.role = 'player' " +
+                                           "join bets b on b.id = w.bet_id and b.status = 'settled' and b.is_deleted = 0 " +
+                                           "where w.user_id = ? and w.role = 'witness'", m.UserId, w).Scan(&decided, &won)
+            if err != nil {
+                return "", errors.New("Failed to load witness decisions: " + err.Error())
+            }
+
+            if decided >= minBets && won * 100 >= decided * percent {
+                return "Witness " + strconv.Itoa(w) + " has decided " + strconv.Itoa(won) + " of " + strconv.Itoa(decided) +
+                       " bets for user " + strconv.Itoa(m.UserId), nil
+            }
+        }
+    }
+
+    return "", nil
+}
+
+// witnessReuse flags high-value bets decided by a witness of many other high-value bets.
+func witnessReuse(ctx context.Context, tx *Tx, b *Bet, transfers []Payment) (string, error) {
+    highValue := EnvInt("FRAUD_HIGH_VALUE", defaultFraudHighValue)
+    if b.pool() < highValue {
+        return "", nil
+    }
+
+    for _, w := range b.Witnesses() {
+        var count int
+        err := tx.QueryRowContext(ctx, "select count(*) from bet_participants w join bets b on b.id = w.bet_id and b.is_deleted = 0 " +
+                                       "where w.user_id = ? and w.role = 'witness' and b.created_on > utc_timestamp() - interval ? day " +
+                                       "and (select sum(s.stake) from bet_participants s where s.bet_id = w.bet_id and s.role = 'player') >= ?",
+                                  w, EnvInt("FRAUD_WINDOW_DAYS", defaultFraudWindowDays), highValue).Scan(&count)
+        if err != nil {
+            return "", errors.New("Failed to count witnessed bets: " + err.Error())
+        }
+
+        if count > EnvInt("FRAUD_WITNESS_REUSE", defaultFraudWitnessReuse) {
+            return "Witness " + strconv.Itoa(w) + " has witnessed " + strconv.Itoa(count) + " bets of " +
+                   strconv.Itoa(highValue) + " cents or more recently", nil
+        }
+    }
+
+    return "", nil
+}
+
+// newAccountStake flags large stakes by accounts that were just made.
+func newAccountStake(ctx context.Context, tx *Tx, b *Bet, transfers []Payment) (string, error) {
+    stake := EnvInt("FRAUD_NEW_ACCOUNT_STAKE", defaultFraudNewAccountStake)
+
+    for _, m := range b.Members {
+        if m.Role != "player" || m.Stake < stake {
+            continue
+        }
+
+        var isNew bool
+        err := tx.QueryRowContext(ctx, "select created_on > utc_timestamp() - interval ? day from users where id = ?",
+                                  EnvInt("FRAUD_NEW_ACCOUNT_DAYS", defaultFraudNewAccountDays), m.UserId).Scan(&isNew)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return "", errors.New("Failed to load account age: " + err.Error())
+        }
+
+        if isNew {
+            return "User " + strconv.Itoa(m.UserId) + " staked " + strconv.Itoa(m.Stake) + " cents from a new account", nil
+        }
+    }
+
+    return "", nil
+}
+
+// circularFlow flags payouts that close a loop of money through three
+// users, A to B to C and back to A, within the window.
+func circularFlow(ctx context.Context, tx *Tx, b *Bet, transfers []Payment) (string, error) {
+    for _, p := range transfers {
+        // another user paid by the payee who in turn paid the payer
+        var via int
+        err := tx.QueryRowContext(ctx, "select a.to_user_id from bet_payouts a join bet_payouts c on c.from_user_id = a.to_user_id " +
+                                       "where a.from_user_id = ? and c.to_user_id = ? and a.to_user_id != ? " +
+                                       "and a.bet_id != ? and c.bet_id != ? and a.status != 'voided' and c.status != 'voided' " +
+                                       "and a.created_on > utc_timestamp() - interval ? day " +
+                                       "and c.created_on > utc_timestamp() - interval ? day limit 1",
+                                  p.ToUserId, p.FromUserId, p.FromUserId, b.Id, b.Id,
+                                  EnvInt("FRAUD_WINDOW_DAYS", defaultFraudWindowDays),
+                                  EnvInt("FRAUD_WINDOW_DAYS", defaultFraudWindowDays)).Scan(&via)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return "", errors.New("Failed to trace payments: " + err.Error())
+        }
+
+        return "Money went from user " + strconv.Itoa(p.FromUserId) + " to " + strconv.Itoa(p.ToUserId) + " to " +
+               strconv.Itoa(via) + " and back to " + strconv.Itoa(p.FromUserId), nil
+    }
+
+    return "", nil
+}
+
+/* Store */
+
+// payOut runs the fraud rules on a bet that was just settled and records
+// its transfers. Unless a rule flags the bet, the payments are queued and the
+// results go into the players' stats; a flagged bet's payments are held and
+// the bet is put up for review, and its results wait on the review too.
+func (tx *Tx) payOut(ctx context.Context, b *Bet, transfers []Payment) error {
+    betId := b.Id
+
+    flags := make([]FraudFlag, 0)
+    for _, rule := range FraudRules {
+        detail, err := rule.Check(ctx, tx, b, transfers)
+        if err != nil {
+            return err
+        }
+        if detail != "" {
+            flags = append(flags, FraudFlag{ Rule: rule.Name, Detail: detail })
+        }
+    }
+
+    status := "queued"
+    if len(flags) > 0 {
+        status = "held"
+
+        for _, f := range flags {
+            _, err := tx.ExecContext(ctx, "insert into bet_flags (bet_id, rule, detail) values (?, ?, ?)", betId, f.Rule, f.Detail)
+            if err != nil {
+                return errors.New("Failed to flag bet: " + err.Error())
+            }
+        }
+
+        // a bet settled again after review goes back in the queue
+        _, err := tx.ExecContext(ctx, "insert into bet_reviews (bet_id) values (?) on duplicate key update " +
+                                     "status = 'pending', reviewer_id = null, note = null, reviewed_on = null", betId)
+        if err != nil {
+            return errors.New("Failed to queue bet for review: " + err.Error())
+        }
+
+        betsFlagged.Inc()
+        Logger(ctx).Warn("bet flagged for review", "bet_id", betId, "rules", len(flags))
+    }
+
+    for _, p := range transfers {
+        res, err := tx.ExecContext(ctx, "insert into bet_payouts (bet_id, from_user_id, to_user_id, amount, status) values (?, ?, ?, ?, ?)",
+                                   p.BetId, p.FromUserId, p.ToUserId, p.Amount, status)
+        if err != nil {
+            return errors.New("Failed to record payout: " + err.Error())
+        }
+        if p.PayoutId, err = res.LastInsertId(); err != nil {
+            return errors.New("Failed to record payout: " + err.Error())
+        }
+
+        if status == "queued" {
+            if err = tx.Enqueue(ctx, "payment", p); err != nil {
+                return err
+            }
+        }
+    }
+
+    if status == "held" {
+        return nil
+    }
+    return tx.recordResults(ctx, b, b.payouts())
+}
+
+// GetReviews returns a page of reviews with a status, oldest first, starting
+// after cursor, or from the oldest when cursor is 0.
+func (db *MyDB) GetReviews(ctx context.Context, status string, cursor int64, limit int) ([]Review, string, error) {
+    rows, err := db.QueryContext(ctx, "select bet_id, status, coalesce(reviewer_id, 0), coalesce(note, ''), created_on, reviewed_on " +
+                                      "from bet_reviews where status = ? and bet_id > ? order by bet_id limit ?",
+                                 status, cursor, limit + 1)
+    if err != nil {
+        return nil, "", errors.New("Failed query for reviews: " + err.Error())
+    }
+
+    reviews := make([]Review, 0)
+    for rows.Next() {
+        var r Review
+        if err := rows.Scan(&r.BetId, &r.Status, &r.ReviewerId, &r.Note, &r.CreatedOn, &r.ReviewedOn); err != nil {
+            rows.Close()
+            return nil, "", errors.New("Failed to scan review row: " + err.Error())
+        }
+        reviews = append(reviews, r)
+    }
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return nil, "", errors.New("Failed while iterating over review rows: " + err.Error())
+    }
+
+    // the extra row only tells us there is a next page
+    next := ""
+    if len(reviews) > limit {
+        reviews = reviews[:limit]
+        next = strconv.Itoa(reviews[limit - 1].BetId)
+    }
+
+    for i := range reviews {
+        if err = loadReview(ctx, db, &reviews[i]); err != nil {
+            return nil, "", err
+        }
+    }
+
+    return reviews, next, nil
+}
+
+// loadReview fills in the flags and payouts of a review.
+func loadReview(ctx context.Context, q Queryer, r *Review) error {
+    rows, err := q.QueryContext(ctx, "select rule, detail, created_on from bet_flags where bet_id = ? order by id", r.BetId)
+    if err != nil {
+        return errors.New("Failed query for bet flags: " + err.Error())
+    }
+
+    r.Flags = make([]FraudFlag, 0)
+    for rows.Next() {
+        var f FraudFlag
+        if err := rows.Scan(&f.Rule, &f.Detail, &f.CreatedOn); err != nil {
+            rows.Close()
+            return errors.New("Failed to scan bet flag: " + err.Error())
+        }
+        r.Flags = append(r.Flags, f)
+    }
+    rows.Close()
+
+    held, err := heldPayouts(ctx, q, r.BetId)
+    if err != nil {
+        return err
+    }
+    r.Payouts = held
+
+    return nil
+}
+
+// heldPayouts returns the payouts of a bet waiting on review.
+func heldPayouts(ctx context.Context, q Queryer, betId int) ([]Payment, error) {
+    rows, err := q.QueryContext(ctx, "select id, bet_id, from_user_id, to_user_id, amount from bet_payouts " +
+                                     "where bet_id = ? and status = 'held' order by id", betId)
+    if err != nil {
+        return nil, errors.New("Failed query for held payouts: " + err.Error())
+    }
+    defer rows.Close()
+
+    payouts := make([]Payment, 0)
+    for rows.Next() {
+        var p Payment
+        if err := rows.Scan(&p.PayoutId, &p.BetId, &p.FromUserId, &p.ToUserId, &p.Amount); err != nil {
+            return nil, errors.New("Failed to scan held payout: " + err.Error())
+        }
+        payouts = append(payouts, p)
+    }
+
+    return payouts, rows.Err()
+}
+
+// ReviewBet decides a flagged bet: "release" queues its held payments and
+// adds the results to the players' stats, "void" cancels them and gives every
+// player their stake back on record. The decision is recorded in the bet's
+// audit trail.
+func (db *MyDB) ReviewBet(ctx context.Context, betId int, reviewerId int, decision string, note string) error {
+    status, ok := map[string]string{ "release": "released", "void": "voided" }[decision]
+    if !ok {
+        return errors.New("Decision must be release or void")
+    }
+
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var current string
+        err := tx.QueryRowContext(ctx, "select status from bet_reviews where bet_id = ? for update", betId).Scan(&current)
+        if err != nil {
+            return errors.New("Bet " + strconv.Itoa(betId) + " isn't up for review")
+        }
+        if current != "pending" {
+            return errors.New("Bet " + strconv.Itoa(betId) + " was already " + current)
+        }
+
+        held, err := heldPayouts(ctx, tx, betId)
+        if err != nil {
+            return err
+        }
+
+        payout := "voided"
+        if status == "released" {
+            payout = "queued"
+            for _, p := range held {
+                if err = tx.Enqueue(ctx, "payment", p); err != nil {
+                    return err
+                }
+            }
+
+            // the results count once the money moves
+            b, err := getBet(ctx, tx, betId)
+            if err != nil {
+                return err
+            }
+            if err = tx.recordResults(ctx, b, b.payouts()); err != nil {
+                return err
+            }
+        } else {
+            // no money moves, so every player ends up with their stake, as
+            // far as records of who won what are concerned
+            _, err = tx.ExecContext(ctx, "update bet_participants set payout = stake where bet_id = ? and role = 'player'", betId)
+            if err != nil {
+                return errors.New("Failed to void payouts: " + err.Error())
+            }
+        }
+
+        if _, err = tx.ExecContext(ctx, "update bet_payouts set status = ? where bet_id = ? and status = 'held'", payout, betId); err != nil {
+            return errors.New("Failed to update payouts: " + err.Error())
+        }
+
+        _, err = tx.ExecContext(ctx, "update bet_reviews set status = ?, reviewer_id = ?, note = nullif(?, ''), reviewed_on = utc_timestamp() " +
+                                     "where bet_id = ?", status, reviewerId, note, betId)
+        if err != nil {
+            return errors.New("Failed to record review: " + err.Error())
+        }
+
+        reason := "payouts " + status
+        if note != "" {
+            reason += ": " + note
+        }
+        return tx.RecordBetChange(ctx, BetChange{
+            BetId: betId,
+            ActorId: reviewerId,
+            Action: "reviewed",
+            OldStatus: "settled",
+            NewStatus: "settled",
+            Reason: reason,
+        })
+    })
+    if err != nil {
+        return err
+    }
+
+    Logger(ctx).Info("bet reviewed", "bet_id", betId, "reviewer_id", reviewerId, "decision", status)
+
+    return nil
+}
@@ -2,10 +2,11 @@ package main
 
 import (
     "encoding/json"
+    "errors"
     "io/ioutil"
-    // "log"
     "net/http"
     "strconv"
+    "time"
 
     "github.com/gorilla/mux"
     _ "github.com/go-sql-driver/mysql"
@@ -37,7 +38,7 @@ func (db *MyDB) ContactsHandler(rw http.ResponseWriter, r *http.Request) {
         }
     }
 
-    contactpairs, err = db.CheckPhoneNumbers(phonenumbers[0:])
+    contactpairs, err = db.CheckPhoneNumbers(r.Context(), phonenumbers[0:])
     if err != nil {
         WriteError(rw, 500, err.Error())
         return
@@ -55,7 +56,6 @@ func (db *MyDB) ContactsHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
@@ -88,7 +88,7 @@ func (db *MyDB) VerificationHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     // Verify user
-    if err := db.VerifyUser(accessToken, verificationToken); err != nil {
+    if err := db.VerifyUser(r.Context(), accessToken, verificationToken); err != nil {
         WriteError(rw, 400, err.Error())
         return
     }
@@ -114,8 +114,10 @@ func (db *MyDB) UsersShowHandler(rw http.ResponseWriter, r *http.Request) {
     for k, v := range r.Form {
         params[k] = v[0]
     }
+    // a token authenticates the request; users can't be looked up by it
+    delete(params, "access_token")
 
-    users, err := db.GetUsers(params)
+    users, err := db.GetUsers(r.Context(), params)
     if err != nil {
         WriteError(rw, 500, err.Error())
         return
@@ -133,7 +135,6 @@ func (db *MyDB) UsersShowHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
@@ -166,14 +167,15 @@ func (db *MyDB) UsersCreateHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     // // request user info from venmo
-    info, err := GetVenmoInfo(accessToken)
+    info, err := GetVenmoInfo(r.Context(), accessToken)
     if err != nil {
         WriteError(rw, 500, "Failed request for info from Venmo: " + err.Error())
         return
     }
 
     // create a user
-    err = db.CreateUser(info["first_name"], 
+    err = db.CreateUser(r.Context(),
+                        info["first_name"],
                         info["last_name"],
                         info["email"], 
                         accessToken,
@@ -185,13 +187,6 @@ func (db *MyDB) UsersCreateHandler(rw http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // send twilio
-    err = db.SendVerificationMsg(accessToken, phoneNumber)
-    if err != nil {
-        WriteError(rw, 500, "Failed to send Twilio message: " + err.Error())
-        return
-    }
-
     WriteSuccess(rw)
 
 }
@@ -202,12 +197,12 @@ func (db *MyDB) UserShowHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.UserExists(id) {
+    if !db.UserExists(r.Context(), id) {
         WriteError(rw, 400, "No user found with id " + strconv.Itoa(id))
         return
     }
 
-    u, err := db.GetUser(id)
+    u, err := db.GetUser(r.Context(), id)
     if err != nil {
         WriteError(rw, 500, "Unable to retrieve user: " + err.Error())
         return
@@ -225,7 +220,6 @@ func (db *MyDB) UserShowHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 
 }
@@ -236,7 +230,7 @@ func (db *MyDB) UserUpdateHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.UserExists(id) {
+    if !db.UserExists(r.Context(), id) {
         WriteError(rw, 400, "No user found with id " + strconv.Itoa(id))
         return
     }
@@ -252,7 +246,7 @@ func (db *MyDB) UserUpdateHandler(rw http.ResponseWriter, r *http.Request) {
     var params map[string]string
     err = json.Unmarshal(body, &params)
 
-    err = db.UpdateUser(id, params); if err != nil {
+    err = db.UpdateUser(r.Context(), id, params); if err != nil {
         WriteError(rw, 400, err.Error())
         return
     }
@@ -266,12 +260,12 @@ func (db *MyDB) UserDeleteHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.UserExists(id) {
+    if !db.UserExists(r.Context(), id) {
         WriteError(rw, 400, "No user found with id " + strconv.Itoa(id))
         return
     }
 
-    if err := db.DeleteUser(id); err != nil {
+    if err := db.DeleteUser(r.Context(), id); err != nil {
         WriteError(rw, 500, "Failed to delete user")
         return
     }
@@ -286,12 +280,12 @@ func (db *MyDB) UserBetsHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.UserExists(id) {
+    if !db.UserExists(r.Context(), id) {
         WriteError(rw, 400, "No user found with id " + strconv.Itoa(id))
         return
     }
 
-    bets, err := db.GetUserBets(id)
+    bets, err := db.GetUserBets(r.Context(), db.Viewer(r), id)
     if err != nil {
         WriteError(rw, 500, "Failed to get bets for the given user")
         return
@@ -309,7 +303,6 @@ func (db *MyDB) UserBetsHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
@@ -319,12 +312,12 @@ func (db *MyDB) UserWitnessingHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.UserExists(id) {
+    if !db.UserExists(r.Context(), id) {
         WriteError(rw, 400, "No user found with id " + strconv.Itoa(id))
         return
     }
 
-    bets, err := db.GetUserWitnessing(id)
+    bets, err := db.GetUserWitnessing(r.Context(), db.Viewer(r), id)
     if err != nil {
         WriteError(rw, 500, "Failed to get bets for the given user")
         return
@@ -342,7 +335,6 @@ func (db *MyDB) UserWitnessingHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
@@ -365,7 +357,7 @@ func (db *MyDB) BetsShowHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     // get user info
-    bets, err = db.GetBets(params)
+    bets, err = db.GetBets(r.Context(), db.Viewer(r), params)
     if err != nil {
         WriteError(rw, 500, err.Error())
         return
@@ -383,7 +375,6 @@ func (db *MyDB) BetsShowHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
@@ -394,9 +385,7 @@ func (db *MyDB) BetsCreateHandler(rw http.ResponseWriter, r *http.Request) {
 
     requiredParams := []string{"access_token", 
                                "betted_id", 
-                               "witness_id",
-                               "title",
-                               "amount"}
+                               "witness_id"}
 
     // parse the data
     defer r.Body.Close()
@@ -418,7 +407,32 @@ func (db *MyDB) BetsCreateHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     // request sets
-    bettorId, err := db.GetIdByAccessToken(params["access_token"])
+    bettorId, err := db.GetIdByAccessToken(r.Context(), params["access_token"])
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+    SetRequestUser(r, bettorId)
+
+    // a template fills in what the request leaves out
+    if v, ok := params["template_id"]; ok {
+        templateId, _ := strconv.Atoi(v)
+        t, err := db.GetTemplate(r.Context(), templateId, bettorId)
+        if err != nil {
+            WriteError(rw, 400, err.Error())
+            return
+        }
+        t.Apply(params)
+    }
+
+    for _, p := range []string{"title", "amount"} {
+        if _, ok := params[p]; !ok {
+            WriteError(rw, 400, "Missing parameter " + p)
+            return
+        }
+    }
+
+    labels, err := ParseLabels(params["category"], params["tags"])
     if err != nil {
         WriteError(rw, 400, err.Error())
         return
@@ -428,23 +442,88 @@ func (db *MyDB) BetsCreateHandler(rw http.ResponseWriter, r *http.Request) {
     witnessId, _ := strconv.Atoi(params["witness_id"])
     amount, _ := strconv.Atoi(params["amount"])
     title := params["title"]
+
+    if amount <= 0 {
+        WriteError(rw, 400, "Parameter 'amount' must be a positive number of cents")
+        return
+    }
+
+    // the betted user stakes the same, a given amount, or what the odds work out to
+    bettedStake := amount
+    var odds *Odds
+
+    _, hasStake := params["betted_stake"]
+    _, hasOdds := params["odds"]
+    switch {
+    case hasStake && hasOdds:
+        WriteError(rw, 400, "Give either 'betted_stake' or 'odds', not both")
+        return
+    case hasStake:
+        bettedStake, err = strconv.Atoi(params["betted_stake"])
+        if err != nil || bettedStake <= 0 {
+            WriteError(rw, 400, "Parameter 'betted_stake' must be a positive number of cents")
+            return
+        }
+    case hasOdds:
+        odds, err = ParseOdds(params["odds_format"], params["odds"])
+        if err != nil {
+            WriteError(rw, 400, err.Error())
+            return
+        }
+        bettedStake = odds.CounterStake(amount)
+    }
+
+    var hideAmount *bool
+    if v, ok := params["hide_amount"]; ok {
+        hide, err := strconv.ParseBool(v)
+        if err != nil {
+            WriteError(rw, 400, "Parameter 'hide_amount' must be true or false")
+            return
+        }
+        hideAmount = &hide
+    }
+
+    privacy, err := db.BetPrivacyFor(r.Context(), bettorId, params["visibility"], hideAmount)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    var deadline *time.Time
+    if v, ok := params["deadline"]; ok {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil || !t.After(time.Now()) {
+            WriteError(rw, 400, "Parameter 'deadline' must be a future RFC 3339 time")
+            return
+        }
+        t = t.UTC()
+        deadline = &t
+    }
    
     // defaults to
     winnerId := 0
-    desc := ""
+    desc := params["description"]
     status := "pending"
 
     // create a user
-    err = db.CreateBet(bettorId, 
+    _, err = db.CreateBet(r.Context(),
+                       bettorId,
                        bettedId, 
                        witnessId, 
                        winnerId,
                        title, 
                        desc, 
                        status,
-                       amount)
+                       amount,
+                       bettedStake,
+                       odds,
+                       deadline,
+                       privacy,
+                       labels)
     if err != nil {
-        WriteError(rw, 500, "Failed to create bet: " + err.Error())
+        if !WriteLimitError(rw, err) {
+            WriteError(rw, 500, "Failed to create bet: " + err.Error())
+        }
         return
     }
 
@@ -458,17 +537,31 @@ func (db *MyDB) BetShowHandler(rw http.ResponseWriter, r *http.Request) {
 
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.BetExists(id) {
-        WriteError(rw, 400, "No bet found with id " + strconv.Itoa(id))
+    if !db.BetExists(r.Context(), id) {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
         return
     }
 
-    b, err := db.GetBet(id)
+    b, err := db.GetBet(r.Context(), id)
     if err != nil {
         WriteError(rw, 500, "Unable to retrieve bet")
         return
     }
 
+    // bets a viewer may not see don't exist as far as they can tell
+    if ok, err := db.CanSee(r.Context(), b, db.Viewer(r)); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    } else if !ok {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
+        return
+    }
+
+    if b.Evidence, err = db.GetBetEvidence(r.Context(), id); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
     // form as a JSON response
     m := M{ Code: 200 }
     resp := JSONResponse { Meta: m, Data: *b }
@@ -481,34 +574,42 @@ func (db *MyDB) BetShowHandler(rw http.ResponseWriter, r *http.Request) {
     }
 
     rw.WriteHeader(200)
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.Write(js)
 }
 
-// BetDeleteHandler handles deletion of bets.
+// BetDeleteHandler handles deletion of bets by their bettor.
 // Handles DELETE to /bets/{id}.
 func (db *MyDB) BetDeleteHandler(rw http.ResponseWriter, r *http.Request) {
 
+    actorId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.BetExists(id) {
-        WriteError(rw, 400, "No bet found with id " + strconv.Itoa(id))
+    if b, err := db.visibleBet(r.Context(), id, actorId); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    } else if b == nil {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
         return
     }
 
-    if err := db.DeleteBet(id); err != nil {
-        WriteError(rw, 500, "Failed to delete bet")
+    if err := db.DeleteBet(r.Context(), actorId, id); err != nil {
+        WriteError(rw, 400, "Failed to delete bet: " + err.Error())
         return
     }
 
     WriteSuccess(rw)
 }
 
-// BetStatusHandler handles changing the status of a bet.
+// BetStatusHandler handles changing the status of a bet by the authenticated user.
 // Handles POST to /bet/{id}/status.
-// Must implement:
 //  - Pending created automatically on create
-//  - Declined allowed by betted and witness
+//  - Active and declined allowed by betted
+//  - Disputed allowed by the players
 //  - Settled allowed by witness
 // Includes requests to Venmo to payout on status = settled.
 func (db *MyDB) BetStatusHandler(rw http.ResponseWriter, r *http.Request) {
@@ -516,11 +617,20 @@ func (db *MyDB) BetStatusHandler(rw http.ResponseWriter, r *http.Request) {
     var settled bool
     var err error
 
+    actorId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
     // check id
     id, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-    if !db.BetExists(id) {
-        WriteError(rw, 400, "No bet found with id " + strconv.Itoa(id))
+    if b, err := db.visibleBet(r.Context(), id, actorId); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    } else if b == nil {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
         return
     }
 
@@ -560,16 +670,14 @@ func (db *MyDB) BetStatusHandler(rw http.ResponseWriter, r *http.Request) {
         }
     }
 
-    err = db.UpdateBetStatus(id, status, winnerId)
+    err = db.UpdateBetStatus(r.Context(), actorId, id, status, winnerId, params["reason"])
     if err != nil {
-        WriteError(rw, 500, "Failed to update bet status")
+        if !WriteLimitError(rw, err) {
+            WriteError(rw, 400, "Failed to update bet status: " + err.Error())
+        }
         return
     }
 
-    // if settled {
-    //     // Call function to charge bettor_id and betted_id
-    // }
-
     WriteSuccess(rw)
 }
 
@@ -588,17 +696,84 @@ func (db *MyDB) BetsHookHandler(rw http.ResponseWriter, r *http.Request) {
 func WriteError(rw http.ResponseWriter, code int, errMsg string) {
     js, _ := json.Marshal(*GenerateError(code, errMsg))
 
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.WriteHeader(code)
     rw.Write(js)
 }
 
+// WriteLimitError writes a 403 response for a bet refused by a player's
+// limits, carrying the limit's error code, and reports whether err was one.
+func WriteLimitError(rw http.ResponseWriter, err error) bool {
+    var limit *LimitError
+    if !errors.As(err, &limit) {
+        return false
+    }
+
+    js, _ := json.Marshal(JSONResponse{ Meta: M{ Code: 403, ErrorMessage: limit.Message, ErrorCode: limit.Code }})
+
+    rw.WriteHeader(403)
+    rw.Write(js)
+    return true
+}
+
+// WriteData writes a JSON-formatted response carrying data to a ResponseWriter.
+func WriteData(rw http.ResponseWriter, code int, data interface{}) {
+    js, err := json.Marshal(JSONResponse{ Meta: M{ Code: code, ErrorMessage: "" }, Data: data })
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    rw.WriteHeader(code)
+    rw.Write(js)
+}
+
+// PageLimit reads the "limit" parameter of a list request, between 1 and max.
+func PageLimit(r *http.Request, def int, max int) int {
+    limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+    if err != nil || limit < 1 {
+        return def
+    }
+    if limit > max {
+        return max
+    }
+    return limit
+}
+
+// PageCursor reads the "cursor" parameter of a list request, 0 for the first page.
+func PageCursor(r *http.Request) (int64, error) {
+    c := r.URL.Query().Get("cursor")
+    if c == "" {
+        return 0, nil
+    }
+
+    cursor, err := strconv.ParseInt(c, 10, 64)
+    if err != nil || cursor < 0 {
+        return 0, errors.New("Parameter 'cursor' must come from a previous page")
+    }
+    return cursor, nil
+}
+
+// WritePage writes a page of a list, with the cursor of the next page if there is one.
+func WritePage(rw http.ResponseWriter, data interface{}, nextCursor string) {
+    js, err := json.Marshal(JSONResponse{
+        Meta: M{ Code: 200 },
+        Data: data,
+        Pagination: &Pagination{ NextCursor: nextCursor },
+    })
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    rw.WriteHeader(200)
+    rw.Write(js)
+}
+
 // WriteSuccess writes a JSON-formatted success response to a ResponseWriter.
 func WriteSuccess(rw http.ResponseWriter) {
     code := 200
     js, _ := json.Marshal(JSONResponse{ Meta: M{ Code: code, ErrorMessage: "" }})
 
-    rw.Header().Set("Access-Control-Allow-Origin", "*")
     rw.WriteHeader(code)
     rw.Write(js)
 }
\ No newline at end of file
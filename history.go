@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// A BetChange is an entry of a bet's audit trail. The trail is append-only:
+// every mutation of a bet adds one, and none is ever changed.
+type BetChange struct {
+    Id int64            `json:"id"`
+    BetId int           `json:"bet_id"`
+    ActorId int         `json:"actor_id,omitempty"`   // 0 when the change wasn't made by a known user
+    Action string       `json:"action"`               // created, status, deleted or reviewed
+    OldStatus string    `json:"old_status,omitempty"`
+    NewStatus string    `json:"new_status"`
+    WinnerId int        `json:"winner_id,omitempty"`
+    Reason string       `json:"reason,omitempty"`
+    CreatedOn time.Time `json:"created_on"`
+}
+
+// nullId stores ids that aren't positive as null.
+func nullId(id int) sql.NullInt64 {
+    return sql.NullInt64{ Int64: int64(id), Valid: id > 0 }
+}
+
+// RecordBetChange appends a change to a bet's audit trail, in the transaction making the change.
+func (tx *Tx) RecordBetChange(ctx context.Context, c BetChange) error {
+    _, err := tx.ExecContext(ctx, "insert into bet_events (bet_id, actor_id, action, old_status, new_status, winner_id, reason) " +
+                                  "values (?, ?, ?, ?, ?, ?, ?)",
+                             c.BetId, nullId(c.ActorId), c.Action,
+                             sql.NullString{ String: c.OldStatus, Valid: c.OldStatus != "" },
+                             c.NewStatus, nullId(c.WinnerId),
+                             sql.NullString{ String: c.Reason, Valid: c.Reason != "" })
+    if err != nil {
+        return errors.New("Failed to record bet change: " + err.Error())
+    }
+    return nil
+}
+
+// GetBetHistory returns the audit trail of a bet, oldest first. Deleted bets keep theirs.
+func (db *MyDB) GetBetHistory(ctx context.Context, betId int) ([]BetChange, error) {
+    rows, err := db.QueryContext(ctx, "select id, bet_id, coalesce(actor_id, 0), action, coalesce(old_status, ''), " +
+                                      "new_status, coalesce(winner_id, 0), coalesce(reason, ''), created_on " +
+                                      "from bet_events where bet_id = ? order by id", betId)
+    if err != nil {
+        return nil, errors.New("Failed query for bet history: " + err.Error())
+    }
+    defer rows.Close()
+
+    history := make([]BetChange, 0)
+    for rows.Next() {
+        var c BetChange
+        err := rows.Scan(&c.Id, &c.BetId, &c.ActorId, &c.Action, &c.OldStatus,
+                         &c.NewStatus, &c.WinnerId, &c.Reason, &c.CreatedOn)
+        if err != nil {
+            return nil, errors.New("Failed to scan bet history row: " + err.Error())
+        }
+        history = append(history, c)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over bet history rows: " + err.Error())
+    }
+
+    return history, nil
+}
+
+// betRecorded reports whether a bet was ever made, deleted or not.
+func (db *MyDB) betRecorded(ctx context.Context, id int) (bool, error) {
+    var exists bool
+    if err := db.QueryRowContext(ctx, "select exists (select 1 from bets where id = ?)", id).Scan(&exists); err != nil {
+        return false, errors.New("Failed to look up bet: " + err.Error())
+    }
+    return exists, nil
+}
+
+/* Handlers */
+
+// BetHistoryHandler shows the audit trail of a bet.
+// Handles GET to /bets/{id}/history.
+func (db *MyDB) BetHistoryHandler(rw http.ResponseWriter, r *http.Request) {
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    // deleted bets keep their history, so look the bet up whatever its state
+    exists, err := db.betRecorded(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+    if !exists {
+        WriteError(rw, 404, "No history found for bet " + strconv.Itoa(id))
+        return
+    }
+
+    b, err := db.GetBet(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+    if ok, err := db.CanSee(r.Context(), b, db.Viewer(r)); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    } else if !ok {
+        WriteError(rw, 404, "No history found for bet " + strconv.Itoa(id))
+        return
+    }
+
+    history, err := db.GetBetHistory(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    if len(history) == 0 {
+        WriteError(rw, 404, "No history found for bet " + strconv.Itoa(id))
+        return
+    }
+
+    WriteData(rw, 200, history)
+}
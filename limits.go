@@ -0,0 +1,366 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// LimitCoolingOff is how long a user waits for raised or removed limits to take effect.
+// Lower limits take effect straight away.
+const LimitCoolingOff = 24 * time.Hour
+
+// MaxExclusionDays is the longest a user can exclude themselves from betting for at once.
+const MaxExclusionDays = 5 * 365
+
+// Limits are the caps a user puts on their own betting, in cents. A nil
+// limit is no limit.
+type Limits struct {
+    MaxStake *int       `json:"max_stake"`       // per bet
+    MaxExposure *int    `json:"max_exposure"`    // staked on bets that haven't settled
+    MaxLossDay *int     `json:"max_loss_day"`    // net losses today, in UTC
+    MaxLossWeek *int    `json:"max_loss_week"`   // over the last 7 days
+    MaxLossMonth *int   `json:"max_loss_month"`  // over the last 30 days
+}
+
+// UserLimits are the limits in effect for a user, any raise waiting out the
+// cooling-off period, and how long they have excluded themselves for.
+type UserLimits struct {
+    Limits
+    Pending *Limits             `json:"pending,omitempty"`
+    PendingOn *time.Time        `json:"pending_on,omitempty"`     // when the pending limits take effect
+    ExcludedUntil *time.Time    `json:"excluded_until,omitempty"`
+}
+
+// A LimitError is a bet refused by the limits of one of its players. Code
+// tells clients which limit it was: self_excluded, stake_limit,
+// exposure_limit, loss_limit_day, loss_limit_week or loss_limit_month.
+type LimitError struct {
+    Code string
+    Message string
+}
+
+func (e *LimitError) Error() string {
+    return e.Message
+}
+
+// fields returns the limits in a fixed order, to compare them one by one.
+func (l *Limits) fields() []**int {
+    return []**int{ &l.MaxStake, &l.MaxExposure, &l.MaxLossDay, &l.MaxLossWeek, &l.MaxLossMonth }
+}
+
+// Validate checks every limit that is set is positive.
+func (l *Limits) Validate() error {
+    for _, f := range l.fields() {
+        if *f != nil && **f <= 0 {
+            return errors.New("Limits must be positive numbers of cents, or null for no limit")
+        }
+    }
+    return nil
+}
+
+// looser reports whether a limit would let a user bet more than another.
+func looser(from *int, to *int) bool {
+    return from != nil && (to == nil || *to > *from)
+}
+
+// lossWindows are the periods losses are limited over, in days counting today.
+var lossWindows = []struct {
+    code string
+    name string
+    days int
+    limit func(l *Limits) *int
+}{
+    { "loss_limit_day", "daily", 1, func(l *Limits) *int { return l.MaxLossDay } },
+    { "loss_limit_week", "weekly", 7, func(l *Limits) *int { return l.MaxLossWeek } },
+    { "loss_limit_month", "monthly", 30, func(l *Limits) *int { return l.MaxLossMonth } },
+}
+
+// change moves a user's limits toward the ones they want as of now. Tighter
+// limits take effect at once; if any is looser, all of want waits out the
+// cooling-off period as the pending limits, replacing any pending before.
+func (ul *UserLimits) change(want Limits, now time.Time) {
+    ul.Pending, ul.PendingOn = nil, nil
+    current, wanted := ul.fields(), want.fields()
+    for i := range current {
+        if looser(*current[i], *wanted[i]) {
+            on := now.Add(LimitCoolingOff)
+            ul.Pending, ul.PendingOn = &want, &on
+        } else {
+            *current[i] = *wanted[i]
+        }
+    }
+}
+
+/* Store */
+
+const limitColumns = "max_stake, max_exposure, max_loss_day, max_loss_week, max_loss_month"
+
+// GetLimits returns a user's limits.
+func (db *MyDB) GetLimits(ctx context.Context, userId int) (*UserLimits, error) {
+    return loadLimits(ctx, db, userId, false)
+}
+
+// loadLimits reads a user's limits, with pending limits whose cooling-off
+// period is over in effect. Locking them serializes the user's bets.
+func loadLimits(ctx context.Context, q Queryer, userId int, lock bool) (*UserLimits, error) {
+    var ul UserLimits
+    var pending Limits
+
+    query := "select " + limitColumns + ", pending_max_stake, pending_max_exposure, pending_max_loss_day, " +
+             "pending_max_loss_week, pending_max_loss_month, pending_on, excluded_until from user_limits where user_id = ?"
+    if lock {
+        query += " for update"
+    }
+
+    dest := make([]interface{}, 0, 12)
+    for _, f := range ul.fields() {
+        dest = append(dest, f)
+    }
+    for _, f := range pending.fields() {
+        dest = append(dest, f)
+    }
+    dest = append(dest, &ul.PendingOn, &ul.ExcludedUntil)
+
+    err := q.QueryRowContext(ctx, query, userId).Scan(dest...)
+    if err == sql.ErrNoRows {
+        return &ul, nil
+    }
+    if err != nil {
+        return nil, errors.New("Failed to load limits: " + err.Error())
+    }
+
+    if ul.PendingOn != nil {
+        if ul.PendingOn.After(time.Now()) {
+            ul.Pending = &pending
+        } else {
+            ul.Limits = pending
+            ul.PendingOn = nil
+        }
+    }
+    if ul.ExcludedUntil != nil && !ul.ExcludedUntil.After(time.Now()) {
+        ul.ExcludedUntil = nil
+    }
+
+    return &ul, nil
+}
+
+// SetLimits changes a user's limits. Lower limits take effect at once;
+// if any limit is raised or removed, all of the new limits wait out the
+// cooling-off period first. Setting limits again replaces a pending raise.
+func (db *MyDB) SetLimits(ctx context.Context, userId int, want Limits) (*UserLimits, error) {
+    if err := want.Validate(); err != nil {
+        return nil, err
+    }
+
+    var ul *UserLimits
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var err error
+        if ul, err = loadLimits(ctx, tx, userId, true); err != nil {
+            return err
+        }
+
+        ul.change(want, time.Now().UTC())
+
+        var pending Limits
+        if ul.Pending != nil {
+            pending = *ul.Pending
+        }
+
+        _, err = tx.ExecContext(ctx, "insert into user_limits (user_id, " + limitColumns + ", pending_max_stake, pending_max_exposure, " +
+                                     "pending_max_loss_day, pending_max_loss_week, pending_max_loss_month, pending_on) " +
+                                     "values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on duplicate key update " +
+                                     "max_stake = values(max_stake), max_exposure = values(max_exposure), " +
+                                     "max_loss_day = values(max_loss_day), max_loss_week = values(max_loss_week), " +
+                                     "max_loss_month = values(max_loss_month), pending_max_stake = values(pending_max_stake), " +
+                                     "pending_max_exposure = values(pending_max_exposure), pending_max_loss_day = values(pending_max_loss_day), " +
+                                     "pending_max_loss_week = values(pending_max_loss_week), " +
+                                     "pending_max_loss_month = values(pending_max_loss_month), pending_on = values(pending_on)",
+                                userId, ul.MaxStake, ul.MaxExposure, ul.MaxLossDay, ul.MaxLossWeek, ul.MaxLossMonth,
+                                pending.MaxStake, pending.MaxExposure, pending.MaxLossDay, pending.MaxLossWeek, pending.MaxLossMonth,
+                                ul.PendingOn)
+        if err != nil {
+            return errors.New("Failed to save limits: " + err.Error())
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    Logger(ctx).Info("limits changed", "user_id", userId, "pending", ul.Pending != nil)
+
+    return ul, nil
+}
+
+// SelfExclude blocks a user from new bets until a time. An exclusion can be
+// extended but not shortened.
+func (db *MyDB) SelfExclude(ctx context.Context, userId int, until time.Time) (*UserLimits, error) {
+    _, err := db.ExecContext(ctx, "insert into user_limits (user_id, excluded_until) values (?, ?) " +
+                                  "on duplicate key update excluded_until = greatest(coalesce(excluded_until, values(excluded_until)), " +
+                                  "values(excluded_until))", userId, until.UTC())
+    if err != nil {
+        return nil, errors.New("Failed to save self-exclusion: " + err.Error())
+    }
+
+    Logger(ctx).Info("user self-excluded", "user_id", userId, "until", until)
+
+    return db.GetLimits(ctx, userId)
+}
+
+// checkLimits checks a player can stake cents on a bet, counting what they
+// already have on their other bets. It locks the player's limits until the
+// transaction ends, so their bets are checked one at a time.
+func (tx *Tx) checkLimits(ctx context.Context, userId int, betId int, stake int) error {
+    ul, err := loadLimits(ctx, tx, userId, true)
+    if err != nil {
+        return err
+    }
+
+    if ul.ExcludedUntil != nil {
+        return &LimitError{ "self_excluded", "User " + strconv.Itoa(userId) + " has excluded themselves from betting until " +
+                                             ul.ExcludedUntil.Format(time.RFC3339) }
+    }
+
+    if ul.MaxStake != nil && stake > *ul.MaxStake {
+        return &LimitError{ "stake_limit", "A stake of " + strconv.Itoa(stake) + " cents is over user " + strconv.Itoa(userId) +
+                                           "'s limit of " + strconv.Itoa(*ul.MaxStake) + " cents per bet" }
+    }
+
+    if ul.MaxExposure != nil {
+        var exposure int
+        // a pending pair bet only counts for the player who proposed it; the
+        // player it was offered to hasn't staked anything until they accept.
+        // Joining a group bet is committing to it, so those always count.
+        err = tx.QueryRowContext(ctx, "select coalesce(sum(p.stake), 0) from bet_participants p join bets b on b.id = p.bet_id " +
+                                      "where p.user_id = ? and p.role = 'player' and p.bet_id != ? and b.is_deleted = 0 " +
+                                      "and b.status in ('pending', 'active', 'disputed') " +
+                                      "and (b.status != 'pending' or b.bettor_id = p.user_id " +
+                                      "or exists (select 1 from bet_outcomes o where o.bet_id = b.id))", userId, betId).Scan(&exposure)
+        if err != nil {
+            return errors.New("Failed to load open stakes: " + err.Error())
+        }
+        if exposure + stake > *ul.MaxExposure {
+            return &LimitError{ "exposure_limit", "This bet would put " + strconv.Itoa(exposure + stake) + " cents of user " +
+                                                  strconv.Itoa(userId) + "'s at stake, over their limit of " +
+                                                  strconv.Itoa(*ul.MaxExposure) + " cents" }
+        }
+    }
+
+    for _, w := range lossWindows {
+        limit := w.limit(&ul.Limits)
+        if limit == nil {
+            continue
+        }
+
+        var net int
+        err = tx.QueryRowContext(ctx, "select coalesce(sum(net), 0) from user_stats_daily where user_id = ? " +
+                                      "and day > utc_date() - interval ? day", userId, w.days).Scan(&net)
+        if err != nil {
+            return errors.New("Failed to load losses: " + err.Error())
+        }
+
+        // losing this bet on top of what is already lost
+        if loss := max(-net, 0) + stake; loss > *limit {
+            return &LimitError{ w.code, "Losing this bet could take user " + strconv.Itoa(userId) + "'s losses to " +
+                                        strconv.Itoa(loss) + " cents, over their " + w.name + " limit of " +
+                                        strconv.Itoa(*limit) + " cents" }
+        }
+    }
+
+    return nil
+}
+
+/* Handlers */
+
+// UserLimitsHandler shows the authenticated user's limits.
+// Handles GET to /users/{id}/limits.
+func (db *MyDB) UserLimitsHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, ok := db.selfUser(rw, r)
+    if !ok {
+        return
+    }
+
+    ul, err := db.GetLimits(r.Context(), userId)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, ul)
+}
+
+// UserLimitsUpdateHandler replaces the authenticated user's limits. Limits left out are removed.
+// Handles PUT and POST to /users/{id}/limits.
+func (db *MyDB) UserLimitsUpdateHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, ok := db.selfUser(rw, r)
+    if !ok {
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var l Limits
+    if err = json.Unmarshal(body, &l); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object of limits: " + err.Error())
+        return
+    }
+    if err = l.Validate(); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    ul, err := db.SetLimits(r.Context(), userId, l)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, ul)
+}
+
+// UserExclusionHandler excludes the authenticated user from new bets for a number of days.
+// Handles POST to /users/{id}/exclusion with "days".
+func (db *MyDB) UserExclusionHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, ok := db.selfUser(rw, r)
+    if !ok {
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+
+    days, err := strconv.Atoi(params["days"])
+    if err != nil || days < 1 || days > MaxExclusionDays {
+        WriteError(rw, 400, "Parameter 'days' must be a number from 1 to " + strconv.Itoa(MaxExclusionDays))
+        return
+    }
+
+    ul, err := db.SelfExclude(r.Context(), userId, time.Now().UTC().AddDate(0, 0, days))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, ul)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func cents(n int) *int {
+    return &n
+}
+
+func TestLooser(t *testing.T) {
+    cases := []struct {
+        from *int
+        to *int
+        want bool
+    }{
+        { nil, nil, false },
+        { nil, cents(500), false },
+        { cents(500), nil, true },
+        { cents(500), cents(600), true },
+        { cents(500), cents(500), false },
+        { cents(500), cents(400), false },
+    }
+
+    for _, c := range cases {
+        if got := looser(c.from, c.to); got != c.want {
+            t.Errorf("looser(%v, %v) = %v, want %v", c.from, c.to, got, c.want)
+        }
+    }
+}
+
+func TestLimitsValidate(t *testing.T) {
+    if err := (&Limits{ MaxStake: cents(100) }).Validate(); err != nil {
+        t.Errorf("a positive limit should be valid: %v", err)
+    }
+    for _, n := range []int{0, -100} {
+        if err := (&Limits{ MaxLossWeek: cents(n) }).Validate(); err == nil {
+            t.Errorf("a limit of %d should be invalid", n)
+        }
+    }
+}
+
+func TestLimitsChange(t *testing.T) {
+    now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+    cases := []struct {
+        name string
+        current Limits
+        want Limits
+        effective Limits    // in effect straight after
+        pending bool        // whether want waits out the cooling-off period
+    }{
+        { "a first limit takes effect",
+          Limits{}, Limits{ MaxStake: cents(100) },
+          Limits{ MaxStake: cents(100) }, false },
+        { "lowering takes effect",
+          Limits{ MaxStake: cents(100) }, Limits{ MaxStake: cents(50) },
+          Limits{ MaxStake: cents(50) }, false },
+        { "raising waits",
+          Limits{ MaxStake: cents(100) }, Limits{ MaxStake: cents(200) },
+          Limits{ MaxStake: cents(100) }, true },
+        { "removing waits",
+          Limits{ MaxExposure: cents(1000) }, Limits{},
+          Limits{ MaxExposure: cents(1000) }, true },
+        { "lowering one and raising another",
+          Limits{ MaxStake: cents(100), MaxLossDay: cents(500) }, Limits{ MaxStake: cents(50), MaxLossDay: cents(1000) },
+          Limits{ MaxStake: cents(50), MaxLossDay: cents(500) }, true },
+    }
+
+    for _, c := range cases {
+        // a change replaces whatever was pending
+        ul := UserLimits{ Limits: c.current, Pending: &Limits{ MaxLossMonth: cents(1) }, PendingOn: &now }
+        ul.change(c.want, now)
+
+        got, want := ul.fields(), c.effective.fields()
+        for i := range got {
+            if (*got[i] == nil) != (*want[i] == nil) || (*got[i] != nil && **got[i] != **want[i]) {
+                t.Errorf("%s: limit %d is %v, want %v", c.name, i, *got[i], *want[i])
+            }
+        }
+
+        if !c.pending {
+            if ul.Pending != nil || ul.PendingOn != nil {
+                t.Errorf("%s: nothing should be pending, got %v on %v", c.name, ul.Pending, ul.PendingOn)
+            }
+            continue
+        }
+        if ul.Pending == nil || ul.PendingOn == nil {
+            t.Errorf("%s: want pending limits", c.name)
+            continue
+        }
+        if *ul.Pending != c.want {
+            t.Errorf("%s: pending %+v, want %+v", c.name, *ul.Pending, c.want)
+        }
+        if !ul.PendingOn.Equal(now.Add(LimitCoolingOff)) {
+            t.Errorf("%s: pending on %s, want %s", c.name, ul.PendingOn, now.Add(LimitCoolingOff))
+        }
+    }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// RequestIDHeader carries the id of a request between services.
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+    loggerKey contextKey = iota
+    requestInfoKey
+)
+
+// A requestInfo collects facts about a request as it moves through the handlers,
+// so they can be reported once the request is done.
+type requestInfo struct {
+    ID string
+    Route string
+    UserId int
+}
+
+/* Loggers */
+
+// sensitiveKeys are attributes whose values are never written to the logs.
+var sensitiveKeys = map[string]bool{
+    "access_token": true,
+    "verification_token": true,
+    "token": true,
+    "authorization": true,
+    "auth_token": true,
+    "secret": true,
+    "password": true,
+}
+
+// phoneKeys are attributes holding phone numbers, of which only the last digits are kept.
+var phoneKeys = map[string]bool{
+    "phone": true,
+    "phone_number": true,
+    "to": true,
+}
+
+var (
+    tokenPattern = regexp.MustCompile(`(access_token|verification_token|token)=[^&\s"]+`)
+    phonePattern = regexp.MustCompile(`\+?\d[\d\- ]{8,}\d`)
+)
+
+// NewLogger creates a JSON logger that redacts phone numbers and tokens.
+// The level is read from LOG_LEVEL and defaults to info.
+func NewLogger(w io.Writer) *slog.Logger {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+        level = slog.LevelInfo
+    }
+
+    return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+        Level: level,
+        ReplaceAttr: redactAttr,
+    }))
+}
+
+// redactAttr scrubs sensitive values out of a log attribute.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+    key := strings.ToLower(a.Key)
+
+    if sensitiveKeys[key] {
+        return slog.String(a.Key, "[REDACTED]")
+    }
+
+    if a.Value.Kind() != slog.KindString && a.Value.Kind() != slog.KindAny {
+        return a
+    }
+
+    if phoneKeys[key] {
+        return slog.String(a.Key, RedactPhone(a.Value.String()))
+    }
+
+    if a.Value.Kind() == slog.KindAny {
+        if err, ok := a.Value.Any().(error); ok {
+            return slog.String(a.Key, Redact(err.Error()))
+        }
+        return a
+    }
+
+    return slog.String(a.Key, Redact(a.Value.String()))
+}
+
+// Redact removes tokens and phone numbers from free-form text.
+func Redact(s string) string {
+    s = tokenPattern.ReplaceAllString(s, "$1=[REDACTED]")
+    return phonePattern.ReplaceAllStringFunc(s, RedactPhone)
+}
+
+// RedactPhone masks all but the last two digits of a phone number.
+func RedactPhone(phone string) string {
+    digits := 0
+    for _, c := range phone {
+        if c >= '0' && c <= '9' {
+            digits++
+        }
+    }
+
+    masked := make([]rune, 0, len(phone))
+    seen := 0
+    for _, c := range phone {
+        if c >= '0' && c <= '9' {
+            seen++
+            if seen <= digits - 2 {
+                c = '*'
+            }
+        }
+        masked = append(masked, c)
+    }
+
+    return string(masked)
+}
+
+// Logger returns the request-scoped logger carried by ctx, or the default logger.
+func Logger(ctx context.Context) *slog.Logger {
+    if ctx != nil {
+        if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+            return l
+        }
+    }
+    return slog.Default()
+}
+
+/* Requests */
+
+// RequestID returns the id of the request carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+    if info := getRequestInfo(ctx); info != nil {
+        return info.ID
+    }
+    return ""
+}
+
+// SetRequestUser records the user a request was made on behalf of.
+func SetRequestUser(r *http.Request, id int) {
+    if info := getRequestInfo(r.Context()); info != nil {
+        info.UserId = id
+    }
+}
+
+func setRequestRoute(r *http.Request, route string) {
+    if info := getRequestInfo(r.Context()); info != nil {
+        info.Route = route
+    }
+}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+    info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+    return info
+}
+
+// newRequestID generates a random request id.
+func newRequestID() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return strings.Replace(time.Now().UTC().Format("20060102150405.000000000"), ".", "", 1)
+    }
+    return hex.EncodeToString(b)
+}
+
+// validRequestID checks that a request id given by a client is safe to log and echo.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 128 {
+        return false
+    }
+    for _, c := range id {
+        if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+            return false
+        }
+    }
+    return true
+}
+
+// LoggingMiddleware assigns or propagates a request id, passes a request-scoped
+// logger down through the request context and writes an access log line once
+// the request is done.
+func LoggingMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+
+        id := r.Header.Get(RequestIDHeader)
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+        rw.Header().Set(RequestIDHeader, id)
+
+        info := &requestInfo{ ID: id }
+        logger := slog.Default().With("request_id", id)
+
+        ctx := context.WithValue(r.Context(), loggerKey, logger)
+        ctx = context.WithValue(ctx, requestInfoKey, info)
+
+        sr := &statusRecorder{ ResponseWriter: rw }
+        next.ServeHTTP(sr, r.WithContext(ctx))
+
+        if sr.status == 0 {
+            sr.status = 200
+        }
+
+        attrs := []any{
+            "method", r.Method,
+            "route", info.Route,
+            "path", r.URL.Path,
+            "status", sr.status,
+            "latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+        }
+        if info.UserId != 0 {
+            attrs = append(attrs, "user_id", info.UserId)
+        }
+
+        logger.Info("request", attrs...)
+    })
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "log"
     "math/rand"
+    "log/slog"
     "net/http"
+    "os"
     "time"
 
-    "github.com/gorilla/mux"
     _ "github.com/go-sql-driver/mysql"
 )
 
 // MyDB facilitates the addition of methods on top of a sql.DB.
 type MyDB struct {
     *sql.DB
+    Events PubSub
+    Blobs BlobStore
+    Search SearchIndex
 }
 
 func main() {
@@ -21,8 +26,13 @@ func main() {
     /* Seeding our random integer generator */
     rand.Seed( time.Now().UTC().UnixNano())
 
+    /* logging */
+    slog.SetDefault(NewLogger(os.Stdout))
+
     /* db */
-    sqldb, err := sql.Open("mysql", "root@tcp(127.0.0.1:3306)/bettor?parseTime=true")
+    // sessions run in UTC, so current_timestamp defaults agree with
+    // utc_timestamp() and with the UTC times the driver parses them as
+    sqldb, err := sql.Open("mysql", "root@tcp(127.0.0.1:3306)/bettor?parseTime=true&time_zone=%27%2B00%3A00%27")
     if err != nil {
         log.Fatal(err)
     }
@@ -33,48 +43,49 @@ func main() {
     }
 
     /* context */
-    db := MyDB{ sqldb }
-
-    /* router */
-    r := mux.NewRouter()
+    db := MyDB{ DB: sqldb, Events: NewLocalPubSub() }
 
-    /* contacts */
-    r.Methods("PUT","POST").Path("/contacts").HandlerFunc(db.ContactsHandler)
-
-    /* verify */
-    r.Methods("PUT","POST").Path("/verify").HandlerFunc(db.VerificationHandler)
+    /* events */
+    if EnvString("EVENTS_PUBSUB", "local") == "sql" {
+        events := NewSQLPubSub(&db, EnvDuration("EVENTS_POLL_INTERVAL", time.Second))
+        go events.Run(context.Background())
+        db.Events = events
+    }
 
-    /* users */
-    users := r.PathPrefix("/users").Subrouter()
+    /* uploads */
+    if db.Blobs, err = BlobStoreFromEnv(); err != nil {
+        log.Fatal(err)
+    }
 
-    users.Methods("GET").Path("/{id:[0-9]+}").HandlerFunc(db.UserShowHandler)
-    users.Methods("PUT", "POST").Path("/{id:[0-9]+}").HandlerFunc(db.UserUpdateHandler)
-    users.Methods("DELETE").Path("/{id:[0-9]+}").HandlerFunc(db.UserDeleteHandler)
-    users.Methods("GET").Path("/{id:[0-9]+}/bets").HandlerFunc(db.UserBetsHandler)
-    users.Methods("GET").Path("/{id:[0-9]+}/witnessing").HandlerFunc(db.UserWitnessingHandler)
+    /* search */
+    db.Search = NewMemoryIndex()
+    go db.RunSearchIndexer(context.Background(), EnvDuration("SEARCH_REINDEX_INTERVAL", 10 * time.Minute))
 
-    users.Methods("GET").HandlerFunc(db.UsersShowHandler)
-    users.Methods("PUT", "POST").HandlerFunc(db.UsersCreateHandler)
+    /* side effects */
+    go db.RunDispatcher(context.Background(), EnvDuration("DISPATCH_INTERVAL", 5 * time.Second))
 
-    /* bets */
-    bets := r.PathPrefix("/bets").Subrouter()
+    /* metrics */
+    DefaultRegistry.Register(NewDBStatsCollector(sqldb))
 
-    bets.Methods("PUT", "POST").Path("/hook").HandlerFunc(db.BetsHookHandler)
-    bets.Methods("GET").Path("/{id:[0-9]+}").HandlerFunc(db.BetShowHandler)
-    bets.Methods("DELETE").Path("/{id:[0-9]+}").HandlerFunc(db.BetDeleteHandler)
-    bets.Methods("PUT", "POST").Path("/{id:[0-9]+}/status").HandlerFunc(db.BetStatusHandler)
+    /* rate limiting */
+    var buckets BucketStore = NewMemoryBucketStore()
+    if EnvString("RATE_LIMIT_STORE", "memory") == "sql" {
+        buckets = NewSQLBucketStore(sqldb)
+    }
+    limiter := NewRateLimiter(&db, buckets, DefaultRateLimits)
 
-    bets.Methods("GET").HandlerFunc(db.BetsShowHandler)
-    bets.Methods("PUT", "POST").HandlerFunc(db.BetsCreateHandler)
+    /* router */
+    r := NewRouter(limiter.Apply(db.Routes()))
 
-    r.Methods("OPTIONS").HandlerFunc(func (rw http.ResponseWriter, r *http.Request) {
-        rw.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept")
-        // rw.Header().Set("Access-Control-Content-Type", "*")
-        rw.Header().Set("Access-Control-Allow-Origin", "*")
-        rw.WriteHeader(200)
-    })
+    /* middleware */
+    cors, err := CORSConfigFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    handler := CORSMiddleware(cors, r)(r)
+    handler = LoggingMiddleware(handler)
 
     /* serve */
-    log.Println("Starting server on :8080")
-    http.ListenAndServe(":8080", r)
+    slog.Info("Starting server on :8080")
+    log.Fatal(http.ListenAndServe(":8080", handler))
 }   
\ No newline at end of file
@@ -0,0 +1,396 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// DefaultBuckets are the latency buckets, in seconds, used by our histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/* Metrics */
+
+var (
+    httpRequests = NewCounterVec("bettor_http_requests_total",
+        "Number of HTTP requests by route template, method and status code.",
+        "route", "method", "code")
+    httpDuration = NewHistogramVec("bettor_http_request_duration_seconds",
+        "Latency of HTTP requests by route template and method.",
+        DefaultBuckets, "route", "method")
+
+    rateLimited = NewCounterVec("bettor_rate_limited_total",
+        "Number of requests rejected by the rate limiter, by route name.",
+        "route")
+
+    outboundRequests = NewCounterVec("bettor_outbound_requests_total",
+        "Number of calls to outside services by service and result.",
+        "service", "result")
+    outboundDuration = NewHistogramVec("bettor_outbound_request_duration_seconds",
+        "Latency of calls to outside services.",
+        DefaultBuckets, "service")
+
+    betsCreated = NewCounterVec("bettor_bets_created_total",
+        "Number of bets created.")
+    betsAccepted = NewCounterVec("bettor_bets_accepted_total",
+        "Number of bets accepted by the betted user.")
+    betsSettled = NewCounterVec("bettor_bets_settled_total",
+        "Number of bets settled by a witness.")
+    betsDisputed = NewCounterVec("bettor_bets_disputed_total",
+        "Number of bets disputed.")
+    betsSettledCents = NewCounterVec("bettor_bets_settled_cents_total",
+        "Total amount of settled bets, in cents.")
+    betsFlagged = NewCounterVec("bettor_bets_flagged_total",
+        "Number of settled bets whose payouts were held for review.")
+)
+
+// DefaultRegistry holds every metric exposed at /metrics.
+var DefaultRegistry = NewRegistry(httpRequests,
+                                  httpDuration,
+                                  rateLimited,
+                                  outboundRequests,
+                                  outboundDuration,
+                                  betsCreated,
+                                  betsAccepted,
+                                  betsSettled,
+                                  betsDisputed,
+                                  betsSettledCents,
+                                  betsFlagged)
+
+// A Collector writes one or more metric families in the Prometheus text format.
+type Collector interface {
+    Collect(w io.Writer)
+}
+
+// A Registry is a set of collectors exposed together.
+type Registry struct {
+    mu sync.Mutex
+    collectors []Collector
+}
+
+// NewRegistry creates a registry holding the given collectors.
+func NewRegistry(collectors ...Collector) *Registry {
+    return &Registry{ collectors: collectors }
+}
+
+// Register adds a collector to the registry.
+func (reg *Registry) Register(c Collector) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+
+    reg.collectors = append(reg.collectors, c)
+}
+
+// ServeHTTP writes every registered metric in the Prometheus text format.
+func (reg *Registry) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+    reg.mu.Lock()
+    collectors := make([]Collector, len(reg.collectors))
+    copy(collectors, reg.collectors)
+    reg.mu.Unlock()
+
+    rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    rw.WriteHeader(200)
+    for _, c := range collectors {
+        c.Collect(rw)
+    }
+}
+
+// MetricsHandler exposes the default registry.
+// Handles GET to /metrics.
+func MetricsHandler(rw http.ResponseWriter, r *http.Request) {
+    DefaultRegistry.ServeHTTP(rw, r)
+}
+
+/* Counters */
+
+// A CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+    name string
+    help string
+    labels []string
+
+    mu sync.Mutex
+    values map[string]float64
+}
+
+// NewCounterVec creates a counter family with the given label names.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+    return &CounterVec{
+        name: name,
+        help: help,
+        labels: labels,
+        values: make(map[string]float64),
+    }
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by v.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+    key := formatLabels(c.labels, labelValues)
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.values[key] += v
+}
+
+// Collect writes the counter family.
+func (c *CounterVec) Collect(w io.Writer) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    writeHeader(w, c.name, c.help, "counter")
+    if len(c.labels) == 0 && len(c.values) == 0 {
+        fmt.Fprintf(w, "%s 0\n", c.name)
+    }
+    for _, key := range sortedKeys(c.values) {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+    }
+}
+
+/* Histograms */
+
+type histogram struct {
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+// A HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+    name string
+    help string
+    labels []string
+    buckets []float64
+
+    mu sync.Mutex
+    values map[string]*histogram
+}
+
+// NewHistogramVec creates a histogram family with the given upper bounds and label names.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+    return &HistogramVec{
+        name: name,
+        help: help,
+        labels: labels,
+        buckets: buckets,
+        values: make(map[string]*histogram),
+    }
+}
+
+// Observe records v in the histogram for the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+    key := strings.Join(labelValues, "\xff")
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    hist, ok := h.values[key]
+    if !ok {
+        hist = &histogram{ counts: make([]uint64, len(h.buckets)) }
+        h.values[key] = hist
+    }
+
+    for i, upper := range h.buckets {
+        if v <= upper {
+            hist.counts[i]++
+        }
+    }
+    hist.sum += v
+    hist.count++
+}
+
+// Collect writes the histogram family.
+func (h *HistogramVec) Collect(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    writeHeader(w, h.name, h.help, "histogram")
+
+    keys := make([]string, 0, len(h.values))
+    for k := range h.values {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, key := range keys {
+        hist := h.values[key]
+        var values []string
+        if len(h.labels) > 0 {
+            values = strings.Split(key, "\xff")
+        }
+
+        names := append(append([]string{}, h.labels...), "le")
+        for i, upper := range h.buckets {
+            le := append(append([]string{}, values...), formatFloat(upper))
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, le), hist.counts[i])
+        }
+        inf := append(append([]string{}, values...), "+Inf")
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, inf), hist.count)
+
+        labels := formatLabels(h.labels, values)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hist.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+    }
+}
+
+/* Database */
+
+// A DBStatsCollector exposes the connection pool statistics of a sql.DB.
+type DBStatsCollector struct {
+    db *sql.DB
+}
+
+// NewDBStatsCollector creates a collector for the pool of the given database.
+func NewDBStatsCollector(db *sql.DB) *DBStatsCollector {
+    return &DBStatsCollector{ db: db }
+}
+
+// Collect writes the current pool statistics.
+func (c *DBStatsCollector) Collect(w io.Writer) {
+    s := c.db.Stats()
+
+    gauges := []struct {
+        name string
+        help string
+        value float64
+    }{
+        {"bettor_db_max_open_connections", "Maximum number of open connections to the database.", float64(s.MaxOpenConnections)},
+        {"bettor_db_open_connections", "Number of established connections, in use and idle.", float64(s.OpenConnections)},
+        {"bettor_db_in_use_connections", "Number of connections currently in use.", float64(s.InUse)},
+        {"bettor_db_idle_connections", "Number of idle connections.", float64(s.Idle)},
+    }
+    for _, g := range gauges {
+        writeHeader(w, g.name, g.help, "gauge")
+        fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+    }
+
+    counters := []struct {
+        name string
+        help string
+        value float64
+    }{
+        {"bettor_db_wait_count_total", "Number of connections waited for.", float64(s.WaitCount)},
+        {"bettor_db_wait_duration_seconds_total", "Time spent waiting for a connection.", s.WaitDuration.Seconds()},
+        {"bettor_db_max_idle_closed_total", "Number of connections closed due to the idle limit.", float64(s.MaxIdleClosed)},
+        {"bettor_db_max_idle_time_closed_total", "Number of connections closed due to the idle time limit.", float64(s.MaxIdleTimeClosed)},
+        {"bettor_db_max_lifetime_closed_total", "Number of connections closed due to the lifetime limit.", float64(s.MaxLifetimeClosed)},
+    }
+    for _, c := range counters {
+        writeHeader(w, c.name, c.help, "counter")
+        fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.value))
+    }
+}
+
+/* Instrumentation */
+
+// A statusRecorder remembers the status code written through a ResponseWriter.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+    if sr.status == 0 {
+        sr.status = code
+    }
+    sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+    if sr.status == 0 {
+        sr.status = 200
+    }
+    return sr.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+    return sr.ResponseWriter
+}
+
+// InstrumentHandler counts and times requests to a handler under a route template.
+func InstrumentHandler(route string, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        sr := &statusRecorder{ ResponseWriter: rw }
+        setRequestRoute(r, route)
+
+        h.ServeHTTP(sr, r)
+
+        if sr.status == 0 {
+            sr.status = 200
+        }
+        httpRequests.Inc(route, r.Method, strconv.Itoa(sr.status))
+        httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+    })
+}
+
+// ObserveOutbound records the latency and result of a call to an outside service.
+func ObserveOutbound(service string, start time.Time, err error) {
+    result := "success"
+    if err != nil {
+        result = "failure"
+    }
+
+    outboundRequests.Inc(service, result)
+    outboundDuration.Observe(time.Since(start).Seconds(), service)
+}
+
+/* Helpers */
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+    fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+    fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels renders label pairs as {a="1",b="2"}, or nothing without labels.
+func formatLabels(names []string, values []string) string {
+    if len(names) == 0 {
+        return ""
+    }
+
+    pairs := make([]string, len(names))
+    for i, name := range names {
+        v := ""
+        if i < len(values) {
+            v = values[i]
+        }
+        pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(v))
+    }
+
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+    v = strings.Replace(v, "\\", "\\\\", -1)
+    v = strings.Replace(v, "\"", "\\\"", -1)
+    return strings.Replace(v, "\n", "\\n", -1)
+}
+
+func formatFloat(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+// Odds are the terms of an asymmetric bet: how much the betted user stakes
+// for every cent the bettor stakes. They are kept as an exact fraction and
+// shown in every format, along with the format they were given in.
+type Odds struct {
+    Format string       `json:"format"`       // fractional, decimal or american
+    Value string        `json:"value"`        // as given
+    Fractional string   `json:"fractional"`   // e.g. 5/2
+    Decimal string      `json:"decimal"`      // e.g. 3.50, rounded to 2 places
+    American string     `json:"american"`     // e.g. +250, rounded to a whole number
+
+    ratio *big.Rat      // profit per cent staked
+}
+
+// ParseOdds reads odds in a format: fractional ("5/2", profit over stake),
+// decimal ("3.5", total return per unit staked) or American ("+250" is the
+// profit on 100 staked, "-150" the stake to profit 100). An empty format is
+// guessed from the value.
+func ParseOdds(format string, value string) (*Odds, error) {
+    value = strings.TrimSpace(value)
+    if value == "" || len(value) > 16 {
+        return nil, errors.New("Odds must be given as a short value like 5/2, 3.5 or +250")
+    }
+
+    if format == "" {
+        switch {
+        case strings.Contains(value, "/"):
+            format = "fractional"
+        case strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"):
+            format = "american"
+        default:
+            format = "decimal"
+        }
+    }
+
+    ratio := new(big.Rat)
+    switch format {
+    case "fractional":
+        parts := strings.SplitN(value, "/", 2)
+        num, err1 := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+        den := int64(1)
+        var err2 error
+        if len(parts) == 2 {
+            den, err2 = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+        }
+        if err1 != nil || err2 != nil || num <= 0 || den <= 0 {
+            return nil, errors.New("Fractional odds must look like 5/2")
+        }
+        ratio.SetFrac64(num, den)
+
+    case "decimal":
+        d, ok := new(big.Rat).SetString(value)
+        if !ok || strings.ContainsAny(value, "/eE") || d.Cmp(big.NewRat(1, 1)) <= 0 {
+            return nil, errors.New("Decimal odds must be a number greater than 1, like 3.5")
+        }
+        ratio.Sub(d, big.NewRat(1, 1))
+
+    case "american":
+        n, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || (n < 100 && n > -100) {
+            return nil, errors.New("American odds must be at least +100 or at most -100, like +250 or -150")
+        }
+        if n > 0 {
+            ratio.SetFrac64(n, 100)
+        } else {
+            ratio.SetFrac64(100, -n)
+        }
+
+    default:
+        return nil, errors.New("Odds format must be fractional, decimal or american")
+    }
+
+    if ratio.Cmp(big.NewRat(1000, 1)) > 0 || ratio.Cmp(big.NewRat(1, 1000)) < 0 {
+        return nil, errors.New("Odds must be between 1/1000 and 1000/1")
+    }
+
+    return newOdds(format, value, ratio), nil
+}
+
+func newOdds(format string, value string, ratio *big.Rat) *Odds {
+    o := &Odds{ Format: format, Value: value, ratio: ratio }
+
+    o.Fractional = ratio.Num().String() + "/" + ratio.Denom().String()
+    o.Decimal = new(big.Rat).Add(ratio, big.NewRat(1, 1)).FloatString(2)
+
+    if ratio.Cmp(big.NewRat(1, 1)) >= 0 {
+        o.American = "+" + roundRat(new(big.Rat).Mul(ratio, big.NewRat(100, 1))).String()
+    } else {
+        o.American = "-" + roundRat(new(big.Rat).Quo(big.NewRat(100, 1), ratio)).String()
+    }
+
+    return o
+}
+
+// roundRat rounds a positive fraction to the nearest integer, halves up.
+func roundRat(r *big.Rat) *big.Int {
+    num := new(big.Int).Mul(r.Num(), big.NewInt(2))
+    num.Add(num, r.Denom())
+    return num.Quo(num, new(big.Int).Mul(r.Denom(), big.NewInt(2)))
+}
+
+// CounterStake returns the cents the betted user stakes against the bettor's
+// stake at these odds: the bettor's profit if they win. It is exact up to a
+// fraction of a cent, which is rounded to the nearest cent, halves up, and is
+// never less than one cent.
+func (o *Odds) CounterStake(stake int) int {
+    cents := roundRat(new(big.Rat).Mul(o.ratio, big.NewRat(int64(stake), 1))).Int64()
+    if cents < 1 {
+        return 1
+    }
+    return int(cents)
+}
+
+/* Store */
+
+// saveOdds stores the odds a bet was made at.
+func (tx *Tx) saveOdds(ctx context.Context, betId int, o *Odds) error {
+    _, err := tx.ExecContext(ctx, "insert into bet_odds (bet_id, format, value, numerator, denominator) values (?, ?, ?, ?, ?)",
+                             betId, o.Format, o.Value, o.ratio.Num().String(), o.ratio.Denom().String())
+    if err != nil {
+        return errors.New("Failed to store odds: " + err.Error())
+    }
+    return nil
+}
+
+// loadOdds fills in the odds of a bet, if it was made at odds.
+func loadOdds(ctx context.Context, q Queryer, b *Bet) error {
+    var format, value, num, den string
+    err := q.QueryRowContext(ctx, "select format, value, numerator, denominator from bet_odds where bet_id = ?", b.Id).
+             Scan(&format, &value, &num, &den)
+    if err == sql.ErrNoRows {
+        // most bets are even
+        return nil
+    }
+    if err != nil {
+        return errors.New("Failed to load odds: " + err.Error())
+    }
+
+    ratio, ok := new(big.Rat).SetString(num + "/" + den)
+    if !ok {
+        return errors.New("Stored odds of bet " + strconv.Itoa(b.Id) + " are invalid")
+    }
+
+    b.Odds = newOdds(format, value, ratio)
+    return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestParseOdds(t *testing.T) {
+    cases := []struct {
+        format string
+        value string
+        fractional string
+        decimal string
+        american string
+    }{
+        { "", "5/2", "5/2", "3.50", "+250" },
+        { "", "3.5", "5/2", "3.50", "+250" },
+        { "", "+250", "5/2", "3.50", "+250" },
+        { "", "-150", "2/3", "1.67", "-150" },
+        { "decimal", "2", "1/1", "2.00", "+100" },
+        { "fractional", "4", "4/1", "5.00", "+400" },
+        { "fractional", "1/3", "1/3", "1.33", "-300" },
+        { "american", "-100", "1/1", "2.00", "+100" },
+        { "fractional", "201/200", "201/200", "2.01", "+101" },  // +100.5 rounds up
+        { "fractional", "200/401", "200/401", "1.50", "-201" },  // -200.5 rounds up too
+        { "fractional", "1000/1", "1000/1", "1001.00", "+100000" },
+        { "fractional", "1/1000", "1/1000", "1.00", "-100000" },
+    }
+
+    for _, c := range cases {
+        o, err := ParseOdds(c.format, c.value)
+        if err != nil {
+            t.Fatalf("ParseOdds(%q, %q): %v", c.format, c.value, err)
+        }
+        if o.Fractional != c.fractional || o.Decimal != c.decimal || o.American != c.american {
+            t.Errorf("ParseOdds(%q, %q) = %s, %s, %s; want %s, %s, %s", c.format, c.value,
+                     o.Fractional, o.Decimal, o.American, c.fractional, c.decimal, c.american)
+        }
+    }
+
+    bad := []struct {
+        format string
+        value string
+    }{
+        { "", "" },
+        { "", "abc" },
+        { "", "5/0" },
+        { "", "0/1" },
+        { "", "+99" },
+        { "decimal", "1" },
+        { "decimal", "0.5" },
+        { "decimal", "1e3" },
+        { "fractional", "1001/1" },
+        { "fractional", "1/1001" },
+        { "american", "+100100" },
+        { "moneyline", "+250" },
+    }
+    for _, c := range bad {
+        if _, err := ParseOdds(c.format, c.value); err == nil {
+            t.Errorf("ParseOdds(%q, %q) should fail", c.format, c.value)
+        }
+    }
+}
+
+func TestCounterStake(t *testing.T) {
+    cases := []struct {
+        odds string
+        stake int
+        want int
+    }{
+        { "5/2", 100, 250 },
+        { "-150", 100, 67 },    // 66.67
+        { "1/4", 2, 1 },        // 0.5 rounds up
+        { "1/4", 6, 2 },        // 1.5 rounds up
+        { "1/3", 4, 1 },        // 1.33 rounds down
+        { "1/3", 1, 1 },        // never less than a cent
+        { "1/1000", 100, 1 },
+        { "1000/1", 100, 100000 },
+    }
+
+    for _, c := range cases {
+        o, err := ParseOdds("", c.odds)
+        if err != nil {
+            t.Fatalf("ParseOdds(%q): %v", c.odds, err)
+        }
+        if got := o.CounterStake(c.stake); got != c.want {
+            t.Errorf("%s on %d cents: got %d, want %d", c.odds, c.stake, got, c.want)
+        }
+    }
+}
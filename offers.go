@@ -0,0 +1,447 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// An Offer is one version of the terms of a two-person bet. The bettor's
+// invitation is version 1; the bettor and the betted user then counter each
+// other until one accepts the other's latest offer, whose terms become the bet.
+type Offer struct {
+    Id int                  `json:"id"`
+    BetId int               `json:"bet_id"`
+    Version int             `json:"version"`
+    ProposerId int          `json:"proposer_id"`
+    Amount int              `json:"amount"`           // the bettor's stake, in cents
+    BettedStake int         `json:"betted_stake"`     // in cents
+    Title string            `json:"title"`
+    Description string      `json:"description,omitempty"`
+    WitnessId int           `json:"witness_id"`
+    Deadline *time.Time     `json:"deadline,omitempty"`
+    Status string           `json:"status"`           // open, countered, accepted or declined
+    CreatedOn time.Time     `json:"created_on"`
+    RespondedOn *time.Time  `json:"responded_on,omitempty"`
+}
+
+/* Store */
+
+const offerColumns = "id, bet_id, version, proposer_id, amount, betted_stake, title, coalesce(description, ''), " +
+                     "witness_id, deadline, status, created_on, responded_on"
+
+func scanOffer(row interface{ Scan(...interface{}) error }) (*Offer, error) {
+    var o Offer
+    var deadline, responded sql.NullTime
+
+    err := row.Scan(&o.Id, &o.BetId, &o.Version, &o.ProposerId, &o.Amount, &o.BettedStake, &o.Title, &o.Description,
+                    &o.WitnessId, &deadline, &o.Status, &o.CreatedOn, &responded)
+    if err != nil {
+        return nil, err
+    }
+    if deadline.Valid {
+        o.Deadline = &deadline.Time
+    }
+    if responded.Valid {
+        o.RespondedOn = &responded.Time
+    }
+
+    return &o, nil
+}
+
+// GetOffers returns the negotiation history of a bet, oldest version first.
+func (db *MyDB) GetOffers(ctx context.Context, betId int) ([]Offer, error) {
+    return getOffers(ctx, db, betId)
+}
+
+func getOffers(ctx context.Context, q Queryer, betId int) ([]Offer, error) {
+    rows, err := q.QueryContext(ctx, "select " + offerColumns + " from bet_offers where bet_id = ? order by version", betId)
+    if err != nil {
+        return nil, errors.New("Failed query for offers: " + err.Error())
+    }
+    defer rows.Close()
+
+    offers := make([]Offer, 0)
+    for rows.Next() {
+        o, err := scanOffer(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan offer row: " + err.Error())
+        }
+        offers = append(offers, *o)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over offer rows: " + err.Error())
+    }
+
+    return offers, nil
+}
+
+// insertOffer stores a new version of a bet's terms.
+func (tx *Tx) insertOffer(ctx context.Context, o Offer) error {
+    _, err := tx.ExecContext(ctx, "insert into bet_offers (bet_id, version, proposer_id, amount, betted_stake, title, description, " +
+                                  "witness_id, deadline, status) values (?, ?, ?, ?, ?, ?, nullif(?, ''), ?, ?, 'open')",
+                             o.BetId, o.Version, o.ProposerId, o.Amount, o.BettedStake, o.Title, o.Description,
+                             o.WitnessId, o.Deadline)
+    if err != nil {
+        return errors.New("Failed to store offer: " + err.Error())
+    }
+    return nil
+}
+
+// loadDeadline fills in the deadline of a bet from its accepted terms, or its
+// open offer while it is still being negotiated.
+func loadDeadline(ctx context.Context, q Queryer, b *Bet) error {
+    var deadline sql.NullTime
+    err := q.QueryRowContext(ctx, "select deadline from bet_offers where bet_id = ? and status in ('open', 'accepted') " +
+                                  "order by version desc limit 1", b.Id).Scan(&deadline)
+    if err != nil && err != sql.ErrNoRows {
+        return errors.New("Failed to load bet deadline: " + err.Error())
+    }
+    if deadline.Valid {
+        b.Deadline = &deadline.Time
+    }
+    return nil
+}
+
+// negotiation locks a pending two-person bet and returns it with its open
+// offer, after checking the user is the one whose turn it is to respond.
+func (tx *Tx) negotiation(ctx context.Context, betId int, userId int) (*Bet, *Offer, error) {
+    var status string
+    err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", betId).Scan(&status)
+    if err != nil {
+        return nil, nil, errors.New("No bet found with id " + strconv.Itoa(betId))
+    }
+
+    b, err := getBet(ctx, tx, betId)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if b.Kind != "pair" || status != "pending" {
+        return nil, nil, errors.New("Only pending two-person bets can be negotiated")
+    }
+    if userId != b.BettorId && userId != b.BettedId {
+        return nil, nil, errors.New("Only the bettor and the betted user can negotiate a bet")
+    }
+
+    open, err := scanOffer(tx.QueryRowContext(ctx, "select " + offerColumns + " from bet_offers " +
+                                                   "where bet_id = ? and status = 'open' order by version desc limit 1", betId))
+    if err == sql.ErrNoRows {
+        // bets made before negotiation existed start from their current terms
+        open = &Offer{
+            BetId: betId,
+            Version: 1,
+            ProposerId: b.BettorId,
+            Amount: b.Amount,
+            BettedStake: b.Amount,
+            Title: b.Title,
+            Description: b.Desc,
+            WitnessId: b.WitnessId,
+        }
+        if b.BettedStake > 0 {
+            open.BettedStake = b.BettedStake
+        }
+        if err = tx.insertOffer(ctx, *open); err != nil {
+            return nil, nil, err
+        }
+    } else if err != nil {
+        return nil, nil, errors.New("Failed to load the open offer: " + err.Error())
+    }
+
+    if open.ProposerId == userId {
+        return nil, nil, errors.New("Waiting for the other side to respond to your offer")
+    }
+
+    return b, open, nil
+}
+
+// answerOpenOffer closes the open offer on a bet that is being accepted or
+// declined through its status. Countered terms have to be accepted as an offer,
+// so they get applied to the bet.
+func (tx *Tx) answerOpenOffer(ctx context.Context, b *Bet, actorId int, status string) error {
+    var version int
+    err := tx.QueryRowContext(ctx, "select version from bet_offers where bet_id = ? and status = 'open' " +
+                                   "order by version desc limit 1", b.Id).Scan(&version)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return errors.New("Failed to load the open offer: " + err.Error())
+    }
+
+    if status == "active" && version > 1 {
+        return errors.New("The bet has been countered; accept offer version " + strconv.Itoa(version) + " instead")
+    }
+
+    answer := "accepted"
+    if status == "declined" {
+        answer = "declined"
+    }
+
+    _, err = tx.ExecContext(ctx, "update bet_offers set status = ?, responded_on = utc_timestamp() where bet_id = ? and version = ?",
+                            answer, b.Id, version)
+    if err != nil {
+        return errors.New("Failed to update offer: " + err.Error())
+    }
+    return nil
+}
+
+// CounterOffer answers the open offer on a bet with new terms. Terms left
+// out of changes carry over from the open offer.
+func (db *MyDB) CounterOffer(ctx context.Context, betId int, userId int, changes map[string]string) (*Offer, error) {
+
+    var counter Offer
+    err := db.InTx(ctx, func(tx *Tx) error {
+        b, open, err := tx.negotiation(ctx, betId, userId)
+        if err != nil {
+            return err
+        }
+
+        counter = *open
+        counter.Version = open.Version + 1
+        counter.ProposerId = userId
+        if err = counter.apply(changes); err != nil {
+            return err
+        }
+        if counter.WitnessId == b.BettorId || counter.WitnessId == b.BettedId {
+            return errors.New("The witness can't be the bettor or the betted user")
+        }
+
+        _, err = tx.ExecContext(ctx, "update bet_offers set status = 'countered', responded_on = utc_timestamp() " +
+                                     "where bet_id = ? and version = ?", betId, open.Version)
+        if err != nil {
+            return errors.New("Failed to update offer: " + err.Error())
+        }
+
+        if err = tx.insertOffer(ctx, counter); err != nil {
+            return err
+        }
+
+        return tx.Event(ctx, "bet.countered", betId, []int{b.BettorId, b.BettedId}, counter)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    Logger(ctx).Info("bet countered", "bet_id", betId, "version", counter.Version, "user_id", userId)
+
+    return &counter, nil
+}
+
+// AcceptOffer accepts the open offer on a bet: its terms become the bet, which becomes active.
+func (db *MyDB) AcceptOffer(ctx context.Context, betId int, userId int, version int) error {
+
+    err := db.InTx(ctx, func(tx *Tx) error {
+        b, open, err := tx.negotiation(ctx, betId, userId)
+        if err != nil {
+            return err
+        }
+
+        if open.Version != version {
+            return errors.New("Only the latest offer, version " + strconv.Itoa(open.Version) + ", can be accepted")
+        }
+
+        // the accepted stakes have to fit within both players' limits
+        if err = tx.checkLimits(ctx, b.BettorId, betId, open.Amount); err != nil {
+            return err
+        }
+        if err = tx.checkLimits(ctx, b.BettedId, betId, open.BettedStake); err != nil {
+            return err
+        }
+
+        _, err = tx.ExecContext(ctx, "update bet_offers set status = 'accepted', responded_on = utc_timestamp() " +
+                                     "where bet_id = ? and version = ?", betId, version)
+        if err != nil {
+            return errors.New("Failed to update offer: " + err.Error())
+        }
+
+        _, err = tx.ExecContext(ctx, "update bets set title = ?, description = ?, witness_id = ?, amount = ?, status = 'active' where id = ?",
+                                open.Title, open.Description, open.WitnessId, open.Amount, betId)
+        if err != nil {
+            return errors.New("Failed to apply offer: " + err.Error())
+        }
+
+        // stakes and the witness follow the accepted terms
+        _, err = tx.ExecContext(ctx, "update bet_participants set stake = if(user_id = ?, ?, ?) where bet_id = ? and role = 'player'",
+                                b.BettorId, open.Amount, open.BettedStake, betId)
+        if err != nil {
+            return errors.New("Failed to apply offer stakes: " + err.Error())
+        }
+        if open.WitnessId != b.WitnessId {
+            _, err = tx.ExecContext(ctx, "delete from bet_participants where bet_id = ? and role = 'witness'", betId)
+            if err != nil {
+                return errors.New("Failed to replace witness: " + err.Error())
+            }
+            if err = tx.addParticipant(ctx, betId, Participant{ UserId: open.WitnessId, Role: "witness" }); err != nil {
+                return err
+            }
+        }
+
+        // odds no longer describe stakes that were negotiated
+        if open.Amount != b.Amount || (b.Odds != nil && open.BettedStake != b.BettedStake) {
+            if _, err = tx.ExecContext(ctx, "delete from bet_odds where bet_id = ?", betId); err != nil {
+                return errors.New("Failed to clear odds: " + err.Error())
+            }
+        }
+
+        err = tx.RecordBetChange(ctx, BetChange{
+            BetId: betId,
+            ActorId: userId,
+            Action: "status",
+            OldStatus: "pending",
+            NewStatus: "active",
+            Reason: "accepted offer version " + strconv.Itoa(version),
+        })
+        if err != nil {
+            return err
+        }
+
+        return tx.BetEvent(ctx, "bet.accepted", betId)
+    })
+    if err != nil {
+        return err
+    }
+
+    db.countBetStatus(ctx, betId, "active")
+    Logger(ctx).Info("bet offer accepted", "bet_id", betId, "version", version, "user_id", userId)
+
+    return nil
+}
+
+// apply changes the terms of an offer. Unknown terms are rejected.
+func (o *Offer) apply(changes map[string]string) error {
+    if len(changes) == 0 {
+        return errors.New("A counter-offer has to change something")
+    }
+
+    for k, v := range changes {
+        var err error
+        switch k {
+        case "amount":
+            o.Amount, err = strconv.Atoi(v)
+            if err == nil && o.Amount <= 0 {
+                err = errors.New("Parameter 'amount' must be a positive number of cents")
+            }
+        case "betted_stake":
+            o.BettedStake, err = strconv.Atoi(v)
+            if err == nil && o.BettedStake <= 0 {
+                err = errors.New("Parameter 'betted_stake' must be a positive number of cents")
+            }
+        case "title":
+            o.Title = strings.TrimSpace(v)
+            if o.Title == "" {
+                err = errors.New("Parameter 'title' can't be empty")
+            }
+        case "description":
+            o.Description = v
+        case "witness_id":
+            o.WitnessId, err = strconv.Atoi(v)
+            if err == nil && o.WitnessId <= 0 {
+                err = errors.New("Parameter 'witness_id' must be a user id")
+            }
+        case "deadline":
+            var t time.Time
+            if t, err = time.Parse(time.RFC3339, v); err == nil {
+                if !t.After(time.Now()) {
+                    err = errors.New("Parameter 'deadline' must be in the future")
+                }
+                t = t.UTC()
+                o.Deadline = &t
+            }
+        default:
+            err = errors.New("Unknown term " + k)
+        }
+
+        if err != nil {
+            return errors.New("Invalid " + k + ": " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+/* Handlers */
+
+// BetOffersShowHandler shows the negotiation history of a bet.
+// Handles GET to /bets/{id}/offers.
+func (db *MyDB) BetOffersShowHandler(rw http.ResponseWriter, r *http.Request) {
+    b, _, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    offers, err := db.GetOffers(r.Context(), b.Id)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, offers)
+}
+
+// BetOffersCreateHandler counters the open offer on a bet.
+// Handles POST to /bets/{id}/offers with the terms to change.
+func (db *MyDB) BetOffersCreateHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var changes map[string]string
+    if err = json.Unmarshal(body, &changes); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+    delete(changes, "access_token")
+
+    o, err := db.CounterOffer(r.Context(), id, userId, changes)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, o)
+}
+
+// BetOfferAcceptHandler accepts the open offer on a bet.
+// Handles POST to /bets/{id}/offers/{version}/accept.
+func (db *MyDB) BetOfferAcceptHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    version, _ := strconv.Atoi(mux.Vars(r)["version"])
+
+    if err = db.AcceptOffer(r.Context(), id, userId, version); err != nil {
+        if !WriteLimitError(rw, err) {
+            WriteError(rw, 400, err.Error())
+        }
+        return
+    }
+
+    WriteSuccess(rw)
+}
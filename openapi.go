@@ -0,0 +1,705 @@
+package main
+
+import (
+    _ "embed"
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "regexp"
+    "strings"
+    "time"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// A RouteDoc documents a route of the route table in the OpenAPI document.
+type RouteDoc struct {
+    Summary string
+    Tag string
+    Query []string          // optional query parameters
+    Body []string           // required string fields of a JSON object body
+    OptionalBody []string   // optional string fields of a JSON object body
+    BodyType interface{}    // a value of the body type, for bodies that aren't flat objects
+    Data interface{}        // a value of the type returned in the data field
+    Text string             // content type of a plain, non-JSON response
+}
+
+// RouteDocs documents every route of the API by its unversioned name.
+var RouteDocs = map[string]RouteDoc{
+    "ContactsCheck": {
+        Summary: "Find the users among a list of phone contacts",
+        Tag: "contacts",
+        BodyType: []Contact{},
+        Data: []ContactPair{},
+    },
+    "Verify": {
+        Summary: "Verify a user's phone number with the texted verification token",
+        Tag: "users",
+        Body: []string{"access_token", "verification_token"},
+    },
+    "UserShow": {
+        Summary: "Get a user",
+        Tag: "users",
+        Data: User{},
+    },
+    "UserUpdate": {
+        Summary: "Update a user, texting the verification token to the new number if the phone number changes",
+        Tag: "users",
+        OptionalBody: []string{"first_name", "last_name", "email", "profile_pic_url", "phone_number"},
+    },
+    "UserDelete": {
+        Summary: "Delete a user",
+        Tag: "users",
+    },
+    "UserBets": {
+        Summary: "List the bets a user is the bettor or betted user of, as far as you may see them",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Data: []Bet{},
+    },
+    "UserWitnessing": {
+        Summary: "List the bets a user is the witness of, as far as you may see them",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Data: []Bet{},
+    },
+    "UserStats": {
+        Summary: "Get a user's wins, losses, pushes, win rate, net cents, biggest win and current streak over the bets they played in",
+        Tag: "users",
+        Data: UserStats{},
+    },
+    "UserVersus": {
+        Summary: "Get the head-to-head record of a user against another: every two-person bet between them, wins for each, the net cents the user is up and the most recent result, over the bets you may see",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Data: Rivalry{},
+    },
+    "UserPrivacy": {
+        Summary: "Get the visibility and hidden amount your new bets get unless you choose otherwise",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Data: BetPrivacy{},
+    },
+    "UserPrivacyUpdate": {
+        Summary: "Set the visibility (participants, friends or public) and hidden amount your new bets get",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Body: []string{"visibility"},
+        OptionalBody: []string{"hide_amount"},
+        Data: BetPrivacy{},
+    },
+    "UserLimits": {
+        Summary: "Get your betting limits in cents (null is no limit), any raised limits waiting out the cooling-off period, and how long you have excluded yourself for",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Data: UserLimits{},
+    },
+    "UserLimitsUpdate": {
+        Summary: "Set your limits on the stake per bet, the cents at stake on unsettled bets, and net losses per day, week (7 days) and month (30 days); limits left out are removed. Lower limits apply at once, raised or removed ones after 24 hours. Bets over a player's limits are refused with error_code stake_limit, exposure_limit, loss_limit_day, loss_limit_week or loss_limit_month",
+        Tag: "users",
+        Query: []string{"access_token"},
+        BodyType: Limits{},
+        Data: UserLimits{},
+    },
+    "UserExclusion": {
+        Summary: "Exclude yourself from new bets for a number of days; an exclusion can be extended but not shortened, and bets refused by it have error_code self_excluded",
+        Tag: "users",
+        Query: []string{"access_token"},
+        Body: []string{"days"},
+        Data: UserLimits{},
+    },
+    "Leaderboard": {
+        Summary: "Rank users by net, wins or win_rate over a window (day, week, month, year, all or a number of days like 90d), globally or among the people you have shared a bet with",
+        Tag: "leaderboards",
+        Query: []string{"window", "by", "scope", "limit", "access_token"},
+        Data: []LeaderboardEntry{},
+    },
+    "UsersShow": {
+        Summary: "List verified users, filtered by any user column",
+        Tag: "users",
+        Query: []string{"first_name", "last_name", "email", "venmo_id"},
+        Data: []User{},
+    },
+    "UsersCreate": {
+        Summary: "Create a user from their Venmo account and text them a verification token",
+        Tag: "users",
+        Body: []string{"access_token", "phone_number"},
+    },
+    "BetsHook": {
+        Summary: "Receive Venmo webhook calls",
+        Tag: "bets",
+        Text: "text/plain",
+    },
+    "GroupBetsCreate": {
+        Summary: "Create a bet any number of players join on named outcomes, resolved by one or more witnesses",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        BodyType: GroupBetRequest{},
+        Data: Bet{},
+    },
+    "BetJoin": {
+        Summary: "Join an open group bet on a side; the stake in cents defaults to the bet's amount",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Body: []string{"side"},
+        OptionalBody: []string{"stake"},
+        Data: Bet{},
+    },
+    "BetResolve": {
+        Summary: "As a witness, pick the winning side of an active bet; it settles once most witnesses agree, and the pool is split pro rata among the winners",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Body: []string{"side"},
+        Data: Bet{},
+    },
+    "BetOfferAccept": {
+        Summary: "Accept the other side's latest offer on a pending two-person bet; its terms become the bet, which becomes active",
+        Tag: "bets",
+        Query: []string{"access_token"},
+    },
+    "BetOffersShow": {
+        Summary: "List the offers made while negotiating a two-person bet, oldest version first; only for the bet's participants",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Data: []Offer{},
+    },
+    "BetOffersCreate": {
+        Summary: "Counter the other side's latest offer on a pending two-person bet with new terms; terms left out carry over",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        OptionalBody: []string{"amount", "betted_stake", "title", "description", "witness_id", "deadline"},
+        Data: Offer{},
+    },
+    "BetShow": {
+        Summary: "Get a bet, with the evidence attached to it, if you may see it; hidden amounts are left out for non-participants",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Data: Bet{},
+    },
+    "BetDelete": {
+        Summary: "Delete a bet you made",
+        Tag: "bets",
+        Query: []string{"access_token"},
+    },
+    "BetStatus": {
+        Summary: "Change the status of a bet: the betted user accepts (active) or declines a pending bet, a player disputes an active one, and the witness settles it with the winner",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Body: []string{"status"},
+        OptionalBody: []string{"winner_id", "reason"},
+    },
+    "BetHistory": {
+        Summary: "List every change made to a bet you may see, oldest first, including deletion",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Data: []BetChange{},
+    },
+    "BetPrivacy": {
+        Summary: "As a participant, set who can see a bet (participants, friends or public) and whether its amounts are hidden from everyone else",
+        Tag: "bets",
+        Query: []string{"access_token"},
+        Body: []string{"visibility"},
+        OptionalBody: []string{"hide_amount"},
+        Data: BetPrivacy{},
+    },
+    "BetCommentUpdate": {
+        Summary: "Edit one of your comments, shortly after posting it",
+        Tag: "comments",
+        Query: []string{"access_token"},
+        Body: []string{"body"},
+        Data: Comment{},
+    },
+    "BetCommentDelete": {
+        Summary: "Delete one of your comments; replies to it stay",
+        Tag: "comments",
+        Query: []string{"access_token"},
+    },
+    "BetCommentsShow": {
+        Summary: "List a page of a bet's comments, oldest first; only for the bet's participants",
+        Tag: "comments",
+        Query: []string{"access_token", "cursor", "limit"},
+        Data: []Comment{},
+    },
+    "BetCommentsCreate": {
+        Summary: "Comment on a bet, or reply to a comment; @<user id> mentions notify other participants",
+        Tag: "comments",
+        Query: []string{"access_token"},
+        Body: []string{"body"},
+        OptionalBody: []string{"parent_id"},
+        Data: Comment{},
+    },
+    "BetEvidenceShow": {
+        Summary: "Download an uploaded piece of evidence; only for the bet's participants",
+        Tag: "evidence",
+        Query: []string{"access_token"},
+        Text: "image/*",
+    },
+    "BetEvidenceCreate": {
+        Summary: "Attach evidence to a bet: a multipart upload of an image as 'file', or a JSON body with a 'url'; both take an optional 'caption'",
+        Tag: "evidence",
+        Query: []string{"access_token"},
+        OptionalBody: []string{"url", "caption"},
+        Data: Evidence{},
+    },
+    "BetsShow": {
+        Summary: "List the bets you may see, filtered by bet columns, category and tag",
+        Tag: "bets",
+        Query: []string{"access_token", "bettor_id", "betted_id", "witness_id", "winner_id", "status", "category", "tag"},
+        Data: []Bet{},
+    },
+    "BetsCreate": {
+        Summary: "Create a bet against another user. The bettor stakes amount, in cents; the betted user stakes the same, betted_stake, or the bettor's winnings at odds (fractional 5/2, decimal 3.5 or American +250, with odds_format to be explicit), rounded to the nearest cent. A template_id fills in whatever is left out, including title and amount",
+        Tag: "bets",
+        Body: []string{"access_token", "betted_id", "witness_id", "title", "amount"},
+        OptionalBody: []string{"description", "betted_stake", "odds", "odds_format", "deadline", "visibility", "hide_amount",
+                               "category", "tags", "template_id"},
+    },
+    "CategoryStats": {
+        Summary: "Get the number of bets, active and settled bets and cents staked in every category, busiest first; with user_id, also that user's wins, losses and net cents in each, counting only bets you may see",
+        Tag: "categories",
+        Query: []string{"user_id", "access_token"},
+        Data: []CategoryStats{},
+    },
+    "Categories": {
+        Summary: "List the categories bets can be filed under",
+        Tag: "categories",
+        Data: []Category{},
+    },
+    "TemplateDelete": {
+        Summary: "Delete one of your bet templates",
+        Tag: "categories",
+        Query: []string{"access_token"},
+    },
+    "TemplatesShow": {
+        Summary: "List the built-in bet templates, and your own when authenticated",
+        Tag: "categories",
+        Query: []string{"access_token"},
+        Data: []Template{},
+    },
+    "TemplatesCreate": {
+        Summary: "Save a bet template that pre-fills the title, description, amount, deadline (as a duration in days), category and tags of new bets",
+        Tag: "categories",
+        Query: []string{"access_token"},
+        BodyType: Template{},
+        Data: Template{},
+    },
+    "SeriesStatus": {
+        Summary: "Pause, resume or cancel a series you play in; resuming skips the bets missed while paused",
+        Tag: "series",
+        Query: []string{"access_token"},
+        Body: []string{"status"},
+        Data: Series{},
+    },
+    "SeriesItem": {
+        Summary: "Get a series you take part in, with the bets it has spawned and each player's wins, losses and net cents over the settled ones",
+        Tag: "series",
+        Query: []string{"access_token"},
+        Data: Series{},
+    },
+    "SeriesUpdate": {
+        Summary: "Change the terms or schedule of a series you started; bets already spawned keep their terms",
+        Tag: "series",
+        Query: []string{"access_token"},
+        BodyType: SeriesRequest{},
+        Data: Series{},
+    },
+    "SeriesDelete": {
+        Summary: "Cancel a series you play in; bets already spawned stay",
+        Tag: "series",
+        Query: []string{"access_token"},
+    },
+    "SeriesShow": {
+        Summary: "List the series you play in, newest first",
+        Tag: "series",
+        Query: []string{"access_token"},
+        Data: []Series{},
+    },
+    "SeriesCreate": {
+        Summary: "Start a series of recurring bets against another user. rule is an RRULE like FREQ=WEEKLY;BYDAY=MO;COUNT=10 (FREQ DAILY, WEEKLY or MONTHLY, with INTERVAL, BYDAY, COUNT and UNTIL); each occurrence spawns a pending bet that runs until the next one",
+        Tag: "series",
+        Query: []string{"access_token"},
+        BodyType: SeriesRequest{},
+        Data: Series{},
+    },
+    "AdminUserRole": {
+        Summary: "Give a user the user, support or admin role (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Body: []string{"role"},
+    },
+    "AdminUserBan": {
+        Summary: "Ban a user from the API, with a reason (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Body: []string{"reason"},
+    },
+    "AdminUserUnban": {
+        Summary: "Lift a user's ban (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+    },
+    "AdminUserVerification": {
+        Summary: "Text an unverified user their verification token again (support)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+    },
+    "AdminUser": {
+        Summary: "Look up a user, deleted or not, with their phone number, role, ban and limits (support)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Data: AdminUser{},
+    },
+    "AdminBetStatus": {
+        Summary: "Force a bet into pending, active, declined or disputed, skipping the usual checks; the reason goes in its audit trail (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Body: []string{"status", "reason"},
+    },
+    "AdminBetResolve": {
+        Summary: "Settle a disputed bet on a side (bettor or betted for two-person bets, an outcome for group bets), or push to give every stake back (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Body: []string{"side", "reason"},
+    },
+    "AdminBet": {
+        Summary: "Look up a bet, deleted or not, with its audit trail and any review of its payouts (support)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Data: AdminBet{},
+    },
+    "AdminReview": {
+        Summary: "Release or void the payouts held on a bet the fraud rules flagged (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token"},
+        Body: []string{"decision"},
+        OptionalBody: []string{"note"},
+    },
+    "AdminReviews": {
+        Summary: "List a page of bets the fraud rules flagged, oldest first, with why and the payouts held (support)",
+        Tag: "admin",
+        Query: []string{"access_token", "status", "cursor", "limit"},
+        Data: []Review{},
+    },
+    "AdminActions": {
+        Summary: "List a page of the audit log of every request to the admin API, newest first (admin only)",
+        Tag: "admin",
+        Query: []string{"access_token", "actor_id", "cursor", "limit"},
+        Data: []AdminAction{},
+    },
+    "Search": {
+        Summary: "Search bet titles and descriptions and user names, tolerating typos; results are ranked and only include bets you may see",
+        Tag: "search",
+        Query: []string{"q", "limit", "access_token"},
+        Data: []SearchResult{},
+    },
+    "Feed": {
+        Summary: "List a page of bets being created, accepted and settled by you and the people you have shared a bet with, newest first; participants-only bets show up only for their participants",
+        Tag: "feed",
+        Query: []string{"access_token", "cursor", "limit"},
+        Data: []FeedItem{},
+    },
+    "Events": {
+        Summary: "Stream bet events for the authenticated user as Server-Sent Events, or over a WebSocket on upgrade",
+        Tag: "events",
+        Query: []string{"access_token", "last_event_id"},
+        Text: "text/event-stream",
+    },
+    "WebhookShow": {
+        Summary: "Get one of the authenticated user's webhooks",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+        Data: Webhook{},
+    },
+    "WebhookDelete": {
+        Summary: "Delete a webhook",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+    },
+    "WebhookDeliveries": {
+        Summary: "List the most recent deliveries of a webhook",
+        Tag: "webhooks",
+        Query: []string{"access_token", "status"},
+        Data: []WebhookDelivery{},
+    },
+    "WebhookRetry": {
+        Summary: "Requeue a dead-lettered delivery",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+    },
+    "WebhookDeadLetters": {
+        Summary: "List the deliveries of a webhook that ran out of attempts",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+        Data: []WebhookDelivery{},
+    },
+    "WebhookPing": {
+        Summary: "Send a signed test event to a webhook and report the response",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+        Data: WebhookDelivery{},
+    },
+    "WebhooksShow": {
+        Summary: "List the authenticated user's webhooks",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+        Data: []Webhook{},
+    },
+    "WebhooksCreate": {
+        Summary: "Subscribe a URL to comma separated events; the signing secret is only returned here",
+        Tag: "webhooks",
+        Query: []string{"access_token"},
+        Body: []string{"url", "events"},
+        Data: Webhook{},
+    },
+    "Metrics": {
+        Summary: "Prometheus metrics",
+        Tag: "system",
+        Text: "text/plain",
+    },
+    "OpenAPI": {
+        Summary: "This OpenAPI document",
+        Tag: "system",
+        Text: "application/json",
+    },
+    "Docs": {
+        Summary: "Interactive API documentation",
+        Tag: "system",
+        Text: "text/html",
+    },
+}
+
+/* Document */
+
+// An OpenAPI is an OpenAPI 3 document.
+type OpenAPI struct {
+    OpenAPI string                              `json:"openapi"`
+    Info map[string]string                      `json:"info"`
+    Paths map[string]map[string]*Operation      `json:"paths"`
+    Components map[string]map[string]Schema     `json:"components"`
+}
+
+// An Operation is a single method on a path of an OpenAPI document.
+type Operation struct {
+    OperationId string              `json:"operationId"`
+    Summary string                  `json:"summary,omitempty"`
+    Tags []string                   `json:"tags,omitempty"`
+    Deprecated bool                 `json:"deprecated,omitempty"`
+    Parameters []Schema             `json:"parameters,omitempty"`
+    RequestBody Schema              `json:"requestBody,omitempty"`
+    Responses map[string]Schema     `json:"responses"`
+}
+
+// A Schema is a free-form OpenAPI object.
+type Schema map[string]interface{}
+
+var pathVarPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// SpecPath converts a mux path template such as /users/{id:[0-9]+} to an
+// OpenAPI path such as /users/{id}.
+func SpecPath(pattern string) string {
+    return pathVarPattern.ReplaceAllString(pattern, "{$1}")
+}
+
+// OpenAPISpec generates the OpenAPI document of a route table.
+// Routes without a RouteDoc are left out.
+func OpenAPISpec(routes []Route) *OpenAPI {
+    spec := &OpenAPI{
+        OpenAPI: "3.0.3",
+        Info: map[string]string{
+            "title": "Bettor API",
+            "version": "1.0.0",
+        },
+        Paths: make(map[string]map[string]*Operation),
+        Components: map[string]map[string]Schema{ "schemas": make(map[string]Schema) },
+    }
+    schemas := spec.Components["schemas"]
+
+    // the envelope every JSON response is wrapped in
+    envelope := schemaOf(reflect.TypeOf(JSONResponse{}), schemas)
+
+    for _, route := range routes {
+        doc, ok := RouteDocs[BaseName(route.Name)]
+        if !ok {
+            continue
+        }
+
+        path := SpecPath(route.Pattern)
+        if spec.Paths[path] == nil {
+            spec.Paths[path] = make(map[string]*Operation)
+        }
+
+        for _, method := range route.Methods {
+            op := &Operation{
+                OperationId: route.Name,
+                Summary: doc.Summary,
+                Responses: make(map[string]Schema),
+            }
+            if doc.Tag != "" {
+                op.Tags = []string{doc.Tag}
+            }
+            if RouteVersion(route.Name) == "legacy" {
+                op.Deprecated = true
+            }
+            if len(route.Methods) > 1 {
+                op.OperationId = route.Name + method[:1] + strings.ToLower(method[1:])
+            }
+
+            for _, match := range pathVarPattern.FindAllStringSubmatch(route.Pattern, -1) {
+                param := Schema{ "name": match[1], "in": "path", "required": true, "schema": Schema{ "type": "string" } }
+                if match[2] == ":[0-9]+" {
+                    param["schema"] = Schema{ "type": "integer" }
+                }
+                op.Parameters = append(op.Parameters, param)
+            }
+            for _, q := range doc.Query {
+                op.Parameters = append(op.Parameters, Schema{ "name": q, "in": "query", "schema": Schema{ "type": "string" } })
+            }
+
+            if body := requestSchema(doc, schemas); body != nil {
+                op.RequestBody = Schema{
+                    "required": true,
+                    "content": Schema{ "application/json": Schema{ "schema": body } },
+                }
+            }
+
+            if doc.Text != "" {
+                op.Responses["200"] = Schema{
+                    "description": "OK",
+                    "content": Schema{ doc.Text: Schema{ "schema": Schema{ "type": "string" } } },
+                }
+            } else {
+                ok := envelope
+                if doc.Data != nil {
+                    ok = Schema{ "allOf": []Schema{
+                        envelope,
+                        Schema{ "type": "object", "properties": Schema{ "data": schemaOf(reflect.TypeOf(doc.Data), schemas) } },
+                    }}
+                }
+                op.Responses["200"] = Schema{
+                    "description": "OK",
+                    "content": Schema{ "application/json": Schema{ "schema": ok } },
+                }
+                op.Responses["default"] = Schema{
+                    "description": "Error, described by meta.error_message; bets refused by a player's limits are a 403 with meta.error_code",
+                    "content": Schema{ "application/json": Schema{ "schema": envelope } },
+                }
+            }
+
+            spec.Paths[path][strings.ToLower(method)] = op
+        }
+    }
+
+    return spec
+}
+
+// requestSchema describes the JSON body of a route, if it has one.
+func requestSchema(doc RouteDoc, schemas map[string]Schema) Schema {
+    if doc.BodyType != nil {
+        return schemaOf(reflect.TypeOf(doc.BodyType), schemas)
+    }
+    if len(doc.Body) == 0 && len(doc.OptionalBody) == 0 {
+        return nil
+    }
+
+    props := Schema{}
+    for _, field := range append(append([]string{}, doc.Body...), doc.OptionalBody...) {
+        props[field] = Schema{ "type": "string" }
+    }
+
+    body := Schema{ "type": "object", "properties": props }
+    if len(doc.Body) > 0 {
+        body["required"] = doc.Body
+    }
+    return body
+}
+
+// schemaOf describes a Go type, adding named structs to the component schemas.
+func schemaOf(t reflect.Type, schemas map[string]Schema) Schema {
+    if t == reflect.TypeOf(time.Time{}) {
+        return Schema{ "type": "string", "format": "date-time" }
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        return schemaOf(t.Elem(), schemas)
+    case reflect.Bool:
+        return Schema{ "type": "boolean" }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+         reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return Schema{ "type": "integer" }
+    case reflect.Float32, reflect.Float64:
+        return Schema{ "type": "number" }
+    case reflect.String:
+        return Schema{ "type": "string" }
+    case reflect.Slice, reflect.Array:
+        return Schema{ "type": "array", "items": schemaOf(t.Elem(), schemas) }
+    case reflect.Map:
+        return Schema{ "type": "object", "additionalProperties": schemaOf(t.Elem(), schemas) }
+    case reflect.Struct:
+        ref := Schema{ "$ref": "#/components/schemas/" + t.Name() }
+        if _, ok := schemas[t.Name()]; ok {
+            return ref
+        }
+
+        props := Schema{}
+        required := make([]string, 0)
+        schemas[t.Name()] = Schema{}    // guards against recursive types
+
+        for i := 0; i < t.NumField(); i++ {
+            f := t.Field(i)
+            if f.PkgPath != "" {
+                continue
+            }
+
+            tag := strings.Split(f.Tag.Get("json"), ",")
+            name := tag[0]
+            if name == "-" {
+                continue
+            }
+            if name == "" {
+                name = f.Name
+            }
+
+            props[name] = schemaOf(f.Type, schemas)
+            if len(tag) == 1 || tag[1] != "omitempty" {
+                required = append(required, name)
+            }
+        }
+
+        schema := Schema{ "type": "object", "properties": props }
+        if len(required) > 0 {
+            schema["required"] = required
+        }
+        schemas[t.Name()] = schema
+
+        return ref
+    }
+
+    // interface{} and anything else can hold any JSON value
+    return Schema{}
+}
+
+/* Handlers */
+
+// OpenAPIHandler serves the OpenAPI document of the API.
+// Handles GET to /openapi.json.
+func (db *MyDB) OpenAPIHandler(rw http.ResponseWriter, r *http.Request) {
+    js, err := json.Marshal(OpenAPISpec(db.Routes()))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(200)
+    rw.Write(js)
+}
+
+// DocsHandler serves a page rendering the OpenAPI document.
+// Handles GET to /docs.
+func DocsHandler(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+    rw.WriteHeader(200)
+    rw.Write(docsPage)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/gorilla/mux"
+)
+
+// TestOpenAPICoversRoutes fails when a route served by the router has no
+// matching operation in the OpenAPI document.
+func TestOpenAPICoversRoutes(t *testing.T) {
+    db := &MyDB{}
+    routes := db.Routes()
+    router := NewRouter(routes)
+    spec := OpenAPISpec(routes)
+
+    for _, route := range routes {
+        if router.Get(route.Name) == nil {
+            t.Errorf("route %s is not registered with the router", route.Name)
+            continue
+        }
+
+        path := SpecPath(route.Pattern)
+        url := pathVarPattern.ReplaceAllString(route.Pattern, "1")
+
+        for _, method := range route.Methods {
+            var match mux.RouteMatch
+            if !router.Match(httptest.NewRequest(method, url, nil), &match) {
+                t.Errorf("%s %s does not match route %s", method, url, route.Name)
+            }
+
+            if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+                t.Errorf("%s %s (route %s) has no entry in the OpenAPI document", method, path, route.Name)
+            }
+        }
+    }
+}
+
+// TestOpenAPIHasNoStaleEntries fails when the OpenAPI document describes an
+// operation the router doesn't serve.
+func TestOpenAPIHasNoStaleEntries(t *testing.T) {
+    db := &MyDB{}
+    routes := db.Routes()
+
+    served := make(map[string]bool)
+    for _, route := range routes {
+        for _, method := range route.Methods {
+            served[strings.ToLower(method) + " " + SpecPath(route.Pattern)] = true
+        }
+    }
+
+    for path, ops := range OpenAPISpec(routes).Paths {
+        for method := range ops {
+            if !served[method + " " + path] {
+                t.Errorf("%s %s is documented but not routed", method, path)
+            }
+        }
+    }
+
+    for name := range RouteDocs {
+        found := false
+        for _, route := range routes {
+            found = found || BaseName(route.Name) == name
+        }
+        if !found {
+            t.Errorf("RouteDocs has an entry for unknown route %s", name)
+        }
+    }
+}
+
+// TestOpenAPISchemas checks the resource schemas are in the document.
+func TestOpenAPISchemas(t *testing.T) {
+    schemas := OpenAPISpec((&MyDB{}).Routes()).Components["schemas"]
+
+    for _, name := range []string{"User", "Bet", "Contact", "ContactPair", "JSONResponse"} {
+        if _, ok := schemas[name]; !ok {
+            t.Errorf("schema %s is missing from the OpenAPI document", name)
+        }
+    }
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "math"
+    "math/rand"
+    "strconv"
+    "time"
+)
+
+const (
+    // OutboxMaxAttempts is how many times an outbox entry is tried before it is given up on.
+    OutboxMaxAttempts = 10
+
+    outboxBaseBackoff = 15 * time.Second
+    outboxMaxBackoff = time.Hour
+
+    // outboxLease is how long a dispatcher holds an entry it is carrying out.
+    outboxLease = 2 * time.Minute
+)
+
+// A Queryer runs statements against the database, directly or inside a transaction.
+type Queryer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// A Tx is a transaction that also records the events and side effects of the
+// state change it makes, so they are committed along with it or not at all.
+type Tx struct {
+    *sql.Tx
+    events []Event
+}
+
+// InTx runs f in a transaction and commits it if f returns nil. Events
+// stored in the transaction are published once it has committed.
+func (db *MyDB) InTx(ctx context.Context, f func(tx *Tx) error) error {
+    sqltx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return errors.New("Failed to begin transaction: " + err.Error())
+    }
+    defer sqltx.Rollback()
+
+    tx := &Tx{ Tx: sqltx }
+    if err = f(tx); err != nil {
+        return err
+    }
+
+    if err = sqltx.Commit(); err != nil {
+        return errors.New("Failed to commit transaction: " + err.Error())
+    }
+
+    if db.Events != nil {
+        for _, e := range tx.events {
+            if err := db.Events.Publish(ctx, e); err != nil {
+                Logger(ctx).Warn("failed to publish event", "event_id", e.Id, "error", err)
+            }
+        }
+    }
+
+    return nil
+}
+
+// Event stores an event for the given users and queues it for their webhooks.
+func (tx *Tx) Event(ctx context.Context, typ string, betId int, userIds []int, data interface{}) error {
+
+    js, err := json.Marshal(data)
+    if err != nil {
+        return errors.New("Failed to encode event data: " + err.Error())
+    }
+
+    res, err := tx.ExecContext(ctx, "insert into events (type, bet_id, data) values (?, ?, ?)", typ, betId, js)
+    if err != nil {
+        return errors.New("Failed to insert event: " + err.Error())
+    }
+
+    id, err := res.LastInsertId()
+    if err != nil {
+        return errors.New("Failed to get event id: " + err.Error())
+    }
+
+    seen := make(map[int]bool)
+    recipients := make([]int, 0, len(userIds))
+    for _, u := range userIds {
+        if u <= 0 || seen[u] {
+            continue
+        }
+        seen[u] = true
+        recipients = append(recipients, u)
+
+        if _, err = tx.ExecContext(ctx, "insert into event_recipients (event_id, user_id) values (?, ?)", id, u); err != nil {
+            return errors.New("Failed to insert event recipient: " + err.Error())
+        }
+    }
+
+    e := Event{
+        Id: id,
+        Type: typ,
+        BetId: betId,
+        Data: js,
+        CreatedOn: time.Now().UTC(),
+        UserIds: recipients,
+    }
+
+    if err = EnqueueWebhooks(ctx, tx, e); err != nil {
+        return err
+    }
+
+    if FeedEventTypes[typ] && betId > 0 {
+        if err = tx.Enqueue(ctx, "feed.fanout", FeedFanout{ EventId: id, BetId: betId, Type: typ }); err != nil {
+            return err
+        }
+    }
+
+    tx.events = append(tx.events, e)
+    return nil
+}
+
+// BetEvent stores an event carrying the state of a bet, as of this
+// transaction, for its participants.
+func (tx *Tx) BetEvent(ctx context.Context, typ string, betId int) error {
+    b, err := getBet(ctx, tx, betId)
+    if err != nil {
+        return err
+    }
+    return tx.Event(ctx, typ, betId, b.Participants(), b)
+}
+
+// Enqueue adds a side effect to the outbox. The dispatcher carries it out
+// once the transaction has committed.
+func (tx *Tx) Enqueue(ctx context.Context, kind string, payload interface{}) error {
+    if _, ok := OutboxHandlers[kind]; !ok {
+        return errors.New("Unknown outbox entry kind " + kind)
+    }
+
+    js, err := json.Marshal(payload)
+    if err != nil {
+        return errors.New("Failed to encode outbox payload: " + err.Error())
+    }
+
+    _, err = tx.ExecContext(ctx, "insert into outbox (kind, payload, status, next_attempt_on) values (?, ?, 'pending', utc_timestamp())", kind, js)
+    if err != nil {
+        return errors.New("Failed to insert outbox entry: " + err.Error())
+    }
+
+    return nil
+}
+
+/* Side effects */
+
+// An OutboxHandler carries out one kind of outbox entry. Entries are carried
+// out at least once, so a handler may run again for an entry it already did
+// if the dispatcher stops before recording the outcome.
+type OutboxHandler func(ctx context.Context, db *MyDB, payload json.RawMessage) error
+
+// OutboxHandlers maps each kind of outbox entry to its handler.
+var OutboxHandlers = map[string]OutboxHandler{
+    "sms.verification": sendVerificationEntry,
+    "payment": sendPaymentEntry,
+    "feed.fanout": fanOutEntry,
+}
+
+// A VerificationSMS texts a user's verification token to a phone number.
+type VerificationSMS struct {
+    UserId int          `json:"user_id"`
+    PhoneNumber string  `json:"phone_number"`
+}
+
+func sendVerificationEntry(ctx context.Context, db *MyDB, payload json.RawMessage) error {
+    var sms VerificationSMS
+    if err := json.Unmarshal(payload, &sms); err != nil {
+        return errors.New("Bad verification text entry: " + err.Error())
+    }
+    return db.SendVerificationMsg(ctx, sms.UserId, sms.PhoneNumber)
+}
+
+// A Payment moves a settled bet's amount from the loser to the winner over Venmo.
+type Payment struct {
+    PayoutId int64      `json:"payout_id,omitempty"`
+    BetId int           `json:"bet_id"`
+    FromUserId int      `json:"from_user_id"`
+    ToUserId int        `json:"to_user_id"`
+    Amount int          `json:"amount"`   // in cents
+}
+
+// sendPaymentEntry pays out one bet_payouts row. Outbox entries can run more
+// than once, so the row is claimed before Venmo is called and marked paid
+// after, and the row id goes to Venmo as an idempotency key: a retry after a
+// crash between the two repeats the same request rather than paying twice.
+func sendPaymentEntry(ctx context.Context, db *MyDB, payload json.RawMessage) error {
+    var p Payment
+    if err := json.Unmarshal(payload, &p); err != nil {
+        return errors.New("Bad payment entry: " + err.Error())
+    }
+
+    payoutId, due, err := db.claimPayout(ctx, p)
+    if err != nil {
+        return err
+    }
+    if !due {
+        Logger(ctx).Info("skipping payout that isn't due", "bet_id", p.BetId, "payout_id", payoutId)
+        return nil
+    }
+
+    var accessToken, venmoId string
+    if err := db.QueryRowContext(ctx, "select access_token from users where id = ?", p.FromUserId).Scan(&accessToken); err != nil {
+        return errors.New("Failed to load paying user: " + err.Error())
+    }
+    if err := db.QueryRowContext(ctx, "select venmo_id from users where id = ?", p.ToUserId).Scan(&venmoId); err != nil {
+        return errors.New("Failed to load paid user: " + err.Error())
+    }
+
+    b, err := db.GetBet(ctx, p.BetId)
+    if err != nil {
+        return err
+    }
+
+    key := "bettor-payout-" + strconv.FormatInt(payoutId, 10)
+    if err = SendVenmoPayment(ctx, accessToken, venmoId, "Bettor: " + b.Title, p.Amount, key); err != nil {
+        return err
+    }
+
+    _, err = db.ExecContext(ctx, "update bet_payouts set status = 'paid', paid_on = utc_timestamp() where id = ? and status = 'sending'", payoutId)
+    if err != nil {
+        return errors.New("Failed to mark payout paid: " + err.Error())
+    }
+    return nil
+}
+
+// claimPayout locks the bet_payouts row of a payment and moves it to sending.
+// It reports false when the row is already paid, or was held or voided since
+// the payment was queued. A row left sending by an interrupted attempt is
+// claimed again, and resent under the same idempotency key.
+func (db *MyDB) claimPayout(ctx context.Context, p Payment) (int64, bool, error) {
+    payoutId := p.PayoutId
+    due := false
+
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var status string
+        var err error
+        if payoutId != 0 {
+            err = tx.QueryRowContext(ctx, "select status from bet_payouts where id = ? for update", payoutId).Scan(&status)
+        } else {
+            // entries queued before payments carried their row
+            err = tx.QueryRowContext(ctx, "select id, status from bet_payouts where bet_id = ? and from_user_id = ? and to_user_id = ? and amount = ? " +
+                                          "order by status = 'paid', id limit 1 for update",
+                                          p.BetId, p.FromUserId, p.ToUserId, p.Amount).Scan(&payoutId, &status)
+        }
+        if err == sql.ErrNoRows {
+            return errors.New("No payout recorded for bet " + strconv.Itoa(p.BetId))
+        } else if err != nil {
+            return errors.New("Failed to load payout: " + err.Error())
+        }
+
+        if status != "queued" && status != "sending" {
+            return nil
+        }
+        due = true
+
+        _, err = tx.ExecContext(ctx, "update bet_payouts set status = 'sending', attempts = attempts + 1 where id = ?", payoutId)
+        if err != nil {
+            return errors.New("Failed to claim payout: " + err.Error())
+        }
+        return nil
+    })
+
+    return payoutId, due, err
+}
+
+/* Dispatcher */
+
+// An outboxEntry is a side effect waiting in the outbox.
+type outboxEntry struct {
+    Id int64
+    Kind string
+    Payload json.RawMessage
+    Attempts int
+}
+
+// Backoff returns how long to wait after a number of failed attempts, doubling
+// from base up to max, with up to 10% jitter.
+func Backoff(attempts int, base time.Duration, max time.Duration) time.Duration {
+    d := time.Duration(float64(base) * math.Pow(2, float64(attempts - 1)))
+    if d > max || d <= 0 {
+        d = max
+    }
+    return d + time.Duration(rand.Int63n(int64(d / 10) + 1))
+}
+
+// RunDispatcher carries out due outbox entries and webhook deliveries, and
+// spawns the bets of due series, every interval until ctx is done. Any number
+// of instances can run it; each entry is leased to one of them at a time.
+func (db *MyDB) RunDispatcher(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        db.dispatchOutbox(ctx)
+        db.dispatchWebhooks(ctx)
+        db.spawnDueSeries(ctx)
+    }
+}
+
+func (db *MyDB) dispatchOutbox(ctx context.Context) {
+    entries, err := db.claimOutbox(ctx, 50)
+    if err != nil {
+        Logger(ctx).Error("claiming outbox entries failed", "error", err)
+        return
+    }
+
+    for _, e := range entries {
+        if err := db.attemptOutboxEntry(ctx, e); err != nil {
+            Logger(ctx).Error("outbox entry errored", "outbox_id", e.Id, "error", err)
+        }
+    }
+}
+
+// claimOutbox leases the outbox entries that are due.
+func (db *MyDB) claimOutbox(ctx context.Context, limit int) ([]outboxEntry, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, errors.New("Failed to begin outbox claim: " + err.Error())
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, "select id, kind, payload, attempts from outbox " +
+                                      "where status = 'pending' and next_attempt_on <= utc_timestamp() " +
+                                      "order by next_attempt_on limit ? for update skip locked", limit)
+    if err != nil {
+        return nil, errors.New("Failed query for due outbox entries: " + err.Error())
+    }
+
+    entries := make([]outboxEntry, 0)
+    for rows.Next() {
+        var e outboxEntry
+        var payload []byte
+        if err := rows.Scan(&e.Id, &e.Kind, &payload, &e.Attempts); err != nil {
+            rows.Close()
+            return nil, errors.New("Failed to scan outbox row: " + err.Error())
+        }
+        e.Payload = payload
+        entries = append(entries, e)
+    }
+    rows.Close()
+
+    lease := time.Now().UTC().Add(outboxLease)
+    for _, e := range entries {
+        if _, err := tx.ExecContext(ctx, "update outbox set next_attempt_on = ? where id = ?", lease, e.Id); err != nil {
+            return nil, errors.New("Failed to lease outbox entry: " + err.Error())
+        }
+    }
+
+    if err = tx.Commit(); err != nil {
+        return nil, errors.New("Failed to commit outbox claim: " + err.Error())
+    }
+
+    return entries, nil
+}
+
+// attemptOutboxEntry carries out an entry and records the outcome, scheduling
+// a retry or giving up once attempts run out.
+func (db *MyDB) attemptOutboxEntry(ctx context.Context, e outboxEntry) error {
+    attempts := e.Attempts + 1
+    status := "done"
+    next := time.Now().UTC()
+    var lastError sql.NullString
+
+    handler, ok := OutboxHandlers[e.Kind]
+    err := errors.New("Unknown outbox entry kind " + e.Kind)
+    if ok {
+        err = handler(ctx, db, e.Payload)
+    }
+
+    if err != nil {
+        lastError = sql.NullString{ String: truncate(err.Error(), 1024), Valid: true }
+        status = "pending"
+        next = next.Add(Backoff(attempts, outboxBaseBackoff, outboxMaxBackoff))
+
+        if attempts >= OutboxMaxAttempts || !ok {
+            status = "dead"
+        }
+        Logger(ctx).Warn("outbox entry failed", "outbox_id", e.Id, "kind", e.Kind,
+                         "attempts", attempts, "status", status, "error", err)
+    }
+
+    _, err = db.ExecContext(ctx, "update outbox set status = ?, attempts = ?, last_error = ?, next_attempt_on = ?, " +
+                                 "done_on = if(? = 'done', utc_timestamp(), null) where id = ?",
+                            status, attempts, lastError, next, status, e.Id)
+    if err != nil {
+        return errors.New("Failed to record outbox entry: " + err.Error())
+    }
+
+    return nil
+}
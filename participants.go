@@ -0,0 +1,755 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// The sides of a two-person bet.
+const (
+    SideBettor = "bettor"
+    SideBetted = "betted"
+)
+
+// A Participant is a user taking part in a bet: a player who staked cents on
+// a side, or a witness who resolves the outcome.
+type Participant struct {
+    UserId int              `json:"user_id"`
+    Role string             `json:"role"`                 // player or witness
+    Side string             `json:"side,omitempty"`
+    Stake int               `json:"stake,omitempty"`      // in cents
+    Payout *int             `json:"payout,omitempty"`     // in cents, once settled
+    JoinedOn time.Time      `json:"joined_on"`
+}
+
+// Outcomes returns the sides of a bet that can win.
+func (b *Bet) Outcomes() []string {
+    if b.Kind == "group" {
+        return b.Sides
+    }
+    return []string{SideBettor, SideBetted}
+}
+
+// Witnesses returns the ids of the users who resolve a bet.
+func (b *Bet) Witnesses() []int {
+    if len(b.Members) == 0 {
+        return []int{b.WitnessId}
+    }
+
+    ids := make([]int, 0)
+    for _, m := range b.Members {
+        if m.Role == "witness" {
+            ids = append(ids, m.UserId)
+        }
+    }
+    return ids
+}
+
+// Member returns the participant entry of a user.
+func (b *Bet) Member(userId int) (Participant, bool) {
+    for _, m := range b.Members {
+        if m.UserId == userId {
+            return m, true
+        }
+    }
+    return Participant{}, false
+}
+
+/* Payouts */
+
+// SplitPool divides the pool of a bet, the sum of every player's stake, among
+// the players on the winning side in proportion to their stakes, and returns
+// each player's payout in cents.
+//
+// Payouts are whole cents. Each winner first gets pool * stake / winning
+// stakes, rounded down. The cents lost to rounding, fewer than the number of
+// winners, then go one each to the winners with the largest remainders,
+// earlier entrants first on ties, so the payouts always add up to the pool.
+// If nobody picked the winning side every player gets their stake back.
+func SplitPool(members []Participant, winningSide string) map[int]int {
+    payouts := make(map[int]int)
+
+    var pool, winning int64
+    winners := make([]int, 0)
+    for i, m := range members {
+        if m.Role != "player" {
+            continue
+        }
+        pool += int64(m.Stake)
+        payouts[m.UserId] = 0
+        if m.Side == winningSide && m.Stake > 0 {
+            winning += int64(m.Stake)
+            winners = append(winners, i)
+        }
+    }
+
+    if len(winners) == 0 {
+        for _, m := range members {
+            if m.Role == "player" {
+                payouts[m.UserId] = m.Stake
+            }
+        }
+        return payouts
+    }
+
+    remainders := make(map[int]int64)
+    paid := int64(0)
+    for _, i := range winners {
+        share := pool * int64(members[i].Stake)
+        payouts[members[i].UserId] = int(share / winning)
+        remainders[i] = share % winning
+        paid += share / winning
+    }
+
+    // stable, so ties keep the order players joined in
+    sort.SliceStable(winners, func(a, b int) bool {
+        return remainders[winners[a]] > remainders[winners[b]]
+    })
+    for k := 0; paid < pool; k++ {
+        payouts[members[winners[k]].UserId]++
+        paid++
+    }
+
+    return payouts
+}
+
+// Transfers turns payouts into the payments that settle a bet: players who
+// get back less than they staked pay those who get back more. Debts are
+// matched in the order players joined, so the same payouts always give the
+// same payments.
+func Transfers(betId int, members []Participant, payouts map[int]int) []Payment {
+    type balance struct {
+        userId int
+        cents int
+    }
+
+    debtors := make([]*balance, 0)
+    creditors := make([]*balance, 0)
+    for _, m := range members {
+        if m.Role != "player" {
+            continue
+        }
+        net := payouts[m.UserId] - m.Stake
+        if net < 0 {
+            debtors = append(debtors, &balance{ m.UserId, -net })
+        } else if net > 0 {
+            creditors = append(creditors, &balance{ m.UserId, net })
+        }
+    }
+
+    payments := make([]Payment, 0)
+    for d, c := 0, 0; d < len(debtors) && c < len(creditors); {
+        amount := debtors[d].cents
+        if creditors[c].cents < amount {
+            amount = creditors[c].cents
+        }
+
+        payments = append(payments, Payment{
+            BetId: betId,
+            FromUserId: debtors[d].userId,
+            ToUserId: creditors[c].userId,
+            Amount: amount,
+        })
+
+        debtors[d].cents -= amount
+        creditors[c].cents -= amount
+        if debtors[d].cents == 0 {
+            d++
+        }
+        if creditors[c].cents == 0 {
+            c++
+        }
+    }
+
+    return payments
+}
+
+/* Store */
+
+// loadParticipants fills in the participants and, for group bets, the sides of a bet.
+func loadParticipants(ctx context.Context, q Queryer, b *Bet) error {
+    rows, err := q.QueryContext(ctx, "select user_id, role, coalesce(side, ''), stake, payout, joined_on " +
+                                     "from bet_participants where bet_id = ? order by id", b.Id)
+    if err != nil {
+        return errors.New("Failed query for bet participants: " + err.Error())
+    }
+
+    b.Members = make([]Participant, 0)
+    for rows.Next() {
+        var m Participant
+        var payout *int
+        if err := rows.Scan(&m.UserId, &m.Role, &m.Side, &m.Stake, &payout, &m.JoinedOn); err != nil {
+            rows.Close()
+            return errors.New("Failed to scan bet participant row: " + err.Error())
+        }
+        m.Payout = payout
+        b.Members = append(b.Members, m)
+    }
+    rows.Close()
+
+    rows, err = q.QueryContext(ctx, "select name, is_winner from bet_outcomes where bet_id = ? order by position", b.Id)
+    if err != nil {
+        return errors.New("Failed query for bet outcomes: " + err.Error())
+    }
+    defer rows.Close()
+
+    b.Kind = "pair"
+    for rows.Next() {
+        var name string
+        var winner bool
+        if err := rows.Scan(&name, &winner); err != nil {
+            return errors.New("Failed to scan bet outcome row: " + err.Error())
+        }
+
+        b.Kind = "group"
+        b.Sides = append(b.Sides, name)
+        if winner {
+            b.WinningSide = name
+        }
+    }
+
+    if b.Kind == "pair" && b.Status == "settled" {
+        if m, ok := b.Member(b.WinnerId); ok && m.Role == "player" {
+            b.WinningSide = m.Side
+        }
+    }
+
+    return rows.Err()
+}
+
+// addParticipant adds a player or witness to a bet.
+func (tx *Tx) addParticipant(ctx context.Context, betId int, m Participant) error {
+    _, err := tx.ExecContext(ctx, "insert into bet_participants (bet_id, user_id, role, side, stake) values (?, ?, ?, nullif(?, ''), ?)",
+                             betId, m.UserId, m.Role, m.Side, m.Stake)
+    if err != nil {
+        return errors.New("Failed to add bet participant: " + err.Error())
+    }
+    return nil
+}
+
+// A GroupBetRequest describes a bet with any number of players on named sides.
+type GroupBetRequest struct {
+    Title string          `json:"title"`
+    Description string    `json:"description,omitempty"`
+    Outcomes []string     `json:"outcomes"`             // the sides players can pick
+    WitnessIds []int      `json:"witness_ids"`          // who resolves the winning side
+    Stake int             `json:"stake"`                // default stake, in cents
+    Side string           `json:"side,omitempty"`       // the creator's pick, if they play
+    Visibility string     `json:"visibility,omitempty"` // participants, friends or public; defaults to the creator's default
+    HideAmount *bool      `json:"hide_amount,omitempty"`
+    BetLabels
+}
+
+// Validate checks a group bet can be created by a user.
+func (g *GroupBetRequest) Validate(creatorId int) error {
+    g.Title = strings.TrimSpace(g.Title)
+    if g.Title == "" {
+        return errors.New("Required parameter 'title' is not present")
+    }
+
+    if len(g.Outcomes) < 2 || len(g.Outcomes) > 20 {
+        return errors.New("A group bet needs between 2 and 20 outcomes")
+    }
+    seen := make(map[string]bool)
+    for i, o := range g.Outcomes {
+        o = strings.TrimSpace(o)
+        if o == "" || len(o) > 64 || seen[strings.ToLower(o)] {
+            return errors.New("Outcomes must be distinct names of at most 64 characters")
+        }
+        seen[strings.ToLower(o)] = true
+        g.Outcomes[i] = o
+    }
+
+    if len(g.WitnessIds) == 0 {
+        return errors.New("A group bet needs at least one witness")
+    }
+    for _, w := range g.WitnessIds {
+        if w <= 0 || (w == creatorId && g.Side != "") {
+            return errors.New("Witnesses must be users other than the players")
+        }
+    }
+
+    if g.Stake <= 0 {
+        return errors.New("Parameter 'stake' must be a positive number of cents")
+    }
+
+    if g.Side != "" {
+        // store the creator's side as the outcome is spelled, since sides are
+        // compared exactly when the bet is settled
+        picked := ""
+        for _, o := range g.Outcomes {
+            if strings.EqualFold(o, strings.TrimSpace(g.Side)) {
+                picked = o
+            }
+        }
+        if picked == "" {
+            return errors.New("Side " + g.Side + " is not one of the outcomes")
+        }
+        g.Side = picked
+    }
+
+    if g.Category != "" && !ValidCategory(g.Category) {
+        return errors.New("Unknown category " + g.Category)
+    }
+
+    var err error
+    if g.Tags, err = NormalizeTags(g.Tags); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// CreateGroupBet creates a bet with named outcomes that players join by
+// picking a side. It is open for joining until it becomes active.
+func (db *MyDB) CreateGroupBet(ctx context.Context, creatorId int, g GroupBetRequest, privacy BetPrivacy) (*Bet, error) {
+
+    var b *Bet
+    err := db.InTx(ctx, func(tx *Tx) error {
+        if g.Side != "" {
+            if err := tx.checkLimits(ctx, creatorId, 0, g.Stake); err != nil {
+                return err
+            }
+        }
+
+        res, err := tx.ExecContext(ctx, "insert into bets (bettor_id, betted_id, witness_id, winner_id, title, description, status, amount) " +
+                                        "values (?, 0, ?, 0, ?, ?, 'pending', ?)",
+                                   creatorId, g.WitnessIds[0], g.Title, g.Description, g.Stake)
+        if err != nil {
+            return errors.New("Error when executing the CreateGroupBet query")
+        }
+
+        id64, err := res.LastInsertId()
+        if err != nil {
+            return errors.New("Error when reading the id of the created bet")
+        }
+        id := int(id64)
+
+        for i, o := range g.Outcomes {
+            if _, err := tx.ExecContext(ctx, "insert into bet_outcomes (bet_id, name, position) values (?, ?, ?)", id, o, i); err != nil {
+                return errors.New("Failed to add bet outcome: " + err.Error())
+            }
+        }
+
+        for _, w := range g.WitnessIds {
+            if err := tx.addParticipant(ctx, id, Participant{ UserId: w, Role: "witness" }); err != nil {
+                return err
+            }
+        }
+
+        if g.Side != "" {
+            if err := tx.addParticipant(ctx, id, Participant{ UserId: creatorId, Role: "player", Side: g.Side, Stake: g.Stake }); err != nil {
+                return err
+            }
+        }
+
+        if err := tx.saveVisibility(ctx, id, privacy); err != nil {
+            return err
+        }
+
+        if err := tx.saveLabels(ctx, id, g.BetLabels); err != nil {
+            return err
+        }
+
+        err = tx.RecordBetChange(ctx, BetChange{ BetId: id, ActorId: creatorId, Action: "created", NewStatus: "pending" })
+        if err != nil {
+            return err
+        }
+
+        if b, err = getBet(ctx, tx, id); err != nil {
+            return err
+        }
+        return tx.Event(ctx, "bet.created", id, b.Participants(), b)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    betsCreated.Inc()
+    Logger(ctx).Info("group bet created", "bet_id", b.Id, "creator_id", creatorId, "outcomes", len(g.Outcomes))
+
+    return b, nil
+}
+
+// JoinBet adds a player to an open group bet, on a side with a stake in cents.
+func (db *MyDB) JoinBet(ctx context.Context, betId int, userId int, side string, stake int) (*Bet, error) {
+
+    var b *Bet
+    err := db.InTx(ctx, func(tx *Tx) error {
+        var status string
+        err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", betId).Scan(&status)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(betId))
+        }
+
+        if b, err = getBet(ctx, tx, betId); err != nil {
+            return err
+        }
+
+        if b.Kind != "group" || status != "pending" {
+            return errors.New("Only group bets that haven't started can be joined")
+        }
+        if _, ok := b.Member(userId); ok {
+            return errors.New("You are already taking part in this bet")
+        }
+
+        picked := ""
+        for _, o := range b.Outcomes() {
+            if strings.EqualFold(o, side) {
+                picked = o
+            }
+        }
+        if picked == "" {
+            return errors.New("Side " + side + " is not one of the outcomes")
+        }
+
+        if err = tx.checkLimits(ctx, userId, betId, stake); err != nil {
+            return err
+        }
+
+        if err = tx.addParticipant(ctx, betId, Participant{ UserId: userId, Role: "player", Side: picked, Stake: stake }); err != nil {
+            return err
+        }
+
+        if b, err = getBet(ctx, tx, betId); err != nil {
+            return err
+        }
+        return tx.Event(ctx, "bet.joined", betId, b.Participants(), b)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return b, nil
+}
+
+// settle settles a locked bet on a winning side: it stores every player's
+// payout, records the change, and queues the payments between players, or
+// holds them for review if the fraud rules flag the bet.
+// Only active and disputed bets can be settled, so a bet is paid out once.
+func (tx *Tx) settle(ctx context.Context, b *Bet, side string, actorId int, reason string) error {
+
+    var status string
+    err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", b.Id).Scan(&status)
+    if err != nil {
+        return errors.New("No bet found with id " + strconv.Itoa(b.Id))
+    }
+    if status != "active" && status != "disputed" {
+        return errors.New("Only active or disputed bets can be settled, and this one is " + status)
+    }
+
+    payouts := SplitPool(b.Members, side)
+
+    winnerId := 0
+    if b.Kind == "pair" {
+        for _, m := range b.Members {
+            if m.Role == "player" && m.Side == side {
+                winnerId = m.UserId
+            }
+        }
+    }
+
+    if _, err := tx.ExecContext(ctx, "update bets set status = 'settled', winner_id = ? where id = ?", winnerId, b.Id); err != nil {
+        return errors.New("Failed to update bet status")
+    }
+
+    if b.Kind == "group" {
+        if _, err := tx.ExecContext(ctx, "update bet_outcomes set is_winner = (name = ?) where bet_id = ?", side, b.Id); err != nil {
+            return errors.New("Failed to record the winning outcome: " + err.Error())
+        }
+    }
+
+    for userId, payout := range payouts {
+        _, err := tx.ExecContext(ctx, "update bet_participants set payout = ? where bet_id = ? and user_id = ?", payout, b.Id, userId)
+        if err != nil {
+            return errors.New("Failed to record payout: " + err.Error())
+        }
+    }
+
+    err = tx.RecordBetChange(ctx, BetChange{
+        BetId: b.Id,
+        ActorId: actorId,
+        Action: "status",
+        OldStatus: b.Status,
+        NewStatus: "settled",
+        WinnerId: winnerId,
+        Reason: reason,
+    })
+    if err != nil {
+        return err
+    }
+
+    settled, err := getBet(ctx, tx, b.Id)
+    if err != nil {
+        return err
+    }
+
+    // settlements carry the evidence they were decided on
+    if settled.Evidence, err = getBetEvidence(ctx, tx, b.Id); err != nil {
+        return err
+    }
+
+    if err = tx.Event(ctx, "bet.settled", b.Id, settled.Participants(), settled); err != nil {
+        return err
+    }
+
+    return tx.payOut(ctx, settled, Transfers(b.Id, b.Members, payouts))
+}
+
+// ResolveBet records a witness's verdict on the winning side of an active bet.
+// The bet settles once a majority of its witnesses agree, and becomes disputed
+// if every witness has voted without a majority.
+func (db *MyDB) ResolveBet(ctx context.Context, betId int, witnessId int, side string) (*Bet, error) {
+
+    var b *Bet
+    var status string
+    err := db.InTx(ctx, func(tx *Tx) error {
+        err := tx.QueryRowContext(ctx, "select status from bets where id = ? and is_deleted = 0 for update", betId).Scan(&status)
+        if err != nil {
+            return errors.New("No bet found with id " + strconv.Itoa(betId))
+        }
+
+        if b, err = getBet(ctx, tx, betId); err != nil {
+            return err
+        }
+
+        if m, ok := b.Member(witnessId); !ok || m.Role != "witness" {
+            return errors.New("Only the witnesses of a bet can resolve it")
+        }
+        if status != "active" {
+            return errors.New("Only active bets can be resolved")
+        }
+
+        picked := ""
+        for _, o := range b.Outcomes() {
+            if strings.EqualFold(o, side) {
+                picked = o
+            }
+        }
+        if picked == "" {
+            return errors.New("Side " + side + " is not one of the outcomes")
+        }
+
+        _, err = tx.ExecContext(ctx, "insert into bet_resolutions (bet_id, witness_id, side) values (?, ?, ?) " +
+                                     "on duplicate key update side = values(side), created_on = current_timestamp",
+                                betId, witnessId, picked)
+        if err != nil {
+            return errors.New("Failed to record resolution: " + err.Error())
+        }
+
+        rows, err := tx.QueryContext(ctx, "select side, count(*) from bet_resolutions where bet_id = ? group by side", betId)
+        if err != nil {
+            return errors.New("Failed query for resolutions: " + err.Error())
+        }
+        votes := make(map[string]int)
+        total := 0
+        for rows.Next() {
+            var s string
+            var n int
+            if err := rows.Scan(&s, &n); err != nil {
+                rows.Close()
+                return errors.New("Failed to scan resolution row: " + err.Error())
+            }
+            votes[s] = n
+            total += n
+        }
+        rows.Close()
+
+        witnesses := len(b.Witnesses())
+        for s, n := range votes {
+            if n * 2 > witnesses {
+                status = "settled"
+                return tx.settle(ctx, b, s, witnessId, "resolved by witnesses")
+            }
+        }
+
+        if total < witnesses {
+            return nil
+        }
+
+        // every witness voted and no side has a majority
+        status = "disputed"
+        if _, err = tx.ExecContext(ctx, "update bets set status = 'disputed' where id = ?", betId); err != nil {
+            return errors.New("Failed to update bet status")
+        }
+        err = tx.RecordBetChange(ctx, BetChange{
+            BetId: betId,
+            ActorId: witnessId,
+            Action: "status",
+            OldStatus: b.Status,
+            NewStatus: "disputed",
+            Reason: "witnesses disagree",
+        })
+        if err != nil {
+            return err
+        }
+
+        disputed, err := getBet(ctx, tx, betId)
+        if err != nil {
+            return err
+        }
+        if disputed.Evidence, err = getBetEvidence(ctx, tx, betId); err != nil {
+            return err
+        }
+        return tx.Event(ctx, "bet.disputed", betId, disputed.Participants(), disputed)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if status == "settled" || status == "disputed" {
+        db.countBetStatus(ctx, betId, status)
+    }
+    Logger(ctx).Info("bet resolution recorded", "bet_id", betId, "witness_id", witnessId, "status", status)
+
+    return db.GetBet(ctx, betId)
+}
+
+/* Handlers */
+
+// GroupBetsCreateHandler creates a group bet.
+// Handles POST to /bets/group.
+func (db *MyDB) GroupBetsCreateHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var g GroupBetRequest
+    if err = json.Unmarshal(body, &g); err != nil {
+        WriteError(rw, 400, "Body must be a group bet: " + err.Error())
+        return
+    }
+
+    if err = g.Validate(userId); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    privacy, err := db.BetPrivacyFor(r.Context(), userId, g.Visibility, g.HideAmount)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    b, err := db.CreateGroupBet(r.Context(), userId, g, privacy)
+    if err != nil {
+        if !WriteLimitError(rw, err) {
+            WriteError(rw, 500, "Failed to create bet: " + err.Error())
+        }
+        return
+    }
+
+    WriteData(rw, 201, b)
+}
+
+// BetJoinHandler joins the authenticated user to a group bet.
+// Handles POST to /bets/{id}/join with a "side" and an optional "stake",
+// which defaults to the bet's amount.
+func (db *MyDB) BetJoinHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    b, err := db.GetBet(r.Context(), id)
+    if err != nil || !db.BetExists(r.Context(), id) {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
+        return
+    }
+
+    // bets a user may not see can't be joined, and don't exist as far as they can tell
+    if ok, err := db.CanSee(r.Context(), b, userId); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    } else if !ok {
+        WriteError(rw, 404, "No bet found with id " + strconv.Itoa(id))
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+
+    stake := b.Amount
+    if s, ok := params["stake"]; ok {
+        if stake, err = strconv.Atoi(s); err != nil || stake <= 0 {
+            WriteError(rw, 400, "Parameter 'stake' must be a positive number of cents")
+            return
+        }
+    }
+
+    joined, err := db.JoinBet(r.Context(), id, userId, params["side"], stake)
+    if err != nil {
+        if !WriteLimitError(rw, err) {
+            WriteError(rw, 400, err.Error())
+        }
+        return
+    }
+
+    WriteData(rw, 200, joined)
+}
+
+// BetResolveHandler records the authenticated witness's verdict on a bet.
+// Handles POST to /bets/{id}/resolve with the winning "side".
+func (db *MyDB) BetResolveHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+
+    b, err := db.ResolveBet(r.Context(), id, userId, params["side"])
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, b)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestSplitPool(t *testing.T) {
+    player := func(userId int, side string, stake int) Participant {
+        return Participant{ UserId: userId, Role: "player", Side: side, Stake: stake }
+    }
+
+    cases := []struct {
+        name string
+        members []Participant
+        winningSide string
+        want map[int]int
+    }{
+        { "even",
+          []Participant{ player(1, "yes", 100), player(2, "no", 100) },
+          "yes", map[int]int{ 1: 200, 2: 0 } },
+        { "proportional, leftover cent to the largest remainder",
+          []Participant{ player(1, "yes", 100), player(2, "yes", 200), player(3, "no", 100) },
+          "yes", map[int]int{ 1: 133, 2: 267, 3: 0 } },
+        { "tied remainders, leftover cent to the earlier entrant",
+          []Participant{ player(1, "yes", 100), player(2, "yes", 100), player(3, "no", 1) },
+          "yes", map[int]int{ 1: 101, 2: 100, 3: 0 } },
+        { "several leftover cents",
+          []Participant{ player(1, "a", 1), player(2, "a", 1), player(3, "a", 1), player(4, "b", 8) },
+          "a", map[int]int{ 1: 4, 2: 4, 3: 3, 4: 0 } },
+        { "nobody on the winning side gets their stake back",
+          []Participant{ player(1, "yes", 100), player(2, "no", 50) },
+          "maybe", map[int]int{ 1: 100, 2: 50 } },
+        { "witnesses are left out",
+          []Participant{ player(1, "yes", 100), { UserId: 9, Role: "witness" }, player(2, "no", 100) },
+          "no", map[int]int{ 1: 0, 2: 200 } },
+    }
+
+    for _, c := range cases {
+        got := SplitPool(c.members, c.winningSide)
+
+        if len(got) != len(c.want) {
+            t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+            continue
+        }
+
+        pool, paid := 0, 0
+        for _, m := range c.members {
+            if m.Role == "player" {
+                pool += m.Stake
+            }
+        }
+        for userId, cents := range c.want {
+            if got[userId] != cents {
+                t.Errorf("%s: user %d got %d, want %d", c.name, userId, got[userId], cents)
+            }
+            paid += got[userId]
+        }
+        if paid != pool {
+            t.Errorf("%s: paid out %d of a pool of %d", c.name, paid, pool)
+        }
+    }
+}
+
+func TestGroupBetRequestSide(t *testing.T) {
+    cases := []struct {
+        side string
+        want string
+    }{
+        { "Yes", "Yes" },
+        { "yes", "Yes" },
+        { " NO ", "No" },
+    }
+
+    for _, c := range cases {
+        g := GroupBetRequest{ Title: "Rain tomorrow", Outcomes: []string{"Yes", "No"}, WitnessIds: []int{3}, Stake: 100, Side: c.side }
+        if err := g.Validate(1); err != nil {
+            t.Fatalf("side %q: %v", c.side, err)
+        }
+        if g.Side != c.want {
+            t.Errorf("side %q was stored as %q, want the outcome %q", c.side, g.Side, c.want)
+        }
+    }
+
+    g := GroupBetRequest{ Title: "Rain tomorrow", Outcomes: []string{"Yes", "No"}, WitnessIds: []int{3}, Stake: 100, Side: "maybe" }
+    if err := g.Validate(1); err == nil {
+        t.Errorf("a side that isn't an outcome should fail")
+    }
+}
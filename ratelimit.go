@@ -0,0 +1,312 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+// DefaultRateLimits are the limits, by route name, of endpoints that cost money,
+// send texts or invite spam. Each can be overridden with RATE_LIMIT_<ROUTE_NAME>, e.g.
+// RATE_LIMIT_VERIFY="10/15m", or turned off with "off".
+var DefaultRateLimits = map[string]RateLimit{
+    "UsersCreate":           RateLimit{ Requests: 5, Per: time.Hour },
+    "Verify":                RateLimit{ Requests: 5, Per: 15 * time.Minute },
+    "ContactsCheck":         RateLimit{ Requests: 20, Per: time.Hour },
+    "BetsCreate":            RateLimit{ Requests: 30, Per: time.Hour },
+    "BetCommentsCreate":     RateLimit{ Requests: 60, Per: time.Hour },
+    "AdminUserVerification": RateLimit{ Requests: 20, Per: time.Hour },
+}
+
+// A RateLimit allows a burst of Requests, refilled evenly over Per.
+type RateLimit struct {
+    Requests int
+    Per time.Duration
+}
+
+// ParseRateLimit parses a limit written as "<requests>/<duration>", e.g. "5/1m".
+func ParseRateLimit(s string) (RateLimit, error) {
+    parts := strings.SplitN(s, "/", 2)
+    if len(parts) != 2 {
+        return RateLimit{}, errors.New("Rate limit must look like <requests>/<duration>: " + s)
+    }
+
+    requests, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if err != nil || requests <= 0 {
+        return RateLimit{}, errors.New("Rate limit requests must be a positive integer: " + s)
+    }
+
+    per, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+    if err != nil || per <= 0 {
+        return RateLimit{}, errors.New("Rate limit duration is invalid: " + s)
+    }
+
+    return RateLimit{ Requests: requests, Per: per }, nil
+}
+
+// rate is the number of tokens added to a bucket per second.
+func (l RateLimit) rate() float64 {
+    return float64(l.Requests) / l.Per.Seconds()
+}
+
+// refill computes the tokens in a bucket after elapsed time, then takes one if
+// it can. It returns the tokens left and how long until the next token.
+func (l RateLimit) refill(tokens float64, elapsed time.Duration) (float64, bool, time.Duration) {
+    tokens = math.Min(float64(l.Requests), tokens + elapsed.Seconds() * l.rate())
+
+    if tokens >= 1 {
+        return tokens - 1, true, 0
+    }
+
+    wait := time.Duration((1 - tokens) / l.rate() * float64(time.Second))
+    return tokens, false, wait
+}
+
+/* Stores */
+
+// A BucketStore keeps token buckets for rate limiting.
+type BucketStore interface {
+    // Take removes a token from the bucket for key. If the bucket is empty it
+    // reports how long until a token is available.
+    Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+type bucket struct {
+    tokens float64
+    updated time.Time
+}
+
+// A MemoryBucketStore keeps buckets in the memory of a single instance.
+type MemoryBucketStore struct {
+    mu sync.Mutex
+    buckets map[string]*bucket
+    takes int
+}
+
+// NewMemoryBucketStore creates an empty in-memory bucket store.
+func NewMemoryBucketStore() *MemoryBucketStore {
+    return &MemoryBucketStore{ buckets: make(map[string]*bucket) }
+}
+
+// Take removes a token from the bucket for key.
+func (s *MemoryBucketStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+
+    b, ok := s.buckets[key]
+    if !ok {
+        b = &bucket{ tokens: float64(limit.Requests), updated: now }
+        s.buckets[key] = b
+    }
+
+    tokens, allowed, wait := limit.refill(b.tokens, now.Sub(b.updated))
+    b.tokens = tokens
+    b.updated = now
+
+    // every so often drop buckets that have been idle long enough to refill
+    s.takes++
+    if s.takes % 1000 == 0 {
+        for k, b := range s.buckets {
+            if now.Sub(b.updated) > 24 * time.Hour {
+                delete(s.buckets, k)
+            }
+        }
+    }
+
+    return allowed, wait, nil
+}
+
+// A SQLBucketStore keeps buckets in the rate_limit_buckets table, so every
+// instance of the API shares them.
+type SQLBucketStore struct {
+    db *sql.DB
+}
+
+// NewSQLBucketStore creates a bucket store backed by the given database.
+func NewSQLBucketStore(db *sql.DB) *SQLBucketStore {
+    return &SQLBucketStore{ db: db }
+}
+
+// Take removes a token from the bucket for key.
+func (s *SQLBucketStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return false, 0, errors.New("Failed to begin rate limit transaction: " + err.Error())
+    }
+    defer tx.Rollback()
+
+    now := time.Now().UTC()
+
+    _, err = tx.ExecContext(ctx, "insert ignore into rate_limit_buckets (bucket_key, tokens, updated_at) values (?, ?, ?)",
+                            key, limit.Requests, now)
+    if err != nil {
+        return false, 0, errors.New("Failed to create rate limit bucket: " + err.Error())
+    }
+
+    var tokens float64
+    var updated time.Time
+    err = tx.QueryRowContext(ctx, "select tokens, updated_at from rate_limit_buckets where bucket_key = ? for update", key).
+             Scan(&tokens, &updated)
+    if err != nil {
+        return false, 0, errors.New("Failed to read rate limit bucket: " + err.Error())
+    }
+
+    elapsed := now.Sub(updated)
+    if elapsed < 0 {
+        elapsed = 0
+    }
+    tokens, allowed, wait := limit.refill(tokens, elapsed)
+
+    _, err = tx.ExecContext(ctx, "update rate_limit_buckets set tokens = ?, updated_at = ? where bucket_key = ?",
+                            tokens, now, key)
+    if err != nil {
+        return false, 0, errors.New("Failed to update rate limit bucket: " + err.Error())
+    }
+
+    if err = tx.Commit(); err != nil {
+        return false, 0, errors.New("Failed to commit rate limit bucket: " + err.Error())
+    }
+
+    return allowed, wait, nil
+}
+
+/* Limiter */
+
+// A RateLimiter throttles routes per account and per client IP.
+type RateLimiter struct {
+    db *MyDB
+    store BucketStore
+    limits map[string]RateLimit
+}
+
+// NewRateLimiter creates a limiter for the given route limits, applying any
+// overrides from the environment.
+func NewRateLimiter(db *MyDB, store BucketStore, limits map[string]RateLimit) *RateLimiter {
+    rl := &RateLimiter{ db: db, store: store, limits: make(map[string]RateLimit) }
+
+    for name, limit := range limits {
+        rl.limits[name] = limit
+    }
+
+    for name := range rl.limits {
+        v := EnvString("RATE_LIMIT_" + envName(name), "")
+        if v == "" {
+            continue
+        }
+        if v == "off" {
+            delete(rl.limits, name)
+            continue
+        }
+
+        limit, err := ParseRateLimit(v)
+        if err != nil {
+            Logger(context.Background()).Warn("ignoring rate limit override", "route", name, "error", err)
+            continue
+        }
+        rl.limits[name] = limit
+    }
+
+    return rl
+}
+
+// Apply wraps the handlers of every limited route in a route table.
+func (rl *RateLimiter) Apply(routes []Route) []Route {
+    limited := make([]Route, len(routes))
+
+    for i, route := range routes {
+        // every version of a route shares its buckets
+        name := BaseName(route.Name)
+        if limit, ok := rl.limits[name]; ok {
+            route.HandlerFunc = rl.handler(name, limit, route.HandlerFunc)
+        }
+        limited[i] = route
+    }
+
+    return limited
+}
+
+func (rl *RateLimiter) handler(name string, limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+
+        // the account's bucket goes first, so a refused account doesn't use up
+        // the tokens of everyone else behind the same IP
+        keys := make([]string, 0, 2)
+        if accessToken := requestAccessToken(r); accessToken != "" {
+            if id, err := rl.db.GetIdByAccessToken(r.Context(), accessToken); err == nil {
+                keys = append(keys, fmt.Sprintf("%s:user:%d", name, id))
+            }
+        }
+        keys = append(keys, fmt.Sprintf("%s:ip:%s", name, ClientIP(r)))
+
+        for _, key := range keys {
+            allowed, wait, err := rl.store.Take(r.Context(), key, limit)
+            if err != nil {
+                // fail open rather than take the API down with the store
+                Logger(r.Context()).Error("rate limit store failed", "error", err)
+                break
+            }
+
+            if !allowed {
+                retry := int(math.Ceil(wait.Seconds()))
+                rateLimited.Inc(name)
+
+                rw.Header().Set("Retry-After", strconv.Itoa(retry))
+                WriteError(rw, 429, fmt.Sprintf("Too many requests, retry in %d seconds", retry))
+                return
+            }
+        }
+
+        next(rw, r)
+    }
+}
+
+// requestAccessToken returns the access token a request acts for. Besides the
+// header and query of AccessToken, routes such as /verify, /users and /bets
+// take it in their JSON body, which is read and put back for the handler.
+func requestAccessToken(r *http.Request) string {
+    if accessToken := AccessToken(r); accessToken != "" {
+        return accessToken
+    }
+    if r.Body == nil || (r.Method != "POST" && r.Method != "PUT") {
+        return ""
+    }
+
+    body, _ := io.ReadAll(io.LimitReader(r.Body, 64 << 10))
+    r.Body = struct {
+        io.Reader
+        io.Closer
+    }{ io.MultiReader(bytes.NewReader(body), r.Body), r.Body }
+
+    var params struct {
+        AccessToken string `json:"access_token"`
+    }
+    if json.Unmarshal(body, &params) != nil {
+        return ""
+    }
+    return params.AccessToken
+}
+
+// envName converts a route name such as "UsersCreate" to "USERS_CREATE".
+func envName(name string) string {
+    var b strings.Builder
+    for i, c := range name {
+        if i > 0 && unicode.IsUpper(c) {
+            b.WriteByte('_')
+        }
+        b.WriteRune(unicode.ToUpper(c))
+    }
+    return b.String()
+}
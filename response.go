@@ -4,12 +4,19 @@ package main
 type JSONResponse struct {
     Meta M                  `json:"meta"`
     Data interface{}        `json:"data,omitempty"`
+    Pagination *Pagination  `json:"pagination,omitempty"`
+}
+
+// A Pagination tells clients how to get the next page of a list.
+type Pagination struct {
+    NextCursor string   `json:"next_cursor,omitempty"`   // pass as the cursor parameter; absent on the last page
 }
 
 // A M represents the meta field of a JSON response.
 type M struct {
     Code int            `json:"code"`
     ErrorMessage string `json:"error_message,omitempty"`  
+    ErrorCode string    `json:"error_code,omitempty"`     // which rule refused the request, for clients to act on
 }
 
 // GenerateError creates an error JSONResponse.
@@ -0,0 +1,272 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// CurrentVersion is the newest API version, used for links the API hands out.
+const CurrentVersion = "v1"
+
+// LegacyVersion is the API version still served at the root paths.
+const LegacyVersion = "v1"
+
+// LegacySunset is when the root paths stop being served, overridable with API_LEGACY_SUNSET.
+var LegacySunset = time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+
+// A Route describes a single endpoint of the API.
+type Route struct {
+    Name string
+    Methods []string
+    Pattern string
+    HandlerFunc http.HandlerFunc
+}
+
+// An APIVersion is a set of routes served under /<Name>.
+type APIVersion struct {
+    Name string
+    Routes []Route
+}
+
+// Versions returns every version of the API served side by side.
+// A new version only needs its own route table, e.g.
+//
+//     {"v2", db.V2Routes()},
+//
+// Its handlers are methods on the same MyDB, so every version shares the store.
+func (db *MyDB) Versions() []APIVersion {
+    return []APIVersion{
+        {"v1", db.V1Routes()},
+    }
+}
+
+// Routes returns the full route table: every API version under its prefix,
+// the legacy version again at the root paths, the admin API under /admin,
+// and the unversioned system routes.
+func (db *MyDB) Routes() []Route {
+    routes := make([]Route, 0)
+
+    for _, v := range db.Versions() {
+        routes = append(routes, Mount(v.Name, v.Routes)...)
+
+        if v.Name == LegacyVersion {
+            routes = append(routes, Legacy(v.Name, v.Routes)...)
+        }
+    }
+
+    routes = append(routes, Mount("admin", db.AdminRoutes())...)
+
+    return append(routes, db.SystemRoutes()...)
+}
+
+// Mount prefixes the paths of a version's routes with /<version>, and their names with "<version>.".
+func Mount(version string, routes []Route) []Route {
+    mounted := make([]Route, len(routes))
+
+    for i, route := range routes {
+        route.Name = version + "." + route.Name
+        route.Pattern = "/" + version + route.Pattern
+        mounted[i] = route
+    }
+
+    return mounted
+}
+
+// Legacy serves a version's routes at the root paths, flagging each response as
+// deprecated in favor of the versioned path.
+func Legacy(version string, routes []Route) []Route {
+    legacy := make([]Route, len(routes))
+
+    for i, route := range routes {
+        route.Name = "legacy." + route.Name
+        route.HandlerFunc = Deprecated(version, route.HandlerFunc)
+        legacy[i] = route
+    }
+
+    return legacy
+}
+
+// Deprecated adds Deprecation, Sunset and successor Link headers to a handler's responses.
+func Deprecated(version string, next http.HandlerFunc) http.HandlerFunc {
+    sunset := LegacySunset
+    if t, err := time.Parse(time.RFC3339, EnvString("API_LEGACY_SUNSET", "")); err == nil {
+        sunset = t
+    }
+
+    return func(rw http.ResponseWriter, r *http.Request) {
+        successor := "/" + version + r.URL.Path
+
+        rw.Header().Set("Deprecation", "true")
+        rw.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+        rw.Header().Add("Link", "<" + successor + ">; rel=\"successor-version\"")
+
+        next(rw, r)
+    }
+}
+
+// BaseName strips the version from a route name, e.g. "v1.UserShow" becomes "UserShow".
+func BaseName(name string) string {
+    return name[strings.LastIndex(name, ".") + 1:]
+}
+
+// RouteVersion returns the version of a route name, "legacy" for the root
+// aliases, or "" for unversioned routes.
+func RouteVersion(name string) string {
+    if i := strings.LastIndex(name, "."); i >= 0 {
+        return name[:i]
+    }
+    return ""
+}
+
+// V1Routes returns the route table of version 1 of the API.
+func (db *MyDB) V1Routes() []Route {
+    return []Route{
+
+        /* contacts */
+        {"ContactsCheck", []string{"PUT", "POST"}, "/contacts", db.ContactsHandler},
+
+        /* verify */
+        {"Verify", []string{"PUT", "POST"}, "/verify", db.VerificationHandler},
+
+        /* users */
+        {"UserShow", []string{"GET"}, "/users/{id:[0-9]+}", db.UserShowHandler},
+        {"UserUpdate", []string{"PUT", "POST"}, "/users/{id:[0-9]+}", db.UserUpdateHandler},
+        {"UserDelete", []string{"DELETE"}, "/users/{id:[0-9]+}", db.UserDeleteHandler},
+        {"UserBets", []string{"GET"}, "/users/{id:[0-9]+}/bets", db.UserBetsHandler},
+        {"UserWitnessing", []string{"GET"}, "/users/{id:[0-9]+}/witnessing", db.UserWitnessingHandler},
+        {"UserStats", []string{"GET"}, "/users/{id:[0-9]+}/stats", db.UserStatsHandler},
+        {"UserVersus", []string{"GET"}, "/users/{id:[0-9]+}/versus/{other:[0-9]+}", db.UserVersusHandler},
+        {"UserPrivacy", []string{"GET"}, "/users/{id:[0-9]+}/privacy", db.UserPrivacyHandler},
+        {"UserPrivacyUpdate", []string{"PUT", "POST"}, "/users/{id:[0-9]+}/privacy", db.UserPrivacyUpdateHandler},
+        {"UserLimits", []string{"GET"}, "/users/{id:[0-9]+}/limits", db.UserLimitsHandler},
+        {"UserLimitsUpdate", []string{"PUT", "POST"}, "/users/{id:[0-9]+}/limits", db.UserLimitsUpdateHandler},
+        {"UserExclusion", []string{"POST"}, "/users/{id:[0-9]+}/exclusion", db.UserExclusionHandler},
+
+        {"UsersShow", []string{"GET"}, "/users", db.UsersShowHandler},
+        {"UsersCreate", []string{"PUT", "POST"}, "/users", db.UsersCreateHandler},
+
+        /* bets */
+        {"BetsHook", []string{"PUT", "POST"}, "/bets/hook", db.BetsHookHandler},
+        {"GroupBetsCreate", []string{"POST"}, "/bets/group", db.GroupBetsCreateHandler},
+        {"BetShow", []string{"GET"}, "/bets/{id:[0-9]+}", db.BetShowHandler},
+        {"BetDelete", []string{"DELETE"}, "/bets/{id:[0-9]+}", db.BetDeleteHandler},
+        {"BetStatus", []string{"PUT", "POST"}, "/bets/{id:[0-9]+}/status", db.BetStatusHandler},
+        {"BetHistory", []string{"GET"}, "/bets/{id:[0-9]+}/history", db.BetHistoryHandler},
+        {"BetPrivacy", []string{"PUT", "POST"}, "/bets/{id:[0-9]+}/privacy", db.BetPrivacyHandler},
+        {"BetJoin", []string{"POST"}, "/bets/{id:[0-9]+}/join", db.BetJoinHandler},
+        {"BetResolve", []string{"POST"}, "/bets/{id:[0-9]+}/resolve", db.BetResolveHandler},
+
+        {"BetOfferAccept", []string{"POST"}, "/bets/{id:[0-9]+}/offers/{version:[0-9]+}/accept", db.BetOfferAcceptHandler},
+        {"BetOffersShow", []string{"GET"}, "/bets/{id:[0-9]+}/offers", db.BetOffersShowHandler},
+        {"BetOffersCreate", []string{"POST"}, "/bets/{id:[0-9]+}/offers", db.BetOffersCreateHandler},
+
+        {"BetCommentUpdate", []string{"PUT", "POST"}, "/bets/{id:[0-9]+}/comments/{comment_id:[0-9]+}", db.BetCommentUpdateHandler},
+        {"BetCommentDelete", []string{"DELETE"}, "/bets/{id:[0-9]+}/comments/{comment_id:[0-9]+}", db.BetCommentDeleteHandler},
+        {"BetCommentsShow", []string{"GET"}, "/bets/{id:[0-9]+}/comments", db.BetCommentsShowHandler},
+        {"BetCommentsCreate", []string{"POST"}, "/bets/{id:[0-9]+}/comments", db.BetCommentsCreateHandler},
+
+        {"BetEvidenceShow", []string{"GET"}, "/bets/{id:[0-9]+}/evidence/{evidence_id:[0-9]+}", db.BetEvidenceShowHandler},
+        {"BetEvidenceCreate", []string{"POST"}, "/bets/{id:[0-9]+}/evidence", db.BetEvidenceCreateHandler},
+
+        {"BetsShow", []string{"GET"}, "/bets", db.BetsShowHandler},
+        {"BetsCreate", []string{"PUT", "POST"}, "/bets", db.BetsCreateHandler},
+
+        /* leaderboards */
+        {"Leaderboard", []string{"GET"}, "/leaderboard", db.LeaderboardHandler},
+
+        /* categories and templates */
+        {"CategoryStats", []string{"GET"}, "/categories/stats", db.CategoryStatsHandler},
+        {"Categories", []string{"GET"}, "/categories", db.CategoriesHandler},
+        {"TemplateDelete", []string{"DELETE"}, "/templates/{id:[0-9]+}", db.TemplateDeleteHandler},
+        {"TemplatesShow", []string{"GET"}, "/templates", db.TemplatesShowHandler},
+        {"TemplatesCreate", []string{"POST"}, "/templates", db.TemplatesCreateHandler},
+
+        /* series */
+        {"SeriesStatus", []string{"POST"}, "/series/{id:[0-9]+}/status", db.SeriesStatusHandler},
+        {"SeriesItem", []string{"GET"}, "/series/{id:[0-9]+}", db.SeriesItemHandler},
+        {"SeriesUpdate", []string{"PUT"}, "/series/{id:[0-9]+}", db.SeriesUpdateHandler},
+        {"SeriesDelete", []string{"DELETE"}, "/series/{id:[0-9]+}", db.SeriesDeleteHandler},
+        {"SeriesShow", []string{"GET"}, "/series", db.SeriesShowHandler},
+        {"SeriesCreate", []string{"POST"}, "/series", db.SeriesCreateHandler},
+
+        /* search */
+        {"Search", []string{"GET"}, "/search", db.SearchHandler},
+
+        /* feed */
+        {"Feed", []string{"GET"}, "/feed", db.FeedHandler},
+
+        /* events */
+        {"Events", []string{"GET"}, "/events", db.EventsHandler},
+
+        /* webhooks */
+        {"WebhookShow", []string{"GET"}, "/webhooks/{id:[0-9]+}", db.WebhookShowHandler},
+        {"WebhookDelete", []string{"DELETE"}, "/webhooks/{id:[0-9]+}", db.WebhookDeleteHandler},
+        {"WebhookDeliveries", []string{"GET"}, "/webhooks/{id:[0-9]+}/deliveries", db.WebhookDeliveriesHandler},
+        {"WebhookRetry", []string{"POST"}, "/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}/retry", db.WebhookRetryHandler},
+        {"WebhookDeadLetters", []string{"GET"}, "/webhooks/{id:[0-9]+}/dead-letters", db.WebhookDeadLettersHandler},
+        {"WebhookPing", []string{"POST"}, "/webhooks/{id:[0-9]+}/ping", db.WebhookPingHandler},
+
+        {"WebhooksShow", []string{"GET"}, "/webhooks", db.WebhooksShowHandler},
+        {"WebhooksCreate", []string{"PUT", "POST"}, "/webhooks", db.WebhooksCreateHandler},
+    }
+}
+
+// AdminRoutes returns the routes staff use to look after users and bets,
+// each guarded by the least role allowed to use it.
+func (db *MyDB) AdminRoutes() []Route {
+    support := func(h http.HandlerFunc) http.HandlerFunc { return db.RequireRole("support", h) }
+    admin := func(h http.HandlerFunc) http.HandlerFunc { return db.RequireRole("admin", h) }
+
+    return []Route{
+
+        /* users */
+        {"AdminUserRole", []string{"PUT"}, "/users/{id:[0-9]+}/role", admin(db.AdminUserRoleHandler)},
+        {"AdminUserBan", []string{"POST"}, "/users/{id:[0-9]+}/ban", admin(db.AdminUserBanHandler)},
+        {"AdminUserUnban", []string{"DELETE"}, "/users/{id:[0-9]+}/ban", admin(db.AdminUserUnbanHandler)},
+        {"AdminUserVerification", []string{"POST"}, "/users/{id:[0-9]+}/verification", support(db.AdminUserVerificationHandler)},
+        {"AdminUser", []string{"GET"}, "/users/{id:[0-9]+}", support(db.AdminUserHandler)},
+
+        /* bets */
+        {"AdminBetStatus", []string{"POST"}, "/bets/{id:[0-9]+}/status", admin(db.AdminBetStatusHandler)},
+        {"AdminBetResolve", []string{"POST"}, "/bets/{id:[0-9]+}/resolve", admin(db.AdminBetResolveHandler)},
+        {"AdminBet", []string{"GET"}, "/bets/{id:[0-9]+}", support(db.AdminBetHandler)},
+
+        /* payout reviews */
+        {"AdminReview", []string{"POST"}, "/reviews/{id:[0-9]+}", admin(db.AdminReviewHandler)},
+        {"AdminReviews", []string{"GET"}, "/reviews", support(db.AdminReviewsHandler)},
+
+        /* audit log */
+        {"AdminActions", []string{"GET"}, "/actions", admin(db.AdminActionsHandler)},
+    }
+}
+
+// SystemRoutes returns the routes that aren't part of any API version.
+func (db *MyDB) SystemRoutes() []Route {
+    return []Route{
+
+        /* metrics */
+        {"Metrics", []string{"GET"}, "/metrics", MetricsHandler},
+
+        /* docs */
+        {"OpenAPI", []string{"GET"}, "/openapi.json", db.OpenAPIHandler},
+        {"Docs", []string{"GET"}, "/docs", DocsHandler},
+    }
+}
+
+// NewRouter builds a router from a route table.
+// Every route is instrumented under its path template.
+func NewRouter(routes []Route) *mux.Router {
+    r := mux.NewRouter()
+
+    for _, route := range routes {
+        r.Methods(route.Methods...).
+          Path(route.Pattern).
+          Name(route.Name).
+          Handler(InstrumentHandler(route.Pattern, route.HandlerFunc))
+    }
+
+    return r
+}
@@ -0,0 +1,431 @@
+-- Tables added on top of the original users and bets tables.
+-- Every statement is safe to run against an existing database.
+
+-- Token buckets shared by every instance when RATE_LIMIT_STORE=sql.
+create table if not exists rate_limit_buckets (
+    bucket_key varchar(191) not null primary key,
+    tokens double not null,
+    updated_at datetime(6) not null
+);
+
+-- Bet lifecycle events, streamed to participants from /events.
+create table if not exists events (
+    id bigint not null auto_increment primary key,
+    type varchar(64) not null,
+    bet_id int null,
+    data json not null,
+    created_on timestamp not null default current_timestamp,
+    key events_bet_id (bet_id)
+);
+
+create table if not exists event_recipients (
+    event_id bigint not null,
+    user_id int not null,
+    primary key (event_id, user_id),
+    key event_recipients_user_id (user_id, event_id)
+);
+
+-- Outbound webhook subscriptions. events is a comma separated list of event types, or *.
+create table if not exists webhooks (
+    id int not null auto_increment primary key,
+    user_id int not null,
+    url varchar(2048) not null,
+    events varchar(512) not null,
+    secret char(64) not null,
+    is_deleted tinyint(1) not null default 0,
+    created_on timestamp not null default current_timestamp,
+    key webhooks_user_id (user_id)
+);
+
+-- Every delivery of an event to a webhook: the delivery log, retry queue and dead-letter list.
+create table if not exists webhook_deliveries (
+    id bigint not null auto_increment primary key,
+    webhook_id int not null,
+    event_id bigint null,
+    event_type varchar(64) not null,
+    payload json not null,
+    status enum('pending', 'delivered', 'failed', 'dead') not null default 'pending',
+    attempts int not null default 0,
+    last_status_code int null,
+    last_error varchar(1024) null,
+    next_attempt_on datetime(6) not null,
+    delivered_on datetime null,
+    created_on timestamp not null default current_timestamp,
+    key webhook_deliveries_due (status, next_attempt_on),
+    key webhook_deliveries_webhook_id (webhook_id, id)
+);
+
+-- Side effects of committed state changes, such as texts and payments,
+-- written in the same transaction and carried out at least once by the dispatcher.
+create table if not exists outbox (
+    id bigint not null auto_increment primary key,
+    kind varchar(64) not null,
+    payload json not null,
+    status enum('pending', 'done', 'dead') not null default 'pending',
+    attempts int not null default 0,
+    last_error varchar(1024) null,
+    next_attempt_on datetime(6) not null,
+    done_on datetime null,
+    created_on timestamp not null default current_timestamp,
+    key outbox_due (status, next_attempt_on)
+);
+
+-- Append-only audit trail of every change made to a bet.
+create table if not exists bet_events (
+    id bigint not null auto_increment primary key,
+    bet_id int not null,
+    actor_id int null,
+    action enum('created', 'status', 'deleted') not null,
+    old_status varchar(32) null,
+    new_status varchar(32) not null,
+    winner_id int null,
+    reason varchar(255) null,
+    created_on datetime(6) not null default current_timestamp(6),
+    key bet_events_bet_id (bet_id, id)
+);
+
+create trigger if not exists bet_events_no_update before update on bet_events
+    for each row signal sqlstate '45000' set message_text = 'bet_events is append-only';
+
+create trigger if not exists bet_events_no_delete before delete on bet_events
+    for each row signal sqlstate '45000' set message_text = 'bet_events is append-only';
+
+-- Threaded comments on bets, visible to the bet's participants.
+create table if not exists bet_comments (
+    id int not null auto_increment primary key,
+    bet_id int not null,
+    user_id int not null,
+    parent_id int null,
+    body text not null,
+    is_deleted tinyint(1) not null default 0,
+    created_on datetime not null default current_timestamp,
+    edited_on datetime null,
+    key bet_comments_bet_id (bet_id, id)
+);
+
+-- Evidence attached to bets: uploaded files, kept in the blob store, or links.
+create table if not exists bet_evidence (
+    id int not null auto_increment primary key,
+    bet_id int not null,
+    user_id int not null,
+    kind enum('file', 'link') not null,
+    url varchar(2048) null,
+    blob_key varchar(255) null,
+    content_type varchar(64) null,
+    size bigint not null default 0,
+    caption varchar(255) null,
+    created_on datetime not null default current_timestamp,
+    key bet_evidence_bet_id (bet_id, id)
+);
+
+-- Everyone taking part in a bet: players on a side with a stake, and witnesses.
+-- Two-person bets have the bettor and betted sides.
+create table if not exists bet_participants (
+    id int not null auto_increment primary key,
+    bet_id int not null,
+    user_id int not null,
+    role enum('player', 'witness') not null,
+    side varchar(64) null,
+    stake int not null default 0,
+    payout int null,
+    joined_on datetime not null default current_timestamp,
+    unique key bet_participants_bet_user (bet_id, user_id),
+    key bet_participants_user_id (user_id)
+);
+
+insert ignore into bet_participants (bet_id, user_id, role, side, stake, joined_on)
+    select id, bettor_id, 'player', 'bettor', amount, created_on from bets where bettor_id > 0;
+insert ignore into bet_participants (bet_id, user_id, role, side, stake, joined_on)
+    select id, betted_id, 'player', 'betted', amount, created_on from bets where betted_id > 0;
+insert ignore into bet_participants (bet_id, user_id, role, joined_on)
+    select id, witness_id, 'witness', created_on from bets where witness_id > 0;
+
+-- The named outcomes of group bets.
+create table if not exists bet_outcomes (
+    bet_id int not null,
+    name varchar(64) not null,
+    position int not null,
+    is_winner tinyint(1) not null default 0,
+    primary key (bet_id, position)
+);
+
+-- Each witness's verdict on the winning side.
+create table if not exists bet_resolutions (
+    bet_id int not null,
+    witness_id int not null,
+    side varchar(64) not null,
+    created_on timestamp not null default current_timestamp,
+    primary key (bet_id, witness_id)
+);
+
+-- The odds two-person bets were made at, as given and as an exact fraction.
+create table if not exists bet_odds (
+    bet_id int not null primary key,
+    format enum('fractional', 'decimal', 'american') not null,
+    value varchar(16) not null,
+    numerator varchar(32) not null,
+    denominator varchar(32) not null
+);
+
+-- The negotiated terms of two-person bets. Version 1 is the bettor's invitation;
+-- each counter-offer adds a version until one is accepted or the bet is declined.
+create table if not exists bet_offers (
+    id int not null auto_increment primary key,
+    bet_id int not null,
+    version int not null,
+    proposer_id int not null,
+    amount int not null,
+    betted_stake int not null,
+    title varchar(255) not null,
+    description text null,
+    witness_id int not null,
+    deadline datetime null,
+    status enum('open', 'countered', 'accepted', 'declined') not null default 'open',
+    created_on timestamp not null default current_timestamp,
+    responded_on datetime null,
+    unique key bet_offers_bet_version (bet_id, version)
+);
+
+-- Each user's all-time results as a player, updated as bets settle.
+create table if not exists user_stats (
+    user_id int not null primary key,
+    wins int not null default 0,
+    losses int not null default 0,
+    pushes int not null default 0,
+    net bigint not null default 0,
+    biggest_win int not null default 0,
+    streak int not null default 0,
+    key user_stats_net (net)
+);
+
+insert ignore into user_stats (user_id, wins, losses, pushes, net, biggest_win)
+    select user_id, sum(payout > stake), sum(payout < stake), sum(payout = stake), sum(payout - stake), greatest(max(payout - stake), 0)
+    from bet_participants where role = 'player' and payout is not null group by user_id;
+
+-- The same results by day, summed over the windows of leaderboards.
+create table if not exists user_stats_daily (
+    user_id int not null,
+    day date not null,
+    wins int not null default 0,
+    losses int not null default 0,
+    pushes int not null default 0,
+    net bigint not null default 0,
+    primary key (user_id, day),
+    key user_stats_daily_day (day)
+);
+
+insert ignore into user_stats_daily (user_id, day, wins, losses, pushes, net)
+    select p.user_id, date(e.created_on), sum(p.payout > p.stake), sum(p.payout < p.stake), sum(p.payout = p.stake), sum(p.payout - p.stake)
+    from bet_participants p join bet_events e on e.bet_id = p.bet_id and e.new_status = 'settled'
+    where p.role = 'player' and p.payout is not null group by p.user_id, date(e.created_on);
+
+-- Lookups of a user's bets, and of the bets between two users, in either order.
+create index if not exists bets_bettor_betted on bets (bettor_id, betted_id, created_on);
+create index if not exists bets_betted_bettor on bets (betted_id, bettor_id, created_on);
+create index if not exists bets_witness on bets (witness_id, created_on);
+
+-- Who can see a bet besides its participants. Bets without a row are public.
+create table if not exists bet_visibility (
+    bet_id int not null primary key,
+    visibility enum('participants', 'friends', 'public') not null
+);
+
+-- Precomputed feeds: each bet event copied to everyone who may see it.
+create table if not exists feed_items (
+    id bigint not null auto_increment primary key,
+    user_id int not null,
+    event_id bigint not null,
+    bet_id int not null,
+    type varchar(64) not null,
+    created_on timestamp not null default current_timestamp,
+    unique key feed_items_user_event (user_id, event_id),
+    key feed_items_user_id (user_id, id)
+);
+
+-- Participants can hide a bet's amounts from everyone else.
+alter table bet_visibility add column if not exists hide_amount tinyint(1) not null default 0;
+
+-- The privacy each user's new bets get, unless they choose otherwise.
+create table if not exists user_privacy (
+    user_id int not null primary key,
+    visibility enum('participants', 'friends', 'public') not null,
+    hide_amount tinyint(1) not null default 0
+);
+
+-- The category of a bet, from the taxonomy in categories.go, and its free-form tags.
+create table if not exists bet_categories (
+    bet_id int not null primary key,
+    category varchar(32) not null,
+    key bet_categories_category (category, bet_id)
+);
+
+create table if not exists bet_tags (
+    bet_id int not null,
+    tag varchar(32) not null,
+    primary key (bet_id, tag),
+    key bet_tags_tag (tag, bet_id)
+);
+
+-- Templates that pre-fill new bets. Built-in templates have owner_id 0.
+-- tags is a comma separated list.
+create table if not exists bet_templates (
+    id int not null auto_increment primary key,
+    owner_id int not null default 0,
+    name varchar(64) not null,
+    title varchar(255) not null,
+    description text null,
+    amount int not null default 0,
+    duration_days int not null default 0,
+    category varchar(32) null,
+    tags varchar(352) not null default '',
+    created_on timestamp not null default current_timestamp,
+    unique key bet_templates_owner_name (owner_id, name)
+);
+
+insert ignore into bet_templates (owner_id, name, title, description, amount, duration_days, category, tags) values
+    (0, 'First to run a 5k', 'First to run a 5k', 'Whoever runs 5 kilometres first, with a tracked run as proof.', 2000, 30, 'fitness', 'running,5k'),
+    (0, 'Weekly weigh-in', 'Weekly weigh-in', 'Whoever loses the larger share of their weight by the weigh-in.', 1000, 7, 'fitness', 'weight-loss,weekly'),
+    (0, 'Most steps this week', 'Most steps this week', 'Whoever logs the most steps by the end of the week.', 500, 7, 'fitness', 'steps,weekly'),
+    (0, 'Who wins the game', 'Who wins the game', 'The team picked wins the game.', 1000, 1, 'sports', 'game-day'),
+    (0, 'Trivia night', 'Trivia night', 'Whoever scores higher at trivia night.', 500, 1, 'trivia', 'pub-quiz');
+
+-- Recurring bets. rule is an RRULE (see series.go); next_on is when the next
+-- bet is spawned, null when paused or over. tags is a comma separated list.
+create table if not exists bet_series (
+    id int not null auto_increment primary key,
+    bettor_id int not null,
+    betted_id int not null,
+    witness_id int not null,
+    title varchar(255) not null,
+    description text null,
+    amount int not null,
+    betted_stake int not null,
+    rule varchar(255) not null,
+    starts_on datetime not null,
+    next_on datetime null,
+    occurrences int not null default 0,
+    status enum('active', 'paused', 'cancelled', 'finished') not null default 'active',
+    visibility enum('participants', 'friends', 'public') not null default 'public',
+    hide_amount tinyint(1) not null default 0,
+    category varchar(32) null,
+    tags varchar(352) not null default '',
+    created_on timestamp not null default current_timestamp,
+    key bet_series_due (status, next_on),
+    key bet_series_bettor (bettor_id),
+    key bet_series_betted (betted_id)
+);
+
+create table if not exists bet_series_bets (
+    series_id int not null,
+    bet_id int not null,
+    occurrence int not null,
+    occurs_on datetime not null,
+    primary key (series_id, occurrence),
+    unique key bet_series_bets_bet (bet_id)
+);
+
+-- Limits users put on their own betting, in cents; null is no limit. Raised
+-- limits wait in the pending_ columns until pending_on.
+create table if not exists user_limits (
+    user_id int not null primary key,
+    max_stake int null,
+    max_exposure int null,
+    max_loss_day int null,
+    max_loss_week int null,
+    max_loss_month int null,
+    pending_max_stake int null,
+    pending_max_exposure int null,
+    pending_max_loss_day int null,
+    pending_max_loss_week int null,
+    pending_max_loss_month int null,
+    pending_on datetime null,
+    excluded_until datetime null
+);
+
+-- Staff reviews of settled bets are recorded in the audit trail too.
+alter table bet_events modify column action enum('created', 'status', 'deleted', 'reviewed') not null;
+
+-- The payments settling a bet. Payouts of bets the fraud rules flag are held
+-- until a review releases or voids them.
+create table if not exists bet_payouts (
+    id bigint not null auto_increment primary key,
+    bet_id int not null,
+    from_user_id int not null,
+    to_user_id int not null,
+    amount int not null,
+    status enum('queued', 'held', 'voided') not null,
+    created_on datetime not null default current_timestamp,
+    key bet_payouts_bet (bet_id),
+    key bet_payouts_from (from_user_id, created_on),
+    key bet_payouts_to (to_user_id, created_on)
+);
+
+-- Payouts are claimed before Venmo is called and marked paid after, so a
+-- retried payment entry never pays the same row twice.
+alter table bet_payouts modify column status enum('queued', 'held', 'voided', 'sending', 'paid') not null;
+alter table bet_payouts add column if not exists attempts int not null default 0;
+alter table bet_payouts add column if not exists paid_on datetime null;
+
+-- Why the fraud rules flagged a bet, and the queue of flagged bets to review.
+create table if not exists bet_flags (
+    id bigint not null auto_increment primary key,
+    bet_id int not null,
+    rule varchar(32) not null,
+    detail varchar(255) not null,
+    created_on datetime not null default current_timestamp,
+    key bet_flags_bet (bet_id)
+);
+
+create table if not exists bet_reviews (
+    bet_id int not null primary key,
+    status enum('pending', 'released', 'voided') not null default 'pending',
+    reviewer_id int null,
+    note varchar(255) null,
+    created_on datetime not null default current_timestamp,
+    reviewed_on datetime null,
+    key bet_reviews_status (status, bet_id)
+);
+
+-- Staff roles; users without a row are plain users. The first admin can be
+-- set up with ADMIN_USER_IDS.
+create table if not exists user_roles (
+    user_id int not null primary key,
+    role enum('support', 'admin') not null,
+    granted_by int null,
+    granted_on timestamp not null default current_timestamp
+);
+
+create table if not exists user_bans (
+    user_id int not null primary key,
+    reason varchar(255) not null,
+    banned_by int not null,
+    banned_on timestamp not null default current_timestamp
+);
+
+-- Every request to the admin API, allowed or refused.
+create table if not exists admin_actions (
+    id bigint not null auto_increment primary key,
+    actor_id int not null,
+    role varchar(16) not null,
+    method varchar(8) not null,
+    path varchar(255) not null,
+    body text null,
+    status int not null,
+    created_on datetime not null default current_timestamp,
+    key admin_actions_actor (actor_id, id)
+);
+
+-- Failed phone verifications of each account; enough of them lock it out of
+-- verifying until locked_until.
+create table if not exists user_verification_attempts (
+    user_id int not null primary key,
+    failures int not null default 0,
+    locked_until datetime null
+);
+
+-- Series whose bets fail to spawn are retried from retry_on, and marked failed
+-- after enough failures in a row.
+alter table bet_series modify column status enum('active', 'paused', 'cancelled', 'finished', 'failed') not null default 'active';
+alter table bet_series add column if not exists failures int not null default 0;
+alter table bet_series add column if not exists last_error varchar(255) null;
+alter table bet_series add column if not exists retry_on datetime null;
@@ -0,0 +1,488 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "math"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "unicode"
+)
+
+// A SearchDoc is a bet or a user as the search index sees it. Title matches
+// count for more than body matches.
+type SearchDoc struct {
+    Kind string     // bet or user
+    Id int
+    Title string    // a bet's title, or a user's name
+    Body string     // a bet's description
+}
+
+// A SearchHit is a document matching a query, with its relevance.
+type SearchHit struct {
+    Kind string
+    Id int
+    Score float64
+}
+
+// A SearchIndex finds bets and users by the words in them. It only knows
+// what is searchable; who may see a hit is checked against the database.
+type SearchIndex interface {
+    // Index adds a document, replacing any earlier version of it.
+    Index(ctx context.Context, doc SearchDoc) error
+
+    // Remove drops a document.
+    Remove(ctx context.Context, kind string, id int) error
+
+    // Rebuild replaces everything in the index with docs.
+    Rebuild(ctx context.Context, docs []SearchDoc) error
+
+    // Search returns up to limit hits for a query, most relevant first.
+    Search(ctx context.Context, query string, limit int) ([]SearchHit, error)
+}
+
+const (
+    searchTitleWeight = 3.0
+    searchBodyWeight = 1.0
+
+    // how much a query word counts when it only matches as a prefix, or with typos
+    searchPrefixMatch = 0.7
+    searchTypoMatch = 0.5
+)
+
+// SearchTerms splits text into lowercase words.
+func SearchTerms(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+// maxTypos is how many typos a query word of a length may have and still match:
+// none for short words, one from 4 letters and two from 8.
+func maxTypos(word string) int {
+    switch n := len([]rune(word)); {
+    case n >= 8:
+        return 2
+    case n >= 4:
+        return 1
+    default:
+        return 0
+    }
+}
+
+// editDistance returns the number of insertions, deletions, substitutions
+// and swaps of adjacent letters that turn a into b, or max + 1 if it is more than max.
+func editDistance(a string, b string, max int) int {
+    s, t := []rune(a), []rune(b)
+    if d := len(s) - len(t); d > max || -d > max {
+        return max + 1
+    }
+
+    prev2 := make([]int, len(t) + 1)
+    prev := make([]int, len(t) + 1)
+    cur := make([]int, len(t) + 1)
+    for j := range prev {
+        prev[j] = j
+    }
+
+    for i := 1; i <= len(s); i++ {
+        cur[0] = i
+        best := cur[0]
+        for j := 1; j <= len(t); j++ {
+            cost := 1
+            if s[i - 1] == t[j - 1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j] + 1, cur[j - 1] + 1, prev[j - 1] + cost)
+            if i > 1 && j > 1 && s[i - 1] == t[j - 2] && s[i - 2] == t[j - 1] {
+                cur[j] = min(cur[j], prev2[j - 2] + 1)
+            }
+            best = min(best, cur[j])
+        }
+        if best > max {
+            return max + 1
+        }
+        prev2, prev, cur = prev, cur, prev2
+    }
+
+    return min(prev[len(t)], max + 1)
+}
+
+type searchKey struct {
+    kind string
+    id int
+}
+
+// A MemoryIndex is an inverted index held in process. Query words match
+// indexed words exactly, as a prefix, or with a few typos; hits are ranked by
+// how rare the matched words are, where they matched, and how many of the
+// query's words they matched.
+type MemoryIndex struct {
+    mu sync.RWMutex
+    postings map[string]map[searchKey]float64   // word -> document -> weight of the word in it
+    docs map[searchKey][]string                 // document -> its words
+}
+
+// NewMemoryIndex returns an empty index.
+func NewMemoryIndex() *MemoryIndex {
+    return &MemoryIndex{
+        postings: make(map[string]map[searchKey]float64),
+        docs: make(map[searchKey][]string),
+    }
+}
+
+func (m *MemoryIndex) Index(ctx context.Context, doc SearchDoc) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.add(doc)
+    return nil
+}
+
+func (m *MemoryIndex) Remove(ctx context.Context, kind string, id int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.remove(searchKey{ kind, id })
+    return nil
+}
+
+func (m *MemoryIndex) Rebuild(ctx context.Context, docs []SearchDoc) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.postings = make(map[string]map[searchKey]float64)
+    m.docs = make(map[searchKey][]string)
+    for _, doc := range docs {
+        m.add(doc)
+    }
+    return nil
+}
+
+func (m *MemoryIndex) add(doc SearchDoc) {
+    key := searchKey{ doc.Kind, doc.Id }
+    m.remove(key)
+
+    weights := make(map[string]float64)
+    for _, w := range SearchTerms(doc.Title) {
+        weights[w] += searchTitleWeight
+    }
+    for _, w := range SearchTerms(doc.Body) {
+        weights[w] += searchBodyWeight
+    }
+
+    words := make([]string, 0, len(weights))
+    for w, weight := range weights {
+        if m.postings[w] == nil {
+            m.postings[w] = make(map[searchKey]float64)
+        }
+        m.postings[w][key] = weight
+        words = append(words, w)
+    }
+    m.docs[key] = words
+}
+
+func (m *MemoryIndex) remove(key searchKey) {
+    for _, w := range m.docs[key] {
+        delete(m.postings[w], key)
+        if len(m.postings[w]) == 0 {
+            delete(m.postings, w)
+        }
+    }
+    delete(m.docs, key)
+}
+
+func (m *MemoryIndex) Search(ctx context.Context, query string, limit int) ([]SearchHit, error) {
+    words := SearchTerms(query)
+    if len(words) == 0 {
+        return []SearchHit{}, nil
+    }
+
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    n := float64(len(m.docs))
+    scores := make(map[searchKey]float64)
+    matched := make(map[searchKey]int)
+
+    for _, q := range words {
+        // the best match of this query word in each document
+        best := make(map[searchKey]float64)
+
+        typos := maxTypos(q)
+        for w, docs := range m.postings {
+            quality := 0.0
+            switch {
+            case w == q:
+                quality = 1
+            case len(q) >= 2 && strings.HasPrefix(w, q):
+                quality = searchPrefixMatch
+            case typos > 0 && editDistance(q, w, typos) <= typos:
+                quality = searchTypoMatch
+            default:
+                continue
+            }
+
+            idf := math.Log(1 + n / float64(len(docs)))
+            for key, weight := range docs {
+                // more occurrences help, with diminishing returns
+                score := quality * idf * weight / (weight + 1)
+                if score > best[key] {
+                    best[key] = score
+                }
+            }
+        }
+
+        for key, score := range best {
+            scores[key] += score
+            matched[key]++
+        }
+    }
+
+    hits := make([]SearchHit, 0, len(scores))
+    for key, score := range scores {
+        coverage := float64(matched[key]) / float64(len(words))
+        hits = append(hits, SearchHit{ Kind: key.kind, Id: key.id, Score: score * coverage * coverage })
+    }
+
+    // newer documents first among equals
+    sort.Slice(hits, func(i, j int) bool {
+        if hits[i].Score != hits[j].Score {
+            return hits[i].Score > hits[j].Score
+        }
+        return hits[i].Id > hits[j].Id
+    })
+
+    if len(hits) > limit {
+        hits = hits[:limit]
+    }
+    return hits, nil
+}
+
+// A SearchResult is a bet or user found by a search.
+type SearchResult struct {
+    Kind string         `json:"kind"`     // bet or user
+    Score float64       `json:"score"`
+    Bet *Bet            `json:"bet,omitempty"`
+    User *UserSummary   `json:"user,omitempty"`
+}
+
+// A UserSummary is what anyone can see of a user.
+type UserSummary struct {
+    Id int                  `json:"id"`
+    FirstName string        `json:"first_name"`
+    LastName string         `json:"last_name"`
+    ProfilePicUrl string    `json:"profile_pic_url"`
+}
+
+/* Store */
+
+// indexBet brings a bet up to date in the search index.
+func (db *MyDB) indexBet(ctx context.Context, id int) error {
+    if db.Search == nil {
+        return nil
+    }
+
+    var doc SearchDoc
+    var deleted bool
+    err := db.QueryRowContext(ctx, "select id, title, coalesce(description, ''), is_deleted from bets where id = ?", id).
+              Scan(&doc.Id, &doc.Title, &doc.Body, &deleted)
+    if err != nil || deleted {
+        return db.Search.Remove(ctx, "bet", id)
+    }
+
+    doc.Kind = "bet"
+    return db.Search.Index(ctx, doc)
+}
+
+// indexUser brings a user up to date in the search index. Only verified
+// users can be found.
+func (db *MyDB) indexUser(ctx context.Context, id int) error {
+    if db.Search == nil {
+        return nil
+    }
+
+    var first, last string
+    var deleted, verified bool
+    err := db.QueryRowContext(ctx, "select first_name, last_name, is_deleted, is_verified from users where id = ?", id).
+              Scan(&first, &last, &deleted, &verified)
+    if err != nil || deleted || !verified {
+        return db.Search.Remove(ctx, "user", id)
+    }
+
+    return db.Search.Index(ctx, SearchDoc{ Kind: "user", Id: id, Title: first + " " + last })
+}
+
+// ReindexSearch rebuilds the search index from the database.
+func (db *MyDB) ReindexSearch(ctx context.Context) error {
+    docs := make([]SearchDoc, 0)
+
+    rows, err := db.QueryContext(ctx, "select id, title, coalesce(description, '') from bets where is_deleted = 0")
+    if err != nil {
+        return errors.New("Failed query for bets to index: " + err.Error())
+    }
+    for rows.Next() {
+        doc := SearchDoc{ Kind: "bet" }
+        if err := rows.Scan(&doc.Id, &doc.Title, &doc.Body); err != nil {
+            rows.Close()
+            return errors.New("Failed to scan bet to index: " + err.Error())
+        }
+        docs = append(docs, doc)
+    }
+    rows.Close()
+
+    rows, err = db.QueryContext(ctx, "select id, first_name, last_name from users where is_deleted = 0 and is_verified = 1")
+    if err != nil {
+        return errors.New("Failed query for users to index: " + err.Error())
+    }
+    for rows.Next() {
+        var first, last string
+        doc := SearchDoc{ Kind: "user" }
+        if err := rows.Scan(&doc.Id, &first, &last); err != nil {
+            rows.Close()
+            return errors.New("Failed to scan user to index: " + err.Error())
+        }
+        doc.Title = first + " " + last
+        docs = append(docs, doc)
+    }
+    rows.Close()
+
+    return db.Search.Rebuild(ctx, docs)
+}
+
+// RunSearchIndexer keeps the search index up to date until ctx is done. It
+// builds the index, updates it from the events of bets and users changing,
+// and rebuilds it every interval to pick up changes that raise no events.
+func (db *MyDB) RunSearchIndexer(ctx context.Context, interval time.Duration) {
+    if err := db.ReindexSearch(ctx); err != nil {
+        Logger(ctx).Error("failed to build search index", "error", err)
+    }
+
+    events, stop := db.Events.Subscribe()
+    defer stop()
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case e := <-events:
+            var err error
+            switch {
+            case e.BetId > 0:
+                err = db.indexBet(ctx, e.BetId)
+            case e.Type == "user.verified":
+                for _, id := range e.UserIds {
+                    err = db.indexUser(ctx, id)
+                }
+            }
+            if err != nil {
+                Logger(ctx).Warn("failed to update search index", "event_id", e.Id, "error", err)
+            }
+        case <-ticker.C:
+            if err := db.ReindexSearch(ctx); err != nil {
+                Logger(ctx).Error("failed to rebuild search index", "error", err)
+            }
+        }
+    }
+}
+
+// SearchFor finds the bets a viewer may see and the users matching a query,
+// most relevant first.
+func (db *MyDB) SearchFor(ctx context.Context, viewerId int, query string, limit int) ([]SearchResult, error) {
+    if db.Search == nil {
+        return nil, errors.New("Search is not available")
+    }
+
+    // some hits may be bets the viewer can't see, so look further than the limit
+    hits, err := db.Search.Search(ctx, query, limit * 4)
+    if err != nil {
+        return nil, err
+    }
+
+    betIds := make([]interface{}, 0)
+    userIds := make([]interface{}, 0)
+    for _, h := range hits {
+        if h.Kind == "bet" {
+            betIds = append(betIds, h.Id)
+        } else {
+            userIds = append(userIds, h.Id)
+        }
+    }
+
+    bets := make(map[int]*Bet)
+    if len(betIds) > 0 {
+        found, err := db.queryBets(ctx, viewerId, "b.id in (" + placeholders(len(betIds)) + ")", betIds...)
+        if err != nil {
+            return nil, err
+        }
+        for i := range found {
+            bets[found[i].Id] = &found[i]
+        }
+    }
+
+    users := make(map[int]*UserSummary)
+    if len(userIds) > 0 {
+        rows, err := db.QueryContext(ctx, "select id, first_name, last_name, profile_pic_url from users " +
+                                          "where is_deleted = 0 and is_verified = 1 and id in (" + placeholders(len(userIds)) + ")",
+                                     userIds...)
+        if err != nil {
+            return nil, errors.New("Failed query for found users: " + err.Error())
+        }
+        for rows.Next() {
+            var u UserSummary
+            if err := rows.Scan(&u.Id, &u.FirstName, &u.LastName, &u.ProfilePicUrl); err != nil {
+                rows.Close()
+                return nil, errors.New("Failed to scan found user: " + err.Error())
+            }
+            users[u.Id] = &u
+        }
+        rows.Close()
+    }
+
+    results := make([]SearchResult, 0, limit)
+    for _, h := range hits {
+        r := SearchResult{ Kind: h.Kind, Score: math.Round(h.Score * 1000) / 1000 }
+        if h.Kind == "bet" {
+            r.Bet = bets[h.Id]
+        } else {
+            r.User = users[h.Id]
+        }
+
+        if (r.Bet != nil || r.User != nil) && len(results) < limit {
+            results = append(results, r)
+        }
+    }
+
+    return results, nil
+}
+
+// placeholders returns n comma separated query placeholders.
+func placeholders(n int) string {
+    return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+/* Handlers */
+
+// SearchHandler searches bet titles and descriptions and user names.
+// Handles GET to /search?q=.
+func (db *MyDB) SearchHandler(rw http.ResponseWriter, r *http.Request) {
+    q := strings.TrimSpace(r.URL.Query().Get("q"))
+    if q == "" || len(q) > 200 {
+        WriteError(rw, 400, "Parameter 'q' must be between 1 and 200 characters")
+        return
+    }
+
+    results, err := db.SearchFor(r.Context(), db.Viewer(r), q, PageLimit(r, 20, 50))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, results)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "testing"
+)
+
+func TestEditDistance(t *testing.T) {
+    cases := []struct {
+        a, b string
+        max, want int
+    }{
+        { "steps", "steps", 1, 0 },
+        { "steps", "stpes", 1, 1 },  // swapped letters
+        { "steps", "step", 1, 1 },
+        { "marathon", "maratohn", 2, 1 },
+        { "marathon", "mrathn", 2, 2 },
+        { "run", "walking", 2, 3 },  // beyond max
+    }
+
+    for _, c := range cases {
+        if got := editDistance(c.a, c.b, c.max); got != c.want {
+            t.Errorf("editDistance(%q, %q, %d) = %d, want %d", c.a, c.b, c.max, got, c.want)
+        }
+    }
+}
+
+func TestMemoryIndex(t *testing.T) {
+    ctx := context.Background()
+    idx := NewMemoryIndex()
+
+    idx.Index(ctx, SearchDoc{ Kind: "bet", Id: 1, Title: "First to run a marathon", Body: "Before the end of the year" })
+    idx.Index(ctx, SearchDoc{ Kind: "bet", Id: 2, Title: "Weekly steps", Body: "Whoever runs the marathon route more often" })
+    idx.Index(ctx, SearchDoc{ Kind: "user", Id: 3, Title: "Marta Hill" })
+
+    hits, _ := idx.Search(ctx, "marathon", 10)
+    if len(hits) != 2 || hits[0].Id != 1 {
+        t.Fatalf("Search(marathon) = %v, want the title match first", hits)
+    }
+
+    hits, _ = idx.Search(ctx, "maratohn", 10)
+    if len(hits) != 2 {
+        t.Errorf("Search(maratohn) = %v, want typos tolerated", hits)
+    }
+
+    hits, _ = idx.Search(ctx, "mart", 10)
+    if len(hits) != 1 || hits[0].Kind != "user" {
+        t.Errorf("Search(mart) = %v, want the user by prefix", hits)
+    }
+
+    idx.Index(ctx, SearchDoc{ Kind: "bet", Id: 1, Title: "First to swim a mile" })
+    idx.Remove(ctx, "bet", 2)
+    if hits, _ = idx.Search(ctx, "marathon", 10); len(hits) != 0 {
+        t.Errorf("Search(marathon) = %v after reindexing, want no hits", hits)
+    }
+}
@@ -0,0 +1,867 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// A Recurrence is when the bets of a series happen, written like an
+// iCalendar RRULE: FREQ=DAILY, WEEKLY or MONTHLY, with an optional INTERVAL,
+// BYDAY (weekly only, e.g. MO,TH), COUNT and UNTIL (a date, or an RFC 3339 time).
+type Recurrence struct {
+    Freq string
+    Interval int
+    ByDay []time.Weekday
+    Count int             // 0 for no limit
+    Until *time.Time
+}
+
+var rruleDays = map[string]time.Weekday{
+    "SU": time.Sunday,
+    "MO": time.Monday,
+    "TU": time.Tuesday,
+    "WE": time.Wednesday,
+    "TH": time.Thursday,
+    "FR": time.Friday,
+    "SA": time.Saturday,
+}
+
+// maxOccurrenceSteps bounds how far ahead Next looks for an occurrence.
+const maxOccurrenceSteps = 10000
+
+const (
+    // defaultSeriesMaxFailures is how many failed spawns in a row mark a series failed.
+    defaultSeriesMaxFailures = 5
+    seriesBaseBackoff = time.Minute
+    seriesMaxBackoff = 6 * time.Hour
+)
+
+// ParseRecurrence reads a recurrence rule.
+func ParseRecurrence(rule string) (*Recurrence, error) {
+    r := &Recurrence{ Interval: 1 }
+
+    for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:"), ";") {
+        if part == "" {
+            continue
+        }
+        kv := strings.SplitN(part, "=", 2)
+        if len(kv) != 2 {
+            return nil, errors.New("Recurrence rules are KEY=VALUE pairs separated by semicolons, like FREQ=WEEKLY;COUNT=10")
+        }
+
+        var err error
+        switch kv[0] {
+        case "FREQ":
+            if kv[1] != "DAILY" && kv[1] != "WEEKLY" && kv[1] != "MONTHLY" {
+                return nil, errors.New("FREQ must be DAILY, WEEKLY or MONTHLY")
+            }
+            r.Freq = kv[1]
+        case "INTERVAL":
+            if r.Interval, err = strconv.Atoi(kv[1]); err != nil || r.Interval < 1 || r.Interval > 365 {
+                return nil, errors.New("INTERVAL must be a number from 1 to 365")
+            }
+        case "COUNT":
+            if r.Count, err = strconv.Atoi(kv[1]); err != nil || r.Count < 1 || r.Count > 1000 {
+                return nil, errors.New("COUNT must be a number from 1 to 1000")
+            }
+        case "UNTIL":
+            t, err := time.Parse("20060102", kv[1])
+            if err != nil {
+                if t, err = time.Parse(time.RFC3339, kv[1]); err != nil {
+                    return nil, errors.New("UNTIL must be a date like 20261231 or an RFC 3339 time")
+                }
+            } else {
+                // a date includes the whole day
+                t = t.Add(24 * time.Hour - time.Second)
+            }
+            t = t.UTC()
+            r.Until = &t
+        case "BYDAY":
+            for _, d := range strings.Split(kv[1], ",") {
+                day, ok := rruleDays[d]
+                if !ok {
+                    return nil, errors.New("BYDAY must list days like MO,WE,FR")
+                }
+                r.ByDay = append(r.ByDay, day)
+            }
+        default:
+            return nil, errors.New("Unsupported recurrence rule part " + kv[0])
+        }
+    }
+
+    if r.Freq == "" {
+        return nil, errors.New("Recurrence rules need a FREQ")
+    }
+    if len(r.ByDay) > 0 && r.Freq != "WEEKLY" {
+        return nil, errors.New("BYDAY is only supported with FREQ=WEEKLY")
+    }
+
+    return r, nil
+}
+
+// String writes the recurrence as a rule.
+func (r *Recurrence) String() string {
+    parts := []string{"FREQ=" + r.Freq}
+    if r.Interval > 1 {
+        parts = append(parts, "INTERVAL=" + strconv.Itoa(r.Interval))
+    }
+    if len(r.ByDay) > 0 {
+        days := make([]string, len(r.ByDay))
+        for i, d := range r.ByDay {
+            days[i] = strings.ToUpper(d.String()[:2])
+        }
+        parts = append(parts, "BYDAY=" + strings.Join(days, ","))
+    }
+    if r.Count > 0 {
+        parts = append(parts, "COUNT=" + strconv.Itoa(r.Count))
+    }
+    if r.Until != nil {
+        parts = append(parts, "UNTIL=" + r.Until.Format(time.RFC3339))
+    }
+    return strings.Join(parts, ";")
+}
+
+// occurrence returns the n-th period of the recurrence from start: a single
+// time, or the days of a week for weekly rules with BYDAY.
+func (r *Recurrence) occurrence(start time.Time, n int) []time.Time {
+    switch r.Freq {
+    case "DAILY":
+        return []time.Time{ start.AddDate(0, 0, n * r.Interval) }
+
+    case "WEEKLY":
+        week := start.AddDate(0, 0, 7 * n * r.Interval)
+        if len(r.ByDay) == 0 {
+            return []time.Time{ week }
+        }
+
+        // the days of the week starting on the Monday of week
+        monday := week.AddDate(0, 0, -((int(week.Weekday()) + 6) % 7))
+        days := make([]time.Time, 0, len(r.ByDay))
+        for offset := 0; offset < 7; offset++ {
+            day := monday.AddDate(0, 0, offset)
+            for _, d := range r.ByDay {
+                if day.Weekday() == d && !day.Before(start) {
+                    days = append(days, day)
+                }
+            }
+        }
+        return days
+
+    default:
+        // months without the start's day are skipped, like Feb 30
+        month := start.AddDate(0, n * r.Interval, 0)
+        if month.Day() != start.Day() {
+            return nil
+        }
+        return []time.Time{ month }
+    }
+}
+
+// Next returns the first occurrence after a time for a series that started
+// at start and already had spawned occurrences, or false if the series is over.
+func (r *Recurrence) Next(start time.Time, after time.Time, spawned int) (time.Time, bool) {
+    if r.Count > 0 && spawned >= r.Count {
+        return time.Time{}, false
+    }
+
+    for n := 0; n < maxOccurrenceSteps; n++ {
+        for _, t := range r.occurrence(start, n) {
+            if r.Until != nil && t.After(*r.Until) {
+                return time.Time{}, false
+            }
+            if t.After(after) {
+                return t, true
+            }
+        }
+    }
+
+    return time.Time{}, false
+}
+
+// A Series is a bet that recurs between the same players and witness. Each
+// occurrence is spawned as a normal two-person bet.
+type Series struct {
+    Id int                  `json:"id"`
+    BettorId int            `json:"bettor_id"`
+    BettedId int            `json:"betted_id"`
+    WitnessId int           `json:"witness_id"`
+    Title string            `json:"title"`
+    Description string      `json:"description,omitempty"`
+    Amount int              `json:"amount"`                 // the bettor's stake in each bet, in cents
+    BettedStake int         `json:"betted_stake"`
+    Rule string             `json:"rule"`
+    StartsOn time.Time      `json:"starts_on"`
+    NextOn *time.Time       `json:"next_on,omitempty"`      // when the next bet is spawned
+    Occurrences int         `json:"occurrences"`            // bets due so far, including any the bettor's limits skipped
+    Status string           `json:"status"`                 // active, paused, cancelled, finished or failed
+    CreatedOn time.Time     `json:"created_on"`
+    BetPrivacy
+    BetLabels
+
+    Standings []Standing    `json:"standings,omitempty"`
+    Bets []Bet              `json:"bets,omitempty"`
+}
+
+// A Standing is a player's results over the bets of a series.
+type Standing struct {
+    UserId int      `json:"user_id"`
+    Wins int        `json:"wins"`
+    Losses int      `json:"losses"`
+    Pushes int      `json:"pushes"`
+    Net int         `json:"net"`     // in cents
+}
+
+// A SeriesRequest creates or edits a series. When editing, only the fields
+// given change, and they apply to the bets spawned from then on.
+type SeriesRequest struct {
+    BettedId *int           `json:"betted_id"`
+    WitnessId *int          `json:"witness_id"`
+    Title *string           `json:"title"`
+    Description *string     `json:"description"`
+    Amount *int             `json:"amount"`
+    BettedStake *int        `json:"betted_stake"`
+    Rule *string            `json:"rule"`
+    StartsOn *time.Time     `json:"starts_on"`
+    Visibility string       `json:"visibility,omitempty"`
+    HideAmount *bool        `json:"hide_amount,omitempty"`
+    BetLabels
+}
+
+// apply changes a series by a request, checking the result.
+func (s *Series) apply(req SeriesRequest) error {
+    if req.BettedId != nil {
+        s.BettedId = *req.BettedId
+    }
+    if req.WitnessId != nil {
+        s.WitnessId = *req.WitnessId
+    }
+    if req.Title != nil {
+        s.Title = strings.TrimSpace(*req.Title)
+    }
+    if req.Description != nil {
+        s.Description = *req.Description
+    }
+    if req.Amount != nil {
+        s.Amount = *req.Amount
+        if req.BettedStake == nil && s.BettedStake == 0 {
+            s.BettedStake = s.Amount
+        }
+    }
+    if req.BettedStake != nil {
+        s.BettedStake = *req.BettedStake
+    }
+    if req.Rule != nil {
+        r, err := ParseRecurrence(*req.Rule)
+        if err != nil {
+            return err
+        }
+        s.Rule = r.String()
+    }
+    if req.StartsOn != nil {
+        // a start in the past would spawn every occurrence since at once;
+        // a minute's grace allows for clocks that differ
+        if req.StartsOn.Before(time.Now().Add(-time.Minute)) {
+            return errors.New("A series can't start in the past")
+        }
+        s.StartsOn = req.StartsOn.UTC()
+    }
+    if req.Category != "" || req.Tags != nil {
+        s.BetLabels = req.BetLabels
+    }
+
+    switch {
+    case s.Title == "" || len(s.Title) > 255:
+        return errors.New("A series needs a title of at most 255 characters")
+    case s.BettedId <= 0 || s.WitnessId <= 0:
+        return errors.New("A series needs a betted user and a witness")
+    case s.BettedId == s.BettorId || s.WitnessId == s.BettorId || s.WitnessId == s.BettedId:
+        return errors.New("The bettor, betted user and witness of a series must be different users")
+    case s.Amount <= 0 || s.BettedStake <= 0:
+        return errors.New("Stakes must be positive numbers of cents")
+    case s.Rule == "":
+        return errors.New("A series needs a recurrence rule, like FREQ=WEEKLY;COUNT=10")
+    }
+    if s.Category != "" && !ValidCategory(s.Category) {
+        return errors.New("Unknown category " + s.Category)
+    }
+
+    var err error
+    s.Tags, err = NormalizeTags(s.Tags)
+    return err
+}
+
+// schedule works out when the next bet of a series is spawned, counting
+// from after. Series with no occurrences left are finished.
+func (s *Series) schedule(after time.Time) {
+    r, err := ParseRecurrence(s.Rule)
+    if err != nil {
+        s.NextOn = nil
+        s.Status = "finished"
+        return
+    }
+
+    next, ok := r.Next(s.StartsOn, after, s.Occurrences)
+    if !ok {
+        s.NextOn = nil
+        s.Status = "finished"
+        return
+    }
+    s.NextOn = &next
+}
+
+/* Store */
+
+const seriesColumns = "id, bettor_id, betted_id, witness_id, title, coalesce(description, ''), amount, betted_stake, rule, " +
+                      "starts_on, next_on, occurrences, status, created_on, visibility, hide_amount, coalesce(category, ''), tags"
+
+func scanSeries(row interface{ Scan(...interface{}) error }) (*Series, error) {
+    var s Series
+    var next sql.NullTime
+    var tags string
+
+    err := row.Scan(&s.Id, &s.BettorId, &s.BettedId, &s.WitnessId, &s.Title, &s.Description, &s.Amount, &s.BettedStake, &s.Rule,
+                    &s.StartsOn, &next, &s.Occurrences, &s.Status, &s.CreatedOn, &s.Visibility, &s.HideAmount, &s.Category, &tags)
+    if err != nil {
+        return nil, err
+    }
+    if next.Valid {
+        s.NextOn = &next.Time
+    }
+    if tags != "" {
+        s.Tags = strings.Split(tags, ",")
+    }
+
+    return &s, nil
+}
+
+// GetSeries returns a series.
+func (db *MyDB) GetSeries(ctx context.Context, id int) (*Series, error) {
+    return getSeries(ctx, db, id, false)
+}
+
+func getSeries(ctx context.Context, q Queryer, id int, lock bool) (*Series, error) {
+    query := "select " + seriesColumns + " from bet_series where id = ?"
+    if lock {
+        query += " for update"
+    }
+
+    s, err := scanSeries(q.QueryRowContext(ctx, query, id))
+    if err != nil {
+        return nil, errors.New("No series found with id " + strconv.Itoa(id))
+    }
+    return s, nil
+}
+
+// GetUserSeries returns the series a user plays in, newest first.
+func (db *MyDB) GetUserSeries(ctx context.Context, userId int) ([]Series, error) {
+    rows, err := db.QueryContext(ctx, "select " + seriesColumns + " from bet_series " +
+                                      "where bettor_id = ? or betted_id = ? order by id desc", userId, userId)
+    if err != nil {
+        return nil, errors.New("Failed query for series: " + err.Error())
+    }
+    defer rows.Close()
+
+    series := make([]Series, 0)
+    for rows.Next() {
+        s, err := scanSeries(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan series row: " + err.Error())
+        }
+        series = append(series, *s)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over series rows: " + err.Error())
+    }
+
+    return series, nil
+}
+
+// GetSeriesBets fills in the bets spawned by a series, newest first, and the
+// players' standings over the settled ones.
+func (db *MyDB) GetSeriesBets(ctx context.Context, s *Series) error {
+    rows, err := db.QueryContext(ctx, "select bet_id from bet_series_bets where series_id = ? order by occurrence desc", s.Id)
+    if err != nil {
+        return errors.New("Failed query for series bets: " + err.Error())
+    }
+
+    ids := make([]int, 0)
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return errors.New("Failed to scan series bet: " + err.Error())
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+
+    s.Bets = make([]Bet, 0, len(ids))
+    for _, id := range ids {
+        b, err := db.GetBet(ctx, id)
+        if err != nil {
+            return err
+        }
+        s.Bets = append(s.Bets, *b)
+    }
+
+    standings := map[int]*Standing{
+        s.BettorId: { UserId: s.BettorId },
+        s.BettedId: { UserId: s.BettedId },
+    }
+    for _, b := range s.Bets {
+        if b.Status != "settled" {
+            continue
+        }
+        for _, m := range b.Members {
+            st, ok := standings[m.UserId]
+            if !ok || m.Role != "player" {
+                continue
+            }
+            net := b.netFor(m.UserId)
+            switch {
+            case net > 0:
+                st.Wins++
+            case net < 0:
+                st.Losses++
+            default:
+                st.Pushes++
+            }
+            st.Net += net
+        }
+    }
+    s.Standings = []Standing{ *standings[s.BettorId], *standings[s.BettedId] }
+
+    return nil
+}
+
+// CreateSeries starts a series and schedules its first bet.
+func (db *MyDB) CreateSeries(ctx context.Context, s Series) (*Series, error) {
+    s.Status = "active"
+    s.schedule(s.StartsOn.Add(-time.Second))
+
+    res, err := db.ExecContext(ctx, "insert into bet_series (bettor_id, betted_id, witness_id, title, description, amount, betted_stake, " +
+                                    "rule, starts_on, next_on, status, visibility, hide_amount, category, tags) " +
+                                    "values (?, ?, ?, ?, nullif(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, nullif(?, ''), ?)",
+                               s.BettorId, s.BettedId, s.WitnessId, s.Title, s.Description, s.Amount, s.BettedStake,
+                               s.Rule, s.StartsOn, s.NextOn, s.Status, s.Visibility, s.HideAmount, s.Category, strings.Join(s.Tags, ","))
+    if err != nil {
+        return nil, errors.New("Failed to create series: " + err.Error())
+    }
+
+    id, err := res.LastInsertId()
+    if err != nil {
+        return nil, errors.New("Failed to get series id: " + err.Error())
+    }
+
+    Logger(ctx).Info("series created", "series_id", id, "bettor_id", s.BettorId, "rule", s.Rule)
+
+    return db.GetSeries(ctx, int(id))
+}
+
+// UpdateSeries edits a series on behalf of its bettor. Bets already spawned keep their terms.
+func (db *MyDB) UpdateSeries(ctx context.Context, id int, userId int, req SeriesRequest) (*Series, error) {
+    err := db.InTx(ctx, func(tx *Tx) error {
+        s, err := getSeries(ctx, tx, id, true)
+        if err != nil {
+            return err
+        }
+
+        if s.BettorId != userId {
+            return errors.New("Only the bettor of a series can edit it")
+        }
+        if s.Status == "cancelled" || s.Status == "finished" {
+            return errors.New("Series that are " + s.Status + " can't be edited")
+        }
+
+        if err = s.apply(req); err != nil {
+            return err
+        }
+        if req.Visibility != "" {
+            if !Visibilities[req.Visibility] {
+                return errors.New("Visibility must be participants, friends or public")
+            }
+            s.Visibility = req.Visibility
+        }
+        if req.HideAmount != nil {
+            s.HideAmount = *req.HideAmount
+        }
+
+        if req.Rule != nil || req.StartsOn != nil {
+            if s.Status == "active" {
+                s.schedule(time.Now().UTC())
+            }
+        }
+
+        _, err = tx.ExecContext(ctx, "update bet_series set betted_id = ?, witness_id = ?, title = ?, description = nullif(?, ''), " +
+                                     "amount = ?, betted_stake = ?, rule = ?, starts_on = ?, next_on = ?, status = ?, " +
+                                     "visibility = ?, hide_amount = ?, category = nullif(?, ''), tags = ? where id = ?",
+                                s.BettedId, s.WitnessId, s.Title, s.Description, s.Amount, s.BettedStake, s.Rule, s.StartsOn,
+                                s.NextOn, s.Status, s.Visibility, s.HideAmount, s.Category, strings.Join(s.Tags, ","), id)
+        if err != nil {
+            return errors.New("Failed to update series: " + err.Error())
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return db.GetSeries(ctx, id)
+}
+
+// SetSeriesStatus pauses, resumes or cancels a series on behalf of one of its
+// players. Occurrences missed while paused are skipped.
+func (db *MyDB) SetSeriesStatus(ctx context.Context, id int, userId int, status string) (*Series, error) {
+    err := db.InTx(ctx, func(tx *Tx) error {
+        s, err := getSeries(ctx, tx, id, true)
+        if err != nil {
+            return err
+        }
+
+        if userId != s.BettorId && userId != s.BettedId {
+            return errors.New("Only the players of a series can change it")
+        }
+        if s.Status == "cancelled" || s.Status == "finished" {
+            return errors.New("Series that are " + s.Status + " can't be changed")
+        }
+
+        switch status {
+        case "paused":
+            s.NextOn = nil
+        case "active":
+            s.schedule(time.Now().UTC())
+        case "cancelled":
+            s.NextOn = nil
+        default:
+            return errors.New("Status must be active, paused or cancelled")
+        }
+        if s.Status != "finished" {
+            s.Status = status
+        }
+
+        // resuming a failed series starts its retries over
+        _, err = tx.ExecContext(ctx, "update bet_series set status = ?, next_on = ?, failures = 0, retry_on = null where id = ?",
+                                s.Status, s.NextOn, id)
+        if err != nil {
+            return errors.New("Failed to update series: " + err.Error())
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    Logger(ctx).Info("series status changed", "series_id", id, "status", status, "user_id", userId)
+
+    return db.GetSeries(ctx, id)
+}
+
+// spawnSeries spawns the next bet of one series that is due, and reports
+// whether there was one. A series whose bet can't be spawned is retried later
+// rather than holding up the others.
+func (db *MyDB) spawnSeries(ctx context.Context) (bool, error) {
+    spawned := false
+    var id, betId int
+    var s *Series
+    var skipped *LimitError
+
+    err := db.InTx(ctx, func(tx *Tx) error {
+        err := tx.QueryRowContext(ctx, "select id from bet_series where status = 'active' and next_on <= utc_timestamp() " +
+                                       "and (retry_on is null or retry_on <= utc_timestamp()) " +
+                                       "order by next_on limit 1 for update skip locked").Scan(&id)
+        if err == sql.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return errors.New("Failed query for due series: " + err.Error())
+        }
+
+        if s, err = getSeries(ctx, tx, id, false); err != nil {
+            return err
+        }
+
+        // each bet runs until the next one is due
+        occurrence := *s.NextOn
+        s.Occurrences++
+        s.schedule(occurrence)
+
+        betId, err = tx.createBet(ctx,
+                                  s.BettorId,
+                                  s.BettedId,
+                                  s.WitnessId,
+                                  0,
+                                  s.Title,
+                                  s.Description,
+                                  "pending",
+                                  s.Amount,
+                                  s.BettedStake,
+                                  nil,
+                                  s.NextOn,
+                                  s.BetPrivacy,
+                                  s.BetLabels)
+
+        // an occurrence the bettor's limits refuse is skipped; limits are
+        // checked before anything is written, so the series can still move on
+        if errors.As(err, &skipped) {
+            betId = 0
+        } else if err != nil {
+            return err
+        }
+
+        if betId > 0 {
+            _, err = tx.ExecContext(ctx, "insert into bet_series_bets (series_id, bet_id, occurrence, occurs_on) values (?, ?, ?, ?)",
+                                    s.Id, betId, s.Occurrences, occurrence)
+            if err != nil {
+                return errors.New("Failed to link series bet: " + err.Error())
+            }
+        }
+
+        _, err = tx.ExecContext(ctx, "update bet_series set occurrences = ?, next_on = ?, status = ?, failures = 0, retry_on = null " +
+                                     "where id = ?", s.Occurrences, s.NextOn, s.Status, s.Id)
+        if err != nil {
+            return errors.New("Failed to update series: " + err.Error())
+        }
+
+        spawned = true
+        return nil
+    })
+    if err != nil && id != 0 {
+        return true, db.seriesFailed(ctx, id, err)
+    }
+    if err != nil || !spawned {
+        return false, err
+    }
+
+    if betId == 0 {
+        Logger(ctx).Info("series bet skipped", "series_id", s.Id, "occurrence", s.Occurrences, "reason", skipped.Code)
+        return true, nil
+    }
+
+    betsCreated.Inc()
+    Logger(ctx).Info("series bet spawned", "series_id", s.Id, "bet_id", betId, "occurrence", s.Occurrences)
+
+    return true, nil
+}
+
+// seriesFailed records that a series' bet couldn't be spawned, and puts off
+// trying it again, backing off, until SERIES_MAX_FAILURES failures in a row
+// mark the series failed. Its players can resume it once the cause is fixed.
+func (db *MyDB) seriesFailed(ctx context.Context, id int, cause error) error {
+    var failures int
+    if err := db.QueryRowContext(ctx, "select failures from bet_series where id = ?", id).Scan(&failures); err != nil {
+        return errors.New("Failed to load series failures: " + err.Error())
+    }
+    failures++
+
+    status := "active"
+    if failures >= EnvInt("SERIES_MAX_FAILURES", defaultSeriesMaxFailures) {
+        status = "failed"
+    }
+    retry := time.Now().UTC().Add(Backoff(failures, seriesBaseBackoff, seriesMaxBackoff))
+
+    _, err := db.ExecContext(ctx, "update bet_series set failures = ?, last_error = ?, retry_on = ?, status = ? " +
+                                  "where id = ? and status = 'active'", failures, truncate(cause.Error(), 255), retry, status, id)
+    if err != nil {
+        return errors.New("Failed to record series failure: " + err.Error())
+    }
+
+    Logger(ctx).Error("spawning series bet failed", "series_id", id, "failures", failures, "status", status, "error", cause)
+    return nil
+}
+
+// spawnDueSeries spawns the bets of every series that is due, a few at a time.
+func (db *MyDB) spawnDueSeries(ctx context.Context) {
+    for i := 0; i < 50; i++ {
+        spawned, err := db.spawnSeries(ctx)
+        if err != nil {
+            Logger(ctx).Error("spawning series bet failed", "error", err)
+            return
+        }
+        if !spawned {
+            return
+        }
+    }
+}
+
+/* Handlers */
+
+func readSeriesRequest(r *http.Request) (SeriesRequest, error) {
+    var req SeriesRequest
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return req, errors.New("Failed to parse body: " + err.Error())
+    }
+
+    if err = json.Unmarshal(body, &req); err != nil {
+        return req, errors.New("Body must be a series: " + err.Error())
+    }
+    return req, nil
+}
+
+// playerSeries loads the series in the path, checking the authenticated user plays in it.
+func (db *MyDB) playerSeries(rw http.ResponseWriter, r *http.Request) (*Series, int, bool) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return nil, 0, false
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    s, err := db.GetSeries(r.Context(), id)
+    if err != nil || (userId != s.BettorId && userId != s.BettedId && userId != s.WitnessId) {
+        WriteError(rw, 404, "No series found with id " + strconv.Itoa(id))
+        return nil, 0, false
+    }
+
+    return s, userId, true
+}
+
+// SeriesShowHandler lists the authenticated user's series.
+// Handles GET to /series.
+func (db *MyDB) SeriesShowHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    series, err := db.GetUserSeries(r.Context(), userId)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, series)
+}
+
+// SeriesCreateHandler starts a series of bets by the authenticated user.
+// Handles POST to /series.
+func (db *MyDB) SeriesCreateHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    req, err := readSeriesRequest(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    s := Series{ BettorId: userId, StartsOn: time.Now().UTC() }
+    if err = s.apply(req); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if s.BetPrivacy, err = db.BetPrivacyFor(r.Context(), userId, req.Visibility, req.HideAmount); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    created, err := db.CreateSeries(r.Context(), s)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, created)
+}
+
+// SeriesItemHandler shows a series with its bets and standings.
+// Handles GET to /series/{id}.
+func (db *MyDB) SeriesItemHandler(rw http.ResponseWriter, r *http.Request) {
+    s, _, ok := db.playerSeries(rw, r)
+    if !ok {
+        return
+    }
+
+    if err := db.GetSeriesBets(r.Context(), s); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, s)
+}
+
+// SeriesUpdateHandler edits the bets a series spawns from now on.
+// Handles PUT to /series/{id}.
+func (db *MyDB) SeriesUpdateHandler(rw http.ResponseWriter, r *http.Request) {
+    s, userId, ok := db.playerSeries(rw, r)
+    if !ok {
+        return
+    }
+
+    req, err := readSeriesRequest(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    updated, err := db.UpdateSeries(r.Context(), s.Id, userId, req)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, updated)
+}
+
+// SeriesStatusHandler pauses, resumes or cancels a series.
+// Handles POST to /series/{id}/status with a "status" of paused, active or cancelled.
+func (db *MyDB) SeriesStatusHandler(rw http.ResponseWriter, r *http.Request) {
+    s, userId, ok := db.playerSeries(rw, r)
+    if !ok {
+        return
+    }
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+
+    updated, err := db.SetSeriesStatus(r.Context(), s.Id, userId, params["status"])
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, updated)
+}
+
+// SeriesDeleteHandler cancels a series. Bets it already spawned stay.
+// Handles DELETE to /series/{id}.
+func (db *MyDB) SeriesDeleteHandler(rw http.ResponseWriter, r *http.Request) {
+    s, userId, ok := db.playerSeries(rw, r)
+    if !ok {
+        return
+    }
+
+    if _, err := db.SetSeriesStatus(r.Context(), s.Id, userId, "cancelled"); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
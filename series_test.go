@@ -0,0 +1,58 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestRecurrenceNext(t *testing.T) {
+    start := time.Date(2026, time.January, 31, 18, 0, 0, 0, time.UTC)  // a Saturday
+
+    cases := []struct {
+        rule string
+        after time.Time
+        spawned int
+        want string  // empty when the series is over
+    }{
+        { "FREQ=DAILY", start, 0, "2026-02-01T18:00:00Z" },
+        { "FREQ=DAILY;INTERVAL=3", start.Add(-time.Second), 0, "2026-01-31T18:00:00Z" },
+        { "FREQ=WEEKLY;INTERVAL=2", start, 1, "2026-02-14T18:00:00Z" },
+        { "FREQ=WEEKLY;BYDAY=MO,TH", start, 0, "2026-02-02T18:00:00Z" },
+        { "FREQ=WEEKLY;BYDAY=MO,TH", time.Date(2026, time.February, 2, 18, 0, 0, 0, time.UTC), 1, "2026-02-05T18:00:00Z" },
+        { "FREQ=MONTHLY", start, 0, "2026-03-31T18:00:00Z" },  // no Feb 31
+        { "FREQ=DAILY;COUNT=2", start, 2, "" },
+        { "FREQ=DAILY;UNTIL=20260201", start.AddDate(0, 0, 1), 2, "" },
+    }
+
+    for _, c := range cases {
+        r, err := ParseRecurrence(c.rule)
+        if err != nil {
+            t.Fatalf("ParseRecurrence(%q): %v", c.rule, err)
+        }
+
+        next, ok := r.Next(start, c.after, c.spawned)
+        got := ""
+        if ok {
+            got = next.Format(time.RFC3339)
+        }
+        if got != c.want {
+            t.Errorf("%q after %s: got %q, want %q", c.rule, c.after.Format(time.RFC3339), got, c.want)
+        }
+    }
+}
+
+func TestParseRecurrence(t *testing.T) {
+    for _, rule := range []string{"", "FREQ=HOURLY", "FREQ=DAILY;BYDAY=MO", "FREQ=WEEKLY;BYDAY=XX", "FREQ=DAILY;COUNT=0", "INTERVAL=2"} {
+        if _, err := ParseRecurrence(rule); err == nil {
+            t.Errorf("ParseRecurrence(%q) should fail", rule)
+        }
+    }
+
+    r, err := ParseRecurrence("rrule:freq=weekly;interval=2;byday=mo,fr;count=6")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := r.String(), "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR;COUNT=6"; got != want {
+        t.Errorf("String() = %q, want %q", got, want)
+    }
+}
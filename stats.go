@@ -0,0 +1,254 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// UserStats are a user's results over the bets they played in.
+// A player wins when they are paid out more than they staked, loses when
+// less, and pushes when they get their stake back.
+type UserStats struct {
+    UserId int          `json:"user_id"`
+    Wins int            `json:"wins"`
+    Losses int          `json:"losses"`
+    Pushes int          `json:"pushes"`
+    WinRate float64     `json:"win_rate"`     // wins over wins and losses
+    Net int             `json:"net"`          // cents won minus cents lost
+    BiggestWin int      `json:"biggest_win"`  // in cents
+    Streak int          `json:"streak"`       // consecutive wins, or losses when negative; pushes don't count
+}
+
+// A LeaderboardEntry is a user's standing over a leaderboard's window.
+type LeaderboardEntry struct {
+    Rank int            `json:"rank"`
+    UserId int          `json:"user_id"`
+    FirstName string    `json:"first_name"`
+    LastName string     `json:"last_name"`
+    Wins int            `json:"wins"`
+    Losses int          `json:"losses"`
+    Pushes int          `json:"pushes"`
+    WinRate float64     `json:"win_rate"`
+    Net int             `json:"net"`
+}
+
+// LeaderboardWindows are the named windows of leaderboards, in days.
+// A window can also be given as a number of days, like "90d"; 0 is all time.
+var LeaderboardWindows = map[string]int{
+    "day": 1,
+    "week": 7,
+    "month": 30,
+    "year": 365,
+    "all": 0,
+}
+
+// leaderboardOrders are the orders a leaderboard can be ranked in.
+var leaderboardOrders = map[string]string{
+    "net": "net desc, wins desc",
+    "wins": "wins desc, net desc",
+    "win_rate": "win_rate desc, wins desc",
+}
+
+// friendIds is a subquery for the users someone has shared a bet with, themselves included.
+const friendIds = "select o.user_id from bet_participants p join bet_participants o on o.bet_id = p.bet_id where p.user_id = ?"
+
+func winRate(wins int, losses int) float64 {
+    if wins + losses == 0 {
+        return 0
+    }
+    return float64(wins) / float64(wins + losses)
+}
+
+// ParseWindow returns the days in a leaderboard window.
+func ParseWindow(window string) (int, error) {
+    if window == "" {
+        return 0, nil
+    }
+    if days, ok := LeaderboardWindows[window]; ok {
+        return days, nil
+    }
+
+    days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+    if err != nil || days < 0 || days > 3650 || !strings.HasSuffix(window, "d") {
+        return 0, errors.New("Parameter 'window' must be day, week, month, year, all or a number of days like 90d")
+    }
+    return days, nil
+}
+
+/* Store */
+
+// recordResults adds each player's result on a settled bet to their stats.
+func (tx *Tx) recordResults(ctx context.Context, b *Bet, payouts map[int]int) error {
+    for _, m := range b.Members {
+        if m.Role != "player" {
+            continue
+        }
+
+        net := payouts[m.UserId] - m.Stake
+        win, loss, push := 0, 0, 0
+        switch {
+        case net > 0:
+            win = 1
+        case net < 0:
+            loss = 1
+        default:
+            push = 1
+        }
+
+        _, err := tx.ExecContext(ctx, "insert into user_stats (user_id, wins, losses, pushes, net, biggest_win, streak) " +
+                                      "values (?, ?, ?, ?, ?, greatest(?, 0), ?) on duplicate key update " +
+                                      "wins = wins + values(wins), losses = losses + values(losses), pushes = pushes + values(pushes), " +
+                                      "net = net + values(net), biggest_win = greatest(biggest_win, values(biggest_win)), " +
+                                      "streak = case when ? > 0 then if(streak > 0, streak + 1, 1) " +
+                                      "when ? < 0 then if(streak < 0, streak - 1, -1) else streak end",
+                                 m.UserId, win, loss, push, net, net, win - loss, net, net)
+        if err != nil {
+            return errors.New("Failed to update user stats: " + err.Error())
+        }
+
+        _, err = tx.ExecContext(ctx, "insert into user_stats_daily (user_id, day, wins, losses, pushes, net) " +
+                                     "values (?, utc_date(), ?, ?, ?, ?) on duplicate key update " +
+                                     "wins = wins + values(wins), losses = losses + values(losses), " +
+                                     "pushes = pushes + values(pushes), net = net + values(net)",
+                                m.UserId, win, loss, push, net)
+        if err != nil {
+            return errors.New("Failed to update daily user stats: " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+// GetUserStats returns a user's all-time stats.
+func (db *MyDB) GetUserStats(ctx context.Context, userId int) (*UserStats, error) {
+    s := UserStats{ UserId: userId }
+
+    err := db.QueryRowContext(ctx, "select wins, losses, pushes, net, biggest_win, streak from user_stats where user_id = ?", userId).
+              Scan(&s.Wins, &s.Losses, &s.Pushes, &s.Net, &s.BiggestWin, &s.Streak)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, errors.New("Failed to get user stats: " + err.Error())
+    }
+    s.WinRate = winRate(s.Wins, s.Losses)
+
+    return &s, nil
+}
+
+// GetLeaderboard ranks users by their results over the last days, or all
+// time when days is 0. When friendsOf is set only the users they have shared
+// a bet with are ranked.
+func (db *MyDB) GetLeaderboard(ctx context.Context, days int, by string, friendsOf int, limit int) ([]LeaderboardEntry, error) {
+    order, ok := leaderboardOrders[by]
+    if !ok {
+        return nil, errors.New("Unknown leaderboard order " + by)
+    }
+
+    args := make([]interface{}, 0)
+    from := "user_stats s"
+    if days > 0 {
+        from = "(select user_id, sum(wins) wins, sum(losses) losses, sum(pushes) pushes, sum(net) net " +
+               "from user_stats_daily where day > utc_date() - interval ? day group by user_id) s"
+        args = append(args, days)
+    }
+
+    q := "select s.user_id, u.first_name, u.last_name, s.wins, s.losses, s.pushes, s.net, " +
+         "coalesce(s.wins / nullif(s.wins + s.losses, 0), 0) win_rate " +
+         "from " + from + " join users u on u.id = s.user_id where s.wins + s.losses + s.pushes > 0"
+    if friendsOf > 0 {
+        q += " and s.user_id in (" + friendIds + ")"
+        args = append(args, friendsOf)
+    }
+    q += " order by " + order + ", s.user_id limit ?"
+    args = append(args, limit)
+
+    rows, err := db.QueryContext(ctx, q, args...)
+    if err != nil {
+        return nil, errors.New("Failed query for leaderboard: " + err.Error())
+    }
+    defer rows.Close()
+
+    entries := make([]LeaderboardEntry, 0)
+    for rows.Next() {
+        var e LeaderboardEntry
+        if err := rows.Scan(&e.UserId, &e.FirstName, &e.LastName, &e.Wins, &e.Losses, &e.Pushes, &e.Net, &e.WinRate); err != nil {
+            return nil, errors.New("Failed to scan leaderboard row: " + err.Error())
+        }
+        e.Rank = len(entries) + 1
+        entries = append(entries, e)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over leaderboard rows: " + err.Error())
+    }
+
+    return entries, nil
+}
+
+/* Handlers */
+
+// UserStatsHandler gets a user's betting stats.
+// Handles GET to /users/{id}/stats.
+func (db *MyDB) UserStatsHandler(rw http.ResponseWriter, r *http.Request) {
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+    if !db.UserExists(r.Context(), id) {
+        WriteError(rw, 404, "No user found with id " + strconv.Itoa(id))
+        return
+    }
+
+    stats, err := db.GetUserStats(r.Context(), id)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, stats)
+}
+
+// LeaderboardHandler ranks users, globally or among the authenticated user's friends.
+// Handles GET to /leaderboard.
+func (db *MyDB) LeaderboardHandler(rw http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+
+    days, err := ParseWindow(query.Get("window"))
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    by := query.Get("by")
+    if by == "" {
+        by = "net"
+    }
+    if _, ok := leaderboardOrders[by]; !ok {
+        WriteError(rw, 400, "Parameter 'by' must be net, wins or win_rate")
+        return
+    }
+
+    friendsOf := 0
+    switch query.Get("scope") {
+    case "", "global":
+    case "friends":
+        if friendsOf, err = db.AuthenticatedUser(r); err != nil {
+            WriteError(rw, 401, err.Error())
+            return
+        }
+    default:
+        WriteError(rw, 400, "Parameter 'scope' must be global or friends")
+        return
+    }
+
+    entries, err := db.GetLeaderboard(r.Context(), days, by, friendsOf, PageLimit(r, 25, 100))
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, entries)
+}
@@ -1,32 +1,35 @@
 package main
 
 import (
+    "context"
     "errors"
     "fmt"
     "net/http"
     "net/url"
     "os"
     "strings"
+    "time"
 
     _ "github.com/go-sql-driver/mysql"
 )
 
 // SendVerificationMsg sends a text message with a user's verification token so they can confirm their phone number.
-func (db *MyDB) SendVerificationMsg(accessToken string, phoneNumber string) error {
+func (db *MyDB) SendVerificationMsg(ctx context.Context, userId int, phoneNumber string) error {
 
-    verificationToken, err := db.GetVerificationTokenFromAccessToken(accessToken)
+    var verificationToken string
+    err := db.QueryRowContext(ctx, "select verification_token from users where id = ?", userId).Scan(&verificationToken)
     if err != nil {
-        return err
+        return errors.New("Failed while querying for the verification token: " + err.Error())
     }
 
     msg := fmt.Sprintf("Your Bettor verification id is: %s", verificationToken)
-    SendTwilioMsg(phoneNumber, msg)
-
-    return nil
+    return SendTwilioMsg(ctx, phoneNumber, msg)
 }
 
 // SendTwilioMsg sends a text message from the Twilio API.
-func SendTwilioMsg(phoneNumber string, message string) error{
+func SendTwilioMsg(ctx context.Context, phoneNumber string, message string) (err error) {
+
+    defer func(start time.Time) { ObserveOutbound("twilio", start, err) }(time.Now())
 
     accountSid := "AC4b7b097d333a0d6490fff5d1098db453"
     authToken := os.Getenv("TWILIO_SECRET_KEY")
@@ -39,7 +42,7 @@ func SendTwilioMsg(phoneNumber string, message string) error{
     req_body := *strings.NewReader(url_params.Encode())
 
     client := &http.Client{}
-    req, err := http.NewRequest("POST", urlString, &req_body)
+    req, err := http.NewRequestWithContext(ctx, "POST", urlString, &req_body)
     if err != nil{
         return errors.New("Unable to create NewRequest: " + err.Error())
     }
@@ -47,19 +50,26 @@ func SendTwilioMsg(phoneNumber string, message string) error{
     req.Header.Add("Accept", "application/json")
     req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-    _, err = client.Do(req)
+    Logger(ctx).Debug("sending text message", "to", phoneNumber)
+
+    resp, err := client.Do(req)
     if err != nil{
         return errors.New("Verification text message failed to send: " + err.Error())
     }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return errors.New("Twilio rejected the text message: " + resp.Status)
+    }
 
     return nil
 }
 
 // GetVerificationTokenFromAccessToken returns the verification token based on a 
 // given user's Venmo access token.
-func (db *MyDB) GetVerificationTokenFromAccessToken(accessToken string) (string, error){
+func (db *MyDB) GetVerificationTokenFromAccessToken(ctx context.Context, accessToken string) (string, error){
     var verificationToken string
-    err := db.QueryRow("select verification_token from users where access_token = ?", accessToken).Scan(&verificationToken)
+    err := db.QueryRowContext(ctx, "select verification_token from users where access_token = ?", accessToken).Scan(&verificationToken)
     if err != nil{
         return "", errors.New("Failed while querying for the verification token: " + err.Error())
     }
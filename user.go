@@ -1,14 +1,17 @@
 package main
 
 import (
+    "context"
+    "crypto/subtle"
     "encoding/json"
     "errors"
     "fmt"
     "io/ioutil"
-    // "log"
     "math/rand"
     "net/http"
+    "net/url"
     "strconv"
+    "strings"
     "time"
 
     _ "github.com/go-sql-driver/mysql"
@@ -22,14 +25,15 @@ type User struct {
     FirstName string        `json:"first_name"`
     LastName string         `json:"last_name"`
     Email string            `json:"email"`
-    AccessToken string      `json:"access_token"`
+    AccessToken string      `json:"-"`
     ProfilePicUrl string    `json:"profile_pic_url"`
     CreatedOn time.Time     `json:"created_on"`
     VenmoId string          `json:"venmo_id"`
 }
 
 // CreateUser creates a new user.
-func (db *MyDB) CreateUser(firstName string,
+func (db *MyDB) CreateUser(ctx context.Context,
+                           firstName string,
                            lastName string,
                            email string,
                            accessToken string,
@@ -37,7 +41,7 @@ func (db *MyDB) CreateUser(firstName string,
                            venmoId string,
                            phoneNumber string) error {
 
-    if db.VenmoUserExists(venmoId) {
+    if db.VenmoUserExists(ctx, venmoId) {
         return errors.New("A user already exists for the given Venmo id")
     }
 
@@ -49,92 +53,115 @@ func (db *MyDB) CreateUser(firstName string,
     q := "insert into users (first_name, last_name, email, " +
              "access_token, verification_token, profile_pic_url, venmo_id, phone_number) values (?, ?, ?, ?, ?, ?, ?, ?)"
 
-    stmt, err := db.Prepare(q)
-    if err != nil {
-        return errors.New("Failed to prepare user insert: " + err.Error())
-    }
-    defer stmt.Close()
-
-    _, err = stmt.Exec(firstName,
-                       lastName,
-                       email,
-                       accessToken,
-                       verificationToken,
-                       profilePicUrl,
-                       venmoId,
-                       phoneNumber)
+    err := db.InTx(ctx, func(tx *Tx) error {
+        res, err := tx.ExecContext(ctx, q,
+                                   firstName,
+                                   lastName,
+                                   email,
+                                   accessToken,
+                                   verificationToken,
+                                   profilePicUrl,
+                                   venmoId,
+                                   phoneNumber)
+        if err != nil {
+            return errors.New("Failed to execute user insert: " + err.Error())
+        }
+
+        id, err := res.LastInsertId()
+        if err != nil {
+            return errors.New("Failed to get user id: " + err.Error())
+        }
+
+        // text the verification token once the user exists
+        return tx.Enqueue(ctx, "sms.verification", VerificationSMS{ UserId: int(id), PhoneNumber: phoneNumber })
+    })
     if err != nil {
-        return errors.New("Failed to execute user insert: " + err.Error())
+        return err
     }
 
+    Logger(ctx).Info("user created", "venmo_id", venmoId, "phone_number", phoneNumber)
+
     return nil
 }
 
 // DeleteUser deletes a user.
-func (db *MyDB) DeleteUser(id int) error {
+func (db *MyDB) DeleteUser(ctx context.Context, id int) error {
 
-    _, err := db.Exec("update users set is_deleted = 1 where id = ?", id)
+    _, err := db.ExecContext(ctx, "update users set is_deleted = 1 where id = ?", id)
     if err != nil {
         return errors.New("Failed to delete user: " + err.Error())
     }
 
-    return nil
+    return db.indexUser(ctx, id)
+}
+
+// updatableUserFields are the user columns UpdateUser may change.
+var updatableUserFields = map[string]bool{
+    "first_name": true,
+    "last_name": true,
+    "email": true,
+    "profile_pic_url": true,
+    "phone_number": true,
 }
 
 // UpdateUser updates information about a user.
 // If there is a phone number passed in, we also verify their phone number.
-func (db *MyDB) UpdateUser(id int, args map[string]string) error {
-
-    if _, ok := args["phone_number"]; ok {
+func (db *MyDB) UpdateUser(ctx context.Context, id int, args map[string]string) error {
 
-        // get the user's access token
-        u, err := db.GetUser(id)
-        if err != nil {
-            return errors.New("Unable to get user")
-        }
-
-        // send verification message
-        db.SendVerificationMsg(u.AccessToken, args["phone_number"])
+    if len(args) == 0 {
+        return errors.New("Nothing to update")
     }
 
     statement := "update users set "
+    values := make([]interface{}, 0, len(args) + 1)
     for k, v := range args {
-        statement += (k + "=" + v + ",")
+        if !updatableUserFields[k] {
+            return errors.New("Unknown or read-only user field " + k)
+        }
+        statement += k + " = ?,"
+        values = append(values, v)
     }
 
     // remove the last comma
     statement = statement[:len(statement) - 1]
-    statement += "where id = ?"
+    statement += " where id = ?"
+    values = append(values, id)
 
-    stmt, err := db.Prepare(statement)
-    if err != nil {
-        return errors.New("Failed to prepare user update: " + err.Error())
-    }
+    err := db.InTx(ctx, func(tx *Tx) error {
+        if _, err := tx.ExecContext(ctx, statement, values...); err != nil {
+            return errors.New("Failed to execute user update: " + err.Error())
+        }
 
-    _, err = stmt.Exec(id)
+        // text the verification token to the new number once it's stored
+        if phone, ok := args["phone_number"]; ok {
+            return tx.Enqueue(ctx, "sms.verification", VerificationSMS{ UserId: id, PhoneNumber: phone })
+        }
+        return nil
+    })
     if err != nil {
-        return errors.New("Failed to execute user update: " + err.Error())
+        return err
     }
 
-    return nil
+    // names are searchable, and raise no event when they change
+    return db.indexUser(ctx, id)
 }
 
 // GetUser returns a User reflecting the current state of a given user.
-func (db *MyDB) GetUser(id int) (*User, error) {
+func (db *MyDB) GetUser(ctx context.Context, id int) (*User, error) {
 
     var u User
     q := "select id, first_name, last_name, email, " +
              "access_token, profile_pic_url, created_on," +
              " venmo_id from users where id = ?"
 
-    err := db.QueryRow(q, id).Scan(&u.Id,
-                                       &u.FirstName,
-                                       &u.LastName,
-                                       &u.Email,
-                                       &u.AccessToken,
-                                       &u.ProfilePicUrl,
-                                       &u.CreatedOn,
-                                       &u.VenmoId)
+    err := db.QueryRowContext(ctx, q, id).Scan(&u.Id,
+                                                &u.FirstName,
+                                                &u.LastName,
+                                                &u.Email,
+                                                &u.AccessToken,
+                                                &u.ProfilePicUrl,
+                                                &u.CreatedOn,
+                                                &u.VenmoId)
     if err != nil {
         return nil, errors.New("Failed to get user: " + err.Error())
     }
@@ -142,8 +169,17 @@ func (db *MyDB) GetUser(id int) (*User, error) {
     return &u, nil
 }
 
+// userFilterFields are the user columns GetUsers may match on.
+var userFilterFields = map[string]bool{
+    "id": true,
+    "first_name": true,
+    "last_name": true,
+    "email": true,
+    "venmo_id": true,
+}
+
 // GetUsers returns a slice of Users matchign the given arguments.
-func (db *MyDB) GetUsers(args map[string]string) ([]User, error) {
+func (db *MyDB) GetUsers(ctx context.Context, args map[string]string) ([]User, error) {
 
     var u User
     users := make([]User, 0)
@@ -152,13 +188,18 @@ func (db *MyDB) GetUsers(args map[string]string) ([]User, error) {
              "access_token, profile_pic_url, created_on," +
              " venmo_id from users where is_deleted = 0 and is_verified = 1 and "
 
+    values := make([]interface{}, 0, len(args))
     for k, v := range args {
-        q += fmt.Sprintf("%s = '%s' and ", k, v)
+        if !userFilterFields[k] {
+            return nil, errors.New("Unknown user field " + k)
+        }
+        q += k + " = ? and "
+        values = append(values, v)
     }
 
     q = q[:len(q) - 5]
 
-    rows, err := db.Query(q)
+    rows, err := db.QueryContext(ctx, q, values...)
     if err != nil {
         return nil, errors.New("Failed query for users: " + err.Error())
     }
@@ -189,135 +230,137 @@ func (db *MyDB) GetUsers(args map[string]string) ([]User, error) {
     return users[0:], nil
 }
 
-// GetUserBets gets the bets for a given user.
-func (db *MyDB) GetUserBets(id int) ([]Bet, error) {
-
-    var b Bet
-    bets := make([]Bet, 0)
+// GetUserBets gets the bets a user plays in as the bettor or the betted
+// user, as far as a viewer may see them.
+func (db *MyDB) GetUserBets(ctx context.Context, viewerId int, id int) ([]Bet, error) {
 
-    q := "select id, bettor_id, betted_id, witness_id, " +
-         "winner_id, title, desc, created_at, expire_at, " +
-         "status, amount from bets where (bettor_id = ? or betted_id = ?)"
-
-    rows, err := db.Query(q, id, id)
-    if err != nil {
-        return nil, errors.New("Failed query for user bets: " + err.Error())
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        err := rows.Scan(&b.Id,
-                         &b.BettorId,
-                         &b.BettedId,
-                         &b.WitnessId,
-                         &b.WinnerId,
-                         &b.Title,
-                         &b.Desc,
-                         &b.CreatedOn,
-                         &b.Status,
-                         &b.Amount)
-        if err != nil {
-            return nil, errors.New("Failed to scan user row: " + err.Error())
-        }
-
-       bets = append(bets, b)
-    }
-
-    err = rows.Err()
-    if err != nil {
-        return nil, errors.New("Failed while iterating over user bet rows: " + err.Error())
-    }
-
-    return bets[0:], nil
+    // two lookups, each served by an index, instead of an or across columns
+    return db.queryBets(ctx, viewerId, "b.id in (select id from bets where bettor_id = ? " +
+                                       "union select id from bets where betted_id = ?)", id, id)
 }
 
-// GetUserWitnessing gets the bets for which a user is a witness.
-func (db *MyDB) GetUserWitnessing(id int) ([]Bet, error) {
-    var b Bet
-    bets := make([]Bet, 0)
-
-    q := "select id, bettor_id, betted_id, witness_id, " +
-         "winner_id, title, desc, created_at, expire_at, " +
-         "status, amount from bets where witness_id = ?)"
-
-    rows, err := db.Query(q, id)
-    if err != nil {
-        return nil, errors.New("Failed query for user bets: " + err.Error())
-    }
-    defer rows.Close()
-
-    for rows.Next() {
-        err := rows.Scan(&b.Id,
-                         &b.BettorId,
-                         &b.BettedId,
-                         &b.WitnessId,
-                         &b.WinnerId,
-                         &b.Title,
-                         &b.Desc,
-                         &b.CreatedOn,
-                         &b.Status,
-                         &b.Amount)
-        if err != nil {
-            return nil, errors.New("Failed to scan user witnesses: " + err.Error())
-        }
-
-       bets = append(bets, b)
-    }
-
-    err = rows.Err()
-    if err != nil {
-        return nil, errors.New("Failed while iterating over user witness rows: " + err.Error())
-    }
-
-    return bets[0:], nil
+// GetUserWitnessing gets the bets for which a user is a witness, as far as
+// a viewer may see them.
+func (db *MyDB) GetUserWitnessing(ctx context.Context, viewerId int, id int) ([]Bet, error) {
+    return db.queryBets(ctx, viewerId, "b.witness_id = ?", id)
 }
 
 // UserExists checks if a user with the given id exists.
-func (db *MyDB) UserExists(id int) bool {
+func (db *MyDB) UserExists(ctx context.Context, id int) bool {
     var first_name string
-    err := db.QueryRow("select first_name from users where id=?", id).Scan(&first_name)
+    err := db.QueryRowContext(ctx, "select first_name from users where id=?", id).Scan(&first_name)
     return err == nil
 }
 
 // VenmoUserExists checks if a user already exists using a Venmo id.
-func (db *MyDB) VenmoUserExists(venmoId string) bool {
+func (db *MyDB) VenmoUserExists(ctx context.Context, venmoId string) bool {
 
     // there has to be a better way to get the errors from QueryRow
     var first_name string
-    err := db.QueryRow("select first_name from users where venmo_id=?", venmoId).Scan(&first_name)
+    err := db.QueryRowContext(ctx, "select first_name from users where venmo_id=?", venmoId).Scan(&first_name)
     return err == nil
 }
 
-// VerifyUser sets is_verified on a given user to True when we verify their phone number.
-func (db *MyDB) VerifyUser(accessToken string, verificationToken string) error{
+const (
+    // defaultVerifyMaxFailures is how many wrong verification tokens lock an
+    // account's verification for VERIFY_LOCKOUT.
+    defaultVerifyMaxFailures = 5
+    defaultVerifyLockout = time.Hour
+)
 
-    dBVerificationToken, _ := db.GetVerificationTokenFromAccessToken(accessToken)
+// VerifyUser sets is_verified on a given user to True when we verify their phone number.
+// Tokens are short, so failed attempts are counted against the account and,
+// every VERIFY_MAX_FAILURES of them, lock it out of verifying for a while.
+func (db *MyDB) VerifyUser(ctx context.Context, accessToken string, verificationToken string) error{
 
-    if dBVerificationToken != verificationToken {
-        return errors.New("Access token does not match our records")
+    id, err := db.GetIdByAccessToken(ctx, accessToken)
+    if err != nil {
+        return err
     }
 
-    _, err := db.Exec("update users set is_verified = 1 where access_token = ?", accessToken)
-    if err != nil{
-        return errors.New("Failed to set is_verified for the current user: " + err.Error())
+    maxFailures := max(EnvInt("VERIFY_MAX_FAILURES", defaultVerifyMaxFailures), 1)
+    lockout := EnvDuration("VERIFY_LOCKOUT", defaultVerifyLockout)
+
+    var failed error
+    err = db.InTx(ctx, func(tx *Tx) error {
+        _, err := tx.ExecContext(ctx, "insert ignore into user_verification_attempts (user_id) values (?)", id)
+        if err != nil {
+            return errors.New("Failed to record verification attempt: " + err.Error())
+        }
+
+        var failures int
+        var locked bool
+        var dBVerificationToken string
+        err = tx.QueryRowContext(ctx, "select a.failures, coalesce(a.locked_until > utc_timestamp(), 0), u.verification_token " +
+                                      "from user_verification_attempts a join users u on u.id = a.user_id where a.user_id = ? for update", id).
+                 Scan(&failures, &locked, &dBVerificationToken)
+        if err != nil {
+            return errors.New("Failed to load verification attempts: " + err.Error())
+        }
+
+        if locked {
+            failed = errors.New("Too many failed attempts, try again later")
+            return nil
+        }
+
+        if subtle.ConstantTimeCompare([]byte(dBVerificationToken), []byte(verificationToken)) != 1 {
+            Logger(ctx).Warn("verification token mismatch", "user_id", id, "failures", failures + 1)
+            failed = errors.New("Access token does not match our records")
+
+            failures++
+            if failures % maxFailures == 0 {
+                _, err = tx.ExecContext(ctx, "update user_verification_attempts set failures = ?, locked_until = utc_timestamp() + interval ? second " +
+                                             "where user_id = ?", failures, int(lockout.Seconds()), id)
+            } else {
+                _, err = tx.ExecContext(ctx, "update user_verification_attempts set failures = ? where user_id = ?", failures, id)
+            }
+            if err != nil {
+                return errors.New("Failed to record verification attempt: " + err.Error())
+            }
+            return nil
+        }
+
+        if _, err = tx.ExecContext(ctx, "delete from user_verification_attempts where user_id = ?", id); err != nil {
+            return errors.New("Failed to clear verification attempts: " + err.Error())
+        }
+
+        _, err = tx.ExecContext(ctx, "update users set is_verified = 1 where id = ?", id)
+        if err != nil{
+            return errors.New("Failed to set is_verified for the current user: " + err.Error())
+        }
+
+        return tx.Event(ctx, "user.verified", 0, []int{id}, map[string]int{"user_id": id})
+    })
+    if err != nil {
+        return err
     }
 
-    return nil
+    return failed
 }
 
 // GetIdByAccessToken gets a users id given their access token.
-func (db *MyDB) GetIdByAccessToken(accessToken string) (int, error) {
+// Banned users are refused.
+func (db *MyDB) GetIdByAccessToken(ctx context.Context, accessToken string) (int, error) {
     var id int
+    var banned bool
 
-    err := db.QueryRow("select id from users where access_token=?", accessToken).Scan(&id)
+    err := db.QueryRowContext(ctx, "select u.id, b.user_id is not null from users u " +
+                                   "left join user_bans b on b.user_id = u.id where u.access_token=?", accessToken).Scan(&id, &banned)
     if err != nil {
         return -1, errors.New("No user found for the given access token")
     }
 
+    if banned {
+        return -1, errors.New("This account has been banned")
+    }
+
     return id, nil
 }
 
-func GetVenmoInfo(accessToken string) (map[string]string, error) {
+// GetVenmoInfo requests a user's profile from Venmo.
+func GetVenmoInfo(ctx context.Context, accessToken string) (info map[string]string, err error) {
+
+    defer func(start time.Time) { ObserveOutbound("venmo", start, err) }(time.Now())
 
     type UserBase struct {
         FirstName string        `json:"first_name"`
@@ -336,13 +379,25 @@ func GetVenmoInfo(accessToken string) (map[string]string, error) {
     }
 
     var responseHolder DataHolder
-    var err error
 
     url := "https://api.venmo.com/v1/me?access_token=" + accessToken
-    resp, err := http.Get(url)
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
     if err != nil {
+        return nil, errors.New("Unable to create Venmo request: " + Redact(err.Error()))
+    }
+
+    Logger(ctx).Debug("requesting Venmo profile")
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        Logger(ctx).Warn("Venmo request failed", "error", err)
         return nil, errors.New("Request to Venmo failed")
     }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return nil, errors.New("Venmo rejected the request: " + resp.Status)
+    }
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
@@ -354,7 +409,7 @@ func GetVenmoInfo(accessToken string) (map[string]string, error) {
         return nil, err
     }
 
-    info := make(map[string]string)
+    info = make(map[string]string)
 
     info["first_name"] = responseHolder.Data.User.FirstName
     info["last_name"] = responseHolder.Data.User.LastName
@@ -363,4 +418,39 @@ func GetVenmoInfo(accessToken string) (map[string]string, error) {
     info["venmo_id"] = responseHolder.Data.User.Id
 
     return info, nil
-}
\ No newline at end of file
+}
+
+// SendVenmoPayment pays an amount in cents to a Venmo user from the account of an access token.
+// Requests sent again with the same idempotency key make a single payment.
+func SendVenmoPayment(ctx context.Context, accessToken string, venmoId string, note string, amount int, idempotencyKey string) (err error) {
+
+    defer func(start time.Time) { ObserveOutbound("venmo", start, err) }(time.Now())
+
+    params := url.Values{}
+    params.Set("access_token", accessToken)
+    params.Set("user_id", venmoId)
+    params.Set("note", note)
+    params.Set("amount", fmt.Sprintf("%d.%02d", amount / 100, amount % 100))
+
+    req, err := http.NewRequestWithContext(ctx, "POST", "https://api.venmo.com/v1/payments", strings.NewReader(params.Encode()))
+    if err != nil {
+        return errors.New("Unable to create Venmo request: " + Redact(err.Error()))
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Idempotency-Key", idempotencyKey)
+
+    Logger(ctx).Debug("sending Venmo payment", "venmo_id", venmoId, "amount", amount)
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        Logger(ctx).Warn("Venmo request failed", "error", err)
+        return errors.New("Request to Venmo failed")
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return errors.New("Venmo rejected the payment: " + resp.Status)
+    }
+
+    return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// A Rivalry is the head-to-head record of a user against another user over
+// the two-person bets between them.
+type Rivalry struct {
+    UserId int          `json:"user_id"`
+    OtherId int         `json:"other_id"`
+    Bets []Bet          `json:"bets"`                   // newest first
+    Wins int            `json:"wins"`
+    OtherWins int       `json:"other_wins"`
+    Net int             `json:"net"`                    // cents the user is up on the other, negative when down
+    LastResult *Bet     `json:"last_result,omitempty"`  // the most recently settled bet
+}
+
+/* Store */
+
+// GetRivalry returns the head-to-head record of a user against another
+// user, over the bets between them a viewer may see. Bets with amounts hidden
+// from the viewer count towards wins but not towards the net.
+func (db *MyDB) GetRivalry(ctx context.Context, viewerId int, userId int, otherId int) (*Rivalry, error) {
+
+    // one side of the pair at a time, so each half is served by the pairwise index
+    bets, err := db.queryBets(ctx, viewerId, "b.id in (select id from bets where bettor_id = ? and betted_id = ? " +
+                                             "union all select id from bets where bettor_id = ? and betted_id = ?)",
+                              userId, otherId, otherId, userId)
+    if err != nil {
+        return nil, err
+    }
+
+    rivalry := &Rivalry{ UserId: userId, OtherId: otherId, Bets: bets }
+
+    var last time.Time
+    for i := range rivalry.Bets {
+        b := &rivalry.Bets[i]
+        if err = loadParticipants(ctx, db, b); err != nil {
+            return nil, err
+        }
+
+        hidden := b.HideAmount && !b.IsParticipant(viewerId)
+        if hidden {
+            b.Redact()
+        } else {
+            if err = loadOdds(ctx, db, b); err != nil {
+                return nil, err
+            }
+            if m, ok := b.Member(b.BettedId); ok && m.Role == "player" && m.Stake != b.Amount {
+                b.BettedStake = m.Stake
+            }
+        }
+
+        if b.Status != "settled" {
+            continue
+        }
+
+        switch b.WinnerId {
+        case userId:
+            rivalry.Wins++
+        case otherId:
+            rivalry.OtherWins++
+        }
+        if !hidden {
+            rivalry.Net += b.netFor(userId)
+        }
+
+        // bets settled before settlements were recorded fall back to when they were made
+        var settledOn sql.NullTime
+        err = db.QueryRowContext(ctx, "select max(created_on) from bet_events where bet_id = ? and new_status = 'settled'", b.Id).
+                 Scan(&settledOn)
+        if err != nil {
+            return nil, errors.New("Failed to load when a bet settled: " + err.Error())
+        }
+        at := b.CreatedOn
+        if settledOn.Valid {
+            at = settledOn.Time
+        }
+        if rivalry.LastResult == nil || at.After(last) {
+            rivalry.LastResult = b
+            last = at
+        }
+    }
+
+    return rivalry, nil
+}
+
+// netFor returns the cents a player came out ahead on a settled bet,
+// negative when behind.
+func (b *Bet) netFor(userId int) int {
+    if m, ok := b.Member(userId); ok && m.Payout != nil {
+        return *m.Payout - m.Stake
+    }
+
+    // settled before payouts were recorded, when both sides staked the amount
+    switch b.WinnerId {
+    case userId:
+        return b.Amount
+    case 0:
+        return 0
+    default:
+        return -b.Amount
+    }
+}
+
+/* Handlers */
+
+// UserVersusHandler gets the head-to-head record between two users.
+// Handles GET to /users/{id}/versus/{other}.
+func (db *MyDB) UserVersusHandler(rw http.ResponseWriter, r *http.Request) {
+
+    vars := mux.Vars(r)
+    id, _ := strconv.Atoi(vars["id"])
+    otherId, _ := strconv.Atoi(vars["other"])
+
+    if id == otherId {
+        WriteError(rw, 400, "A user has no record against themselves")
+        return
+    }
+
+    for _, uid := range []int{id, otherId} {
+        if !db.UserExists(r.Context(), uid) {
+            WriteError(rw, 404, "No user found with id " + strconv.Itoa(uid))
+            return
+        }
+    }
+
+    rivalry, err := db.GetRivalry(r.Context(), db.Viewer(r), id, otherId)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, rivalry)
+}
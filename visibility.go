@@ -0,0 +1,350 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+)
+
+// Visibilities are who can see a bet beyond its participants: nobody else,
+// the participants' friends, or everyone.
+var Visibilities = map[string]bool{
+    "participants": true,
+    "friends": true,
+    "public": true,
+}
+
+// DefaultVisibility is the visibility of bets made by users without a default
+// of their own, and of bets made before visibility existed, which were
+// readable by anyone.
+const DefaultVisibility = "public"
+
+// BetPrivacy is who can see a bet, and whether its amount is hidden from
+// those who aren't taking part. Users keep a default for the bets they make.
+type BetPrivacy struct {
+    Visibility string   `json:"visibility"`             // participants, friends or public
+    HideAmount bool     `json:"hide_amount,omitempty"`  // stakes, odds and payouts are left out for non-participants
+}
+
+// Redact leaves out the amounts of a bet.
+func (b *Bet) Redact() {
+    b.Amount = 0
+    b.BettedStake = 0
+    b.Odds = nil
+    for i := range b.Members {
+        b.Members[i].Stake = 0
+        b.Members[i].Payout = nil
+    }
+}
+
+// visibleTo is a condition on bets b, with their bet_visibility v left
+// joined, that holds for the bets a viewer may see. It takes the viewer's id twice.
+const visibleTo = "(coalesce(v.visibility, '" + DefaultVisibility + "') = 'public' or " +
+                  "exists (select 1 from bet_participants vp where vp.bet_id = b.id and vp.user_id = ?) or " +
+                  "(v.visibility = 'friends' and exists (select 1 from bet_participants vp " +
+                  "join bet_participants vm on vm.user_id = vp.user_id " +
+                  "join bet_participants vf on vf.bet_id = vm.bet_id where vp.bet_id = b.id and vf.user_id = ?)))"
+
+/* Store */
+
+// saveVisibility sets who can see a bet.
+func (tx *Tx) saveVisibility(ctx context.Context, betId int, p BetPrivacy) error {
+    if !Visibilities[p.Visibility] {
+        return errors.New("Visibility must be participants, friends or public")
+    }
+
+    _, err := tx.ExecContext(ctx, "insert into bet_visibility (bet_id, visibility, hide_amount) values (?, ?, ?) " +
+                                  "on duplicate key update visibility = values(visibility), hide_amount = values(hide_amount)",
+                             betId, p.Visibility, p.HideAmount)
+    if err != nil {
+        return errors.New("Failed to store bet visibility: " + err.Error())
+    }
+    return nil
+}
+
+// loadVisibility fills in who can see a bet.
+func loadVisibility(ctx context.Context, q Queryer, b *Bet) error {
+    err := q.QueryRowContext(ctx, "select visibility, hide_amount from bet_visibility where bet_id = ?", b.Id).
+             Scan(&b.Visibility, &b.HideAmount)
+    if err == sql.ErrNoRows {
+        b.BetPrivacy = BetPrivacy{ Visibility: DefaultVisibility }
+        return nil
+    }
+    if err != nil {
+        return errors.New("Failed to load bet visibility: " + err.Error())
+    }
+    return nil
+}
+
+// GetDefaultPrivacy returns the privacy a user's new bets get.
+func (db *MyDB) GetDefaultPrivacy(ctx context.Context, userId int) (BetPrivacy, error) {
+    p := BetPrivacy{ Visibility: DefaultVisibility }
+
+    err := db.QueryRowContext(ctx, "select visibility, hide_amount from user_privacy where user_id = ?", userId).
+              Scan(&p.Visibility, &p.HideAmount)
+    if err != nil && err != sql.ErrNoRows {
+        return p, errors.New("Failed to load privacy defaults: " + err.Error())
+    }
+    return p, nil
+}
+
+// SetDefaultPrivacy sets the privacy a user's new bets get.
+func (db *MyDB) SetDefaultPrivacy(ctx context.Context, userId int, p BetPrivacy) error {
+    if !Visibilities[p.Visibility] {
+        return errors.New("Visibility must be participants, friends or public")
+    }
+
+    _, err := db.ExecContext(ctx, "insert into user_privacy (user_id, visibility, hide_amount) values (?, ?, ?) " +
+                                  "on duplicate key update visibility = values(visibility), hide_amount = values(hide_amount)",
+                             userId, p.Visibility, p.HideAmount)
+    if err != nil {
+        return errors.New("Failed to store privacy defaults: " + err.Error())
+    }
+    return nil
+}
+
+// BetPrivacyFor returns the privacy of a new bet by a user: their default,
+// with the visibility and hidden amount overridden when given.
+func (db *MyDB) BetPrivacyFor(ctx context.Context, userId int, visibility string, hideAmount *bool) (BetPrivacy, error) {
+    p, err := db.GetDefaultPrivacy(ctx, userId)
+    if err != nil {
+        return p, err
+    }
+
+    if visibility != "" {
+        if !Visibilities[visibility] {
+            return p, errors.New("Visibility must be participants, friends or public")
+        }
+        p.Visibility = visibility
+    }
+    if hideAmount != nil {
+        p.HideAmount = *hideAmount
+    }
+
+    return p, nil
+}
+
+// SetBetPrivacy changes who can see a bet on behalf of one of its participants.
+func (db *MyDB) SetBetPrivacy(ctx context.Context, b *Bet, userId int, p BetPrivacy) error {
+    err := db.InTx(ctx, func(tx *Tx) error {
+        return tx.saveVisibility(ctx, b.Id, p)
+    })
+    if err != nil {
+        return err
+    }
+
+    Logger(ctx).Info("bet privacy changed", "bet_id", b.Id, "user_id", userId, "visibility", p.Visibility, "hide_amount", p.HideAmount)
+    return nil
+}
+
+// CanSee reports whether a viewer may see a bet, leaving out its amounts if
+// they are hidden from the viewer. Anonymous viewers have id 0.
+func (db *MyDB) CanSee(ctx context.Context, b *Bet, viewerId int) (bool, error) {
+    if b.IsParticipant(viewerId) {
+        return true, nil
+    }
+
+    switch b.Visibility {
+    case "participants":
+        return false, nil
+    case "friends":
+        var friend int
+        err := db.QueryRowContext(ctx, "select exists (" + friendsOfBet + " and f.user_id = ?)", b.Id, viewerId).Scan(&friend)
+        if err != nil {
+            return false, errors.New("Failed to check bet visibility: " + err.Error())
+        }
+        if friend == 0 {
+            return false, nil
+        }
+    }
+
+    if b.HideAmount {
+        b.Redact()
+    }
+    return true, nil
+}
+
+// visibleBet returns a bet if it exists and the viewer may see it, and nil
+// otherwise, so callers answer the same for a missing bet and a hidden one.
+func (db *MyDB) visibleBet(ctx context.Context, id int, viewerId int) (*Bet, error) {
+    if !db.BetExists(ctx, id) {
+        return nil, nil
+    }
+
+    b, err := db.GetBet(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+
+    if ok, err := db.CanSee(ctx, b, viewerId); err != nil || !ok {
+        return nil, err
+    }
+    return b, nil
+}
+
+// queryBets returns the bets matching a condition on bets b that a viewer may
+// see, newest first, with amounts hidden from the viewer left out.
+func (db *MyDB) queryBets(ctx context.Context, viewerId int, where string, args ...interface{}) ([]Bet, error) {
+
+    q := "select " + betColumns + ", coalesce(v.visibility, ?), coalesce(v.hide_amount, 0), " +
+         "exists (select 1 from bet_participants vp where vp.bet_id = b.id and vp.user_id = ?) " +
+         "from bets b left join bet_visibility v on v.bet_id = b.id " +
+         "where b.is_deleted = 0 and " + where + " and " + visibleTo + " " +
+         "order by b.created_on desc, b.id desc"
+
+    args = append([]interface{}{ DefaultVisibility, viewerId }, args...)
+    args = append(args, viewerId, viewerId)
+
+    rows, err := db.QueryContext(ctx, q, args...)
+    if err != nil {
+        return nil, errors.New("Failed query for bets: " + err.Error())
+    }
+    defer rows.Close()
+
+    bets := make([]Bet, 0)
+    for rows.Next() {
+        var b Bet
+        var participant bool
+        err := rows.Scan(&b.Id,
+                         &b.BettorId,
+                         &b.BettedId,
+                         &b.WitnessId,
+                         &b.WinnerId,
+                         &b.Title,
+                         &b.Desc,
+                         &b.CreatedOn,
+                         &b.Status,
+                         &b.Amount,
+                         &b.Visibility,
+                         &b.HideAmount,
+                         &participant)
+        if err != nil {
+            return nil, errors.New("Failed to scan bet row: " + err.Error())
+        }
+
+        if b.HideAmount && !participant {
+            b.Redact()
+        }
+        bets = append(bets, b)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over bet rows: " + err.Error())
+    }
+
+    return bets, nil
+}
+
+/* Handlers */
+
+// Viewer returns the id of the user a request was made by, or 0 for anonymous requests.
+func (db *MyDB) Viewer(r *http.Request) int {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        return 0
+    }
+    return userId
+}
+
+// readPrivacy reads a "visibility" and optional "hide_amount" from a JSON body.
+func readPrivacy(r *http.Request) (BetPrivacy, error) {
+    var p BetPrivacy
+
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        return p, errors.New("Failed to parse body: " + err.Error())
+    }
+
+    if err = json.Unmarshal(body, &p); err != nil {
+        return p, errors.New("Body must be a JSON object: " + err.Error())
+    }
+    if !Visibilities[p.Visibility] {
+        return p, errors.New("Parameter 'visibility' must be participants, friends or public")
+    }
+
+    return p, nil
+}
+
+// BetPrivacyHandler changes who can see a bet, and whether its amount is hidden.
+// Handles PUT and POST to /bets/{id}/privacy.
+func (db *MyDB) BetPrivacyHandler(rw http.ResponseWriter, r *http.Request) {
+    b, userId, ok := db.participantBet(rw, r)
+    if !ok {
+        return
+    }
+
+    p, err := readPrivacy(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if err = db.SetBetPrivacy(r.Context(), b, userId, p); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, p)
+}
+
+// UserPrivacyHandler shows the privacy a user's new bets get.
+// Handles GET to /users/{id}/privacy.
+func (db *MyDB) UserPrivacyHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, ok := db.selfUser(rw, r)
+    if !ok {
+        return
+    }
+
+    p, err := db.GetDefaultPrivacy(r.Context(), userId)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, p)
+}
+
+// UserPrivacyUpdateHandler changes the privacy a user's new bets get.
+// Handles PUT and POST to /users/{id}/privacy.
+func (db *MyDB) UserPrivacyUpdateHandler(rw http.ResponseWriter, r *http.Request) {
+    userId, ok := db.selfUser(rw, r)
+    if !ok {
+        return
+    }
+
+    p, err := readPrivacy(r)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    if err = db.SetDefaultPrivacy(r.Context(), userId, p); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, p)
+}
+
+// selfUser checks the user in the path is the authenticated user.
+func (db *MyDB) selfUser(rw http.ResponseWriter, r *http.Request) (int, bool) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return 0, false
+    }
+
+    if id, _ := strconv.Atoi(mux.Vars(r)["id"]); id != userId {
+        WriteError(rw, 403, "Only the user themselves can see and change their settings")
+        return 0, false
+    }
+
+    return userId, true
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// WebhookEvents are the event types a webhook can subscribe to, besides "*" for all of them.
+var WebhookEvents = []string{
+    "bet.created",
+    "bet.countered",
+    "bet.accepted",
+    "bet.joined",
+    "bet.declined",
+    "bet.disputed",
+    "bet.settled",
+    "bet.deleted",
+    "bet.updated",
+    "comment.created",
+    "comment.edited",
+    "comment.deleted",
+    "comment.mentioned",
+    "evidence.added",
+    "user.verified",
+}
+
+const (
+    // WebhookMaxAttempts is how many times a delivery is tried before it is dead-lettered.
+    WebhookMaxAttempts = 8
+
+    // webhookBaseBackoff is the wait after the first failure, doubled after each one.
+    webhookBaseBackoff = 30 * time.Second
+    webhookMaxBackoff = 6 * time.Hour
+
+    // webhookLease is how long a worker holds a delivery it is attempting.
+    webhookLease = time.Minute
+)
+
+// A Webhook is a subscription of a URL to events.
+type Webhook struct {
+    Id int                  `json:"id"`
+    UserId int              `json:"user_id"`
+    Url string              `json:"url"`
+    Events []string         `json:"events"`
+    Secret string           `json:"secret,omitempty"`
+    CreatedOn time.Time     `json:"created_on"`
+}
+
+// Wants reports whether the webhook subscribes to an event type.
+func (w *Webhook) Wants(typ string) bool {
+    for _, e := range w.Events {
+        if e == "*" || e == typ {
+            return true
+        }
+    }
+    return false
+}
+
+// A WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+    Id int64                `json:"id"`
+    WebhookId int           `json:"webhook_id"`
+    EventId int64           `json:"event_id,omitempty"`
+    EventType string        `json:"event_type"`
+    Status string           `json:"status"`     // pending, delivered, failed or dead
+    Attempts int            `json:"attempts"`
+    LastStatusCode int      `json:"last_status_code,omitempty"`
+    LastError string        `json:"last_error,omitempty"`
+    NextAttemptOn time.Time `json:"next_attempt_on"`
+    CreatedOn time.Time     `json:"created_on"`
+    Payload json.RawMessage `json:"-"`
+}
+
+/* Store */
+
+// CreateWebhook subscribes a URL to events for a user. The returned webhook
+// carries the signing secret, which isn't shown again.
+func (db *MyDB) CreateWebhook(ctx context.Context, userId int, rawUrl string, events []string) (*Webhook, error) {
+
+    u, err := url.Parse(rawUrl)
+    if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+        return nil, errors.New("Webhook url must be an absolute http or https url")
+    }
+    if u.Scheme == "http" && !EnvBool("WEBHOOK_ALLOW_HTTP", false) {
+        return nil, errors.New("Webhook url must use https")
+    }
+    if err := checkWebhookHost(ctx, u.Hostname()); err != nil {
+        return nil, err
+    }
+
+    if len(events) == 0 {
+        return nil, errors.New("At least one event is required")
+    }
+    for _, e := range events {
+        if !validWebhookEvent(e) {
+            return nil, errors.New("Unknown webhook event " + e)
+        }
+    }
+
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return nil, errors.New("Failed to generate webhook secret: " + err.Error())
+    }
+    secret := hex.EncodeToString(b)
+
+    res, err := db.ExecContext(ctx, "insert into webhooks (user_id, url, events, secret) values (?, ?, ?, ?)",
+                               userId, rawUrl, strings.Join(events, ","), secret)
+    if err != nil {
+        return nil, errors.New("Failed to insert webhook: " + err.Error())
+    }
+
+    id, err := res.LastInsertId()
+    if err != nil {
+        return nil, errors.New("Failed to get webhook id: " + err.Error())
+    }
+
+    w, err := db.GetWebhook(ctx, int(id))
+    if err != nil {
+        return nil, err
+    }
+    w.Secret = secret
+
+    Logger(ctx).Info("webhook created", "webhook_id", id, "user_id", userId)
+
+    return w, nil
+}
+
+const webhookColumns = "id, user_id, url, events, created_on"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+    var w Webhook
+    var events string
+
+    if err := row.Scan(&w.Id, &w.UserId, &w.Url, &events, &w.CreatedOn); err != nil {
+        return nil, err
+    }
+    w.Events = strings.Split(events, ",")
+
+    return &w, nil
+}
+
+// GetWebhook returns a webhook, without its secret.
+func (db *MyDB) GetWebhook(ctx context.Context, id int) (*Webhook, error) {
+    row := db.QueryRowContext(ctx, "select " + webhookColumns + " from webhooks where id = ? and is_deleted = 0", id)
+
+    w, err := scanWebhook(row)
+    if err != nil {
+        return nil, errors.New("Failed to get webhook: " + err.Error())
+    }
+
+    return w, nil
+}
+
+// GetUserWebhooks returns the webhooks of a user.
+func (db *MyDB) GetUserWebhooks(ctx context.Context, userId int) ([]Webhook, error) {
+    rows, err := db.QueryContext(ctx, "select " + webhookColumns + " from webhooks where user_id = ? and is_deleted = 0 order by id", userId)
+    if err != nil {
+        return nil, errors.New("Failed query for webhooks: " + err.Error())
+    }
+    defer rows.Close()
+
+    webhooks := make([]Webhook, 0)
+    for rows.Next() {
+        w, err := scanWebhook(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan webhook row: " + err.Error())
+        }
+        webhooks = append(webhooks, *w)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over webhook rows: " + err.Error())
+    }
+
+    return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook. Its pending deliveries are dropped.
+func (db *MyDB) DeleteWebhook(ctx context.Context, id int) error {
+    if _, err := db.ExecContext(ctx, "update webhooks set is_deleted = 1 where id = ?", id); err != nil {
+        return errors.New("Failed to delete webhook: " + err.Error())
+    }
+    return nil
+}
+
+// EnqueueWebhooks queues a delivery of an event to every webhook subscribed to
+// it, among the webhooks of the event's recipients. It runs in the transaction
+// that stores the event, so deliveries exist exactly when the event does, and
+// the dispatcher delivers them at least once.
+func EnqueueWebhooks(ctx context.Context, tx Queryer, e Event) error {
+    if len(e.UserIds) == 0 {
+        return nil
+    }
+
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(e.UserIds)), ",")
+    args := make([]interface{}, len(e.UserIds))
+    for i, u := range e.UserIds {
+        args[i] = u
+    }
+
+    rows, err := tx.QueryContext(ctx, "select " + webhookColumns + " from webhooks " +
+                                      "where is_deleted = 0 and user_id in (" + placeholders + ")", args...)
+    if err != nil {
+        return errors.New("Failed query for subscribed webhooks: " + err.Error())
+    }
+
+    webhooks := make([]*Webhook, 0)
+    for rows.Next() {
+        w, err := scanWebhook(rows)
+        if err != nil {
+            rows.Close()
+            return errors.New("Failed to scan webhook row: " + err.Error())
+        }
+        if w.Wants(e.Type) {
+            webhooks = append(webhooks, w)
+        }
+    }
+    rows.Close()
+
+    if len(webhooks) == 0 {
+        return nil
+    }
+
+    payload, err := json.Marshal(e)
+    if err != nil {
+        return errors.New("Failed to encode webhook payload: " + err.Error())
+    }
+
+    for _, w := range webhooks {
+        _, err := tx.ExecContext(ctx, "insert into webhook_deliveries (webhook_id, event_id, event_type, payload, status, next_attempt_on) " +
+                                      "values (?, ?, ?, ?, 'pending', utc_timestamp())", w.Id, e.Id, e.Type, payload)
+        if err != nil {
+            return errors.New("Failed to queue webhook delivery: " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+const deliveryColumns = "id, webhook_id, coalesce(event_id, 0), event_type, status, attempts, " +
+                        "coalesce(last_status_code, 0), coalesce(last_error, ''), next_attempt_on, created_on, payload"
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+    var d WebhookDelivery
+    var payload []byte
+
+    err := row.Scan(&d.Id, &d.WebhookId, &d.EventId, &d.EventType, &d.Status, &d.Attempts,
+                    &d.LastStatusCode, &d.LastError, &d.NextAttemptOn, &d.CreatedOn, &payload)
+    if err != nil {
+        return nil, err
+    }
+    d.Payload = payload
+
+    return &d, nil
+}
+
+// GetWebhookDeliveries returns the most recent deliveries of a webhook, newest
+// first, optionally only those with a status.
+func (db *MyDB) GetWebhookDeliveries(ctx context.Context, webhookId int, status string, limit int) ([]WebhookDelivery, error) {
+    q := "select " + deliveryColumns + " from webhook_deliveries where webhook_id = ? "
+    args := []interface{}{webhookId}
+
+    if status != "" {
+        q += "and status = ? "
+        args = append(args, status)
+    }
+    q += "order by id desc limit ?"
+    args = append(args, limit)
+
+    rows, err := db.QueryContext(ctx, q, args...)
+    if err != nil {
+        return nil, errors.New("Failed query for webhook deliveries: " + err.Error())
+    }
+    defer rows.Close()
+
+    deliveries := make([]WebhookDelivery, 0)
+    for rows.Next() {
+        d, err := scanDelivery(rows)
+        if err != nil {
+            return nil, errors.New("Failed to scan webhook delivery row: " + err.Error())
+        }
+        deliveries = append(deliveries, *d)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, errors.New("Failed while iterating over webhook delivery rows: " + err.Error())
+    }
+
+    return deliveries, nil
+}
+
+// RetryWebhookDelivery puts a dead-lettered delivery back in the queue.
+func (db *MyDB) RetryWebhookDelivery(ctx context.Context, webhookId int, deliveryId int64) error {
+    res, err := db.ExecContext(ctx, "update webhook_deliveries set status = 'pending', attempts = 0, next_attempt_on = utc_timestamp() " +
+                                    "where id = ? and webhook_id = ? and status = 'dead'", deliveryId, webhookId)
+    if err != nil {
+        return errors.New("Failed to requeue webhook delivery: " + err.Error())
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errors.New("No dead-lettered delivery found with id " + strconv.FormatInt(deliveryId, 10))
+    }
+
+    return nil
+}
+
+/* Delivery */
+
+// WebhookSignature signs a payload sent at a time with a webhook's secret.
+// Receivers recompute HMAC-SHA256 over "<timestamp>.<body>" and compare it to v1.
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    fmt.Fprintf(mac, "%d.", timestamp)
+    mac.Write(body)
+
+    return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookBlockedNets are ranges that aren't reachable from the internet at
+// large, besides the loopback, private and link-local ones net.IP knows.
+var webhookBlockedNets = []string{
+    "0.0.0.0/8",
+    "100.64.0.0/10",
+    "192.0.0.0/24",
+    "198.18.0.0/15",
+    "240.0.0.0/4",
+    "64:ff9b::/96",
+}
+
+// publicIP reports whether webhooks may be sent to an address. Users choose
+// webhook urls, so without this they could have the API probe and post to
+// hosts on its own network. WEBHOOK_ALLOW_PRIVATE lifts it for development.
+func publicIP(ip net.IP) bool {
+    if EnvBool("WEBHOOK_ALLOW_PRIVATE", false) {
+        return true
+    }
+    if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+       ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+        return false
+    }
+    for _, cidr := range webhookBlockedNets {
+        _, n, _ := net.ParseCIDR(cidr)
+        if n.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// checkWebhookHost resolves a webhook's host and refuses it unless every
+// address it resolves to is public.
+func checkWebhookHost(ctx context.Context, host string) error {
+    refused := errors.New("Webhook url must resolve to a public address")
+
+    if ip := net.ParseIP(host); ip != nil {
+        if !publicIP(ip) {
+            return refused
+        }
+        return nil
+    }
+
+    addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+    if err != nil || len(addrs) == 0 {
+        return errors.New("Webhook url host could not be resolved")
+    }
+    for _, a := range addrs {
+        if !publicIP(a.IP) {
+            return refused
+        }
+    }
+    return nil
+}
+
+// webhookDialControl checks the address a webhook connection is actually
+// made to, after DNS, so a host can't pass checkWebhookHost and then be
+// rebound to a private address.
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+    if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+        return errors.New("Refusing to connect to a non-public address")
+    }
+    return nil
+}
+
+// webhookClient sends webhooks directly, never through a proxy, only to public
+// addresses, and doesn't follow redirects: a 3xx counts as a failed delivery.
+var webhookClient = &http.Client{
+    Timeout: 10 * time.Second,
+    Transport: &http.Transport{
+        DialContext: (&net.Dialer{ Timeout: 5 * time.Second, Control: webhookDialControl }).DialContext,
+        TLSHandshakeTimeout: 5 * time.Second,
+        MaxIdleConnsPerHost: 2,
+    },
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+    },
+}
+
+// SendWebhook posts a signed payload to a webhook and returns the status code it answered with.
+func SendWebhook(ctx context.Context, url string, secret string, deliveryId int64, eventType string, body []byte) (code int, err error) {
+
+    defer func(start time.Time) { ObserveOutbound("webhook", start, err) }(time.Now())
+
+    req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+    if err != nil {
+        return 0, errors.New("Unable to create webhook request: " + err.Error())
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "Bettor-Webhooks/1.0")
+    req.Header.Set("X-Bettor-Event", eventType)
+    req.Header.Set("X-Bettor-Delivery", strconv.FormatInt(deliveryId, 10))
+    req.Header.Set("X-Bettor-Signature", WebhookSignature(secret, time.Now().Unix(), body))
+
+    resp, err := webhookClient.Do(req)
+    if err != nil {
+        // the cause stays in the log: it could tell a user about hosts other than theirs
+        Logger(ctx).Warn("webhook request failed", "delivery_id", deliveryId, "error", err)
+        return 0, errors.New("Webhook request failed")
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 1 << 16))
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, errors.New("Webhook answered " + resp.Status)
+    }
+
+    return resp.StatusCode, nil
+}
+
+// claimWebhookDeliveries leases the deliveries that are due, so no other
+// worker attempts them at the same time.
+func (db *MyDB) claimWebhookDeliveries(ctx context.Context, limit int) ([]WebhookDelivery, error) {
+    tx, err := db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, errors.New("Failed to begin webhook claim: " + err.Error())
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.QueryContext(ctx, "select " + deliveryColumns + " from webhook_deliveries " +
+                                      "where status in ('pending', 'failed') and next_attempt_on <= utc_timestamp() " +
+                                      "order by next_attempt_on limit ? for update skip locked", limit)
+    if err != nil {
+        return nil, errors.New("Failed query for due webhook deliveries: " + err.Error())
+    }
+
+    deliveries := make([]WebhookDelivery, 0)
+    for rows.Next() {
+        d, err := scanDelivery(rows)
+        if err != nil {
+            rows.Close()
+            return nil, errors.New("Failed to scan webhook delivery row: " + err.Error())
+        }
+        deliveries = append(deliveries, *d)
+    }
+    rows.Close()
+
+    lease := time.Now().UTC().Add(webhookLease)
+    for _, d := range deliveries {
+        if _, err := tx.ExecContext(ctx, "update webhook_deliveries set next_attempt_on = ? where id = ?", lease, d.Id); err != nil {
+            return nil, errors.New("Failed to lease webhook delivery: " + err.Error())
+        }
+    }
+
+    if err = tx.Commit(); err != nil {
+        return nil, errors.New("Failed to commit webhook claim: " + err.Error())
+    }
+
+    return deliveries, nil
+}
+
+// attemptWebhookDelivery sends a delivery and records the outcome, scheduling
+// a retry with exponential backoff or dead-lettering it once attempts run out.
+func (db *MyDB) attemptWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+    var url, secret string
+    var deleted bool
+    err := db.QueryRowContext(ctx, "select url, secret, is_deleted from webhooks where id = ?", d.WebhookId).
+             Scan(&url, &secret, &deleted)
+    if err != nil {
+        return errors.New("Failed to load webhook: " + err.Error())
+    }
+
+    if deleted {
+        _, err := db.ExecContext(ctx, "update webhook_deliveries set status = 'dead', last_error = 'webhook deleted' where id = ?", d.Id)
+        return err
+    }
+
+    code, sendErr := SendWebhook(ctx, url, secret, d.Id, d.EventType, d.Payload)
+    attempts := d.Attempts + 1
+
+    var lastError sql.NullString
+    status := "delivered"
+    next := time.Now().UTC()
+
+    if sendErr != nil {
+        lastError = sql.NullString{ String: truncate(sendErr.Error(), 1024), Valid: true }
+        status = "failed"
+        next = next.Add(Backoff(attempts, webhookBaseBackoff, webhookMaxBackoff))
+
+        if attempts >= WebhookMaxAttempts {
+            status = "dead"
+        }
+        Logger(ctx).Warn("webhook delivery failed", "webhook_id", d.WebhookId, "delivery_id", d.Id,
+                         "attempts", attempts, "status", status, "error", sendErr)
+    }
+
+    _, err = db.ExecContext(ctx, "update webhook_deliveries set status = ?, attempts = ?, last_status_code = ?, " +
+                                 "last_error = ?, next_attempt_on = ?, delivered_on = if(? = 'delivered', utc_timestamp(), null) " +
+                                 "where id = ?", status, attempts, code, lastError, next, status, d.Id)
+    if err != nil {
+        return errors.New("Failed to record webhook delivery: " + err.Error())
+    }
+
+    return nil
+}
+
+// dispatchWebhooks attempts the webhook deliveries that are due.
+func (db *MyDB) dispatchWebhooks(ctx context.Context) {
+    deliveries, err := db.claimWebhookDeliveries(ctx, 50)
+    if err != nil {
+        Logger(ctx).Error("claiming webhook deliveries failed", "error", err)
+        return
+    }
+
+    for _, d := range deliveries {
+        if err := db.attemptWebhookDelivery(ctx, d); err != nil {
+            Logger(ctx).Error("webhook delivery errored", "delivery_id", d.Id, "error", err)
+        }
+    }
+}
+
+// PingWebhook sends a test event to a webhook right away and logs it as a delivery.
+// The result only says whether it was delivered.
+func (db *MyDB) PingWebhook(ctx context.Context, w *Webhook) (*WebhookDelivery, error) {
+    var secret string
+    if err := db.QueryRowContext(ctx, "select secret from webhooks where id = ?", w.Id).Scan(&secret); err != nil {
+        return nil, errors.New("Failed to load webhook: " + err.Error())
+    }
+
+    payload, _ := json.Marshal(Event{
+        Type: "ping",
+        Data: json.RawMessage(`{"message":"Hello from Bettor"}`),
+        CreatedOn: time.Now().UTC(),
+    })
+
+    res, err := db.ExecContext(ctx, "insert into webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_on) " +
+                                    "values (?, 'ping', ?, 'pending', utc_timestamp())", w.Id, payload)
+    if err != nil {
+        return nil, errors.New("Failed to log webhook ping: " + err.Error())
+    }
+    id, _ := res.LastInsertId()
+
+    code, sendErr := SendWebhook(ctx, w.Url, secret, id, "ping", payload)
+
+    // pings are never retried
+    status, lastError := "delivered", sql.NullString{}
+    if sendErr != nil {
+        status, lastError = "dead", sql.NullString{ String: truncate(sendErr.Error(), 1024), Valid: true }
+    }
+    _, err = db.ExecContext(ctx, "update webhook_deliveries set status = ?, attempts = 1, last_status_code = ?, last_error = ?, " +
+                                 "delivered_on = if(? = 'delivered', utc_timestamp(), null) where id = ?",
+                            status, code, lastError, status, id)
+    if err != nil {
+        return nil, errors.New("Failed to record webhook ping: " + err.Error())
+    }
+
+    return &WebhookDelivery{
+        Id: id,
+        WebhookId: w.Id,
+        EventType: "ping",
+        Status: status,
+        Attempts: 1,
+        NextAttemptOn: time.Now().UTC(),
+        CreatedOn: time.Now().UTC(),
+    }, nil
+}
+
+func truncate(s string, n int) string {
+    if len(s) > n {
+        return s[:n]
+    }
+    return s
+}
+
+func validWebhookEvent(e string) bool {
+    if e == "*" {
+        return true
+    }
+    for _, known := range WebhookEvents {
+        if e == known {
+            return true
+        }
+    }
+    return false
+}
+
+/* Handlers */
+
+// ownWebhook loads the webhook in the path, checking it belongs to the authenticated user.
+func (db *MyDB) ownWebhook(rw http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return nil, false
+    }
+
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    w, err := db.GetWebhook(r.Context(), id)
+    if err != nil || w.UserId != userId {
+        WriteError(rw, 404, "No webhook found with id " + strconv.Itoa(id))
+        return nil, false
+    }
+
+    return w, true
+}
+
+// WebhooksCreateHandler subscribes a URL to events.
+// Handles POST to /webhooks with "url" and comma separated "events".
+func (db *MyDB) WebhooksCreateHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    // parse the data
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        WriteError(rw, 500, "Failed to parse body: " + err.Error())
+        return
+    }
+
+    var params map[string]string
+    if err = json.Unmarshal(body, &params); err != nil {
+        WriteError(rw, 400, "Body must be a JSON object: " + err.Error())
+        return
+    }
+
+    events := make([]string, 0)
+    for _, e := range strings.Split(params["events"], ",") {
+        if e = strings.TrimSpace(e); e != "" {
+            events = append(events, e)
+        }
+    }
+
+    w, err := db.CreateWebhook(r.Context(), userId, params["url"], events)
+    if err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteData(rw, 201, w)
+}
+
+// WebhooksShowHandler lists the authenticated user's webhooks.
+// Handles GET to /webhooks.
+func (db *MyDB) WebhooksShowHandler(rw http.ResponseWriter, r *http.Request) {
+
+    userId, err := db.AuthenticatedUser(r)
+    if err != nil {
+        WriteError(rw, 401, err.Error())
+        return
+    }
+
+    webhooks, err := db.GetUserWebhooks(r.Context(), userId)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, webhooks)
+}
+
+// WebhookShowHandler displays a webhook.
+// Handles GET to /webhooks/{id}.
+func (db *MyDB) WebhookShowHandler(rw http.ResponseWriter, r *http.Request) {
+    if w, ok := db.ownWebhook(rw, r); ok {
+        WriteData(rw, 200, w)
+    }
+}
+
+// WebhookDeleteHandler deletes a webhook.
+// Handles DELETE to /webhooks/{id}.
+func (db *MyDB) WebhookDeleteHandler(rw http.ResponseWriter, r *http.Request) {
+    w, ok := db.ownWebhook(rw, r)
+    if !ok {
+        return
+    }
+
+    if err := db.DeleteWebhook(r.Context(), w.Id); err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// WebhookDeliveriesHandler shows the delivery log of a webhook.
+// Handles GET to /webhooks/{id}/deliveries, optionally filtered by "status".
+func (db *MyDB) WebhookDeliveriesHandler(rw http.ResponseWriter, r *http.Request) {
+    w, ok := db.ownWebhook(rw, r)
+    if !ok {
+        return
+    }
+
+    deliveries, err := db.GetWebhookDeliveries(r.Context(), w.Id, r.URL.Query().Get("status"), 100)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, deliveries)
+}
+
+// WebhookDeadLettersHandler lists the deliveries of a webhook that ran out of attempts.
+// Handles GET to /webhooks/{id}/dead-letters.
+func (db *MyDB) WebhookDeadLettersHandler(rw http.ResponseWriter, r *http.Request) {
+    w, ok := db.ownWebhook(rw, r)
+    if !ok {
+        return
+    }
+
+    deliveries, err := db.GetWebhookDeliveries(r.Context(), w.Id, "dead", 100)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, deliveries)
+}
+
+// WebhookRetryHandler requeues a dead-lettered delivery.
+// Handles POST to /webhooks/{id}/deliveries/{delivery_id}/retry.
+func (db *MyDB) WebhookRetryHandler(rw http.ResponseWriter, r *http.Request) {
+    w, ok := db.ownWebhook(rw, r)
+    if !ok {
+        return
+    }
+
+    deliveryId, _ := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+    if err := db.RetryWebhookDelivery(r.Context(), w.Id, deliveryId); err != nil {
+        WriteError(rw, 400, err.Error())
+        return
+    }
+
+    WriteSuccess(rw)
+}
+
+// WebhookPingHandler sends a test event to a webhook and reports how it went.
+// Handles POST to /webhooks/{id}/ping.
+func (db *MyDB) WebhookPingHandler(rw http.ResponseWriter, r *http.Request) {
+    w, ok := db.ownWebhook(rw, r)
+    if !ok {
+        return
+    }
+
+    d, err := db.PingWebhook(r.Context(), w)
+    if err != nil {
+        WriteError(rw, 500, err.Error())
+        return
+    }
+
+    WriteData(rw, 200, d)
+}
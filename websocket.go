@@ -0,0 +1,202 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// websocketGUID is the key suffix defined by RFC 6455 for the handshake.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+    opText = 0x1
+    opClose = 0x8
+    opPing = 0x9
+    opPong = 0xA
+)
+
+// A WebSocket is a server side WebSocket connection that sends events as text
+// messages. Messages from the client are read only to answer pings and closes.
+type WebSocket struct {
+    conn net.Conn
+    rw *bufio.ReadWriter
+
+    mu sync.Mutex
+    done chan struct{}
+    closeOnce sync.Once
+}
+
+// IsWebSocketUpgrade reports whether a request asks to switch to a WebSocket.
+func IsWebSocketUpgrade(r *http.Request) bool {
+    return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+           strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// UpgradeWebSocket completes the WebSocket handshake and takes over the connection.
+func UpgradeWebSocket(rw http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+    if r.Header.Get("Sec-WebSocket-Version") != "13" {
+        return nil, errors.New("Only WebSocket version 13 is supported")
+    }
+
+    key := r.Header.Get("Sec-WebSocket-Key")
+    if key == "" {
+        return nil, errors.New("Missing Sec-WebSocket-Key header")
+    }
+
+    conn, brw, err := http.NewResponseController(rw).Hijack()
+    if err != nil {
+        return nil, errors.New("WebSockets are not supported: " + err.Error())
+    }
+
+    sum := sha1.Sum([]byte(key + websocketGUID))
+    accept := base64.StdEncoding.EncodeToString(sum[:])
+
+    brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+                    "Upgrade: websocket\r\n" +
+                    "Connection: Upgrade\r\n" +
+                    "Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+    if err := brw.Flush(); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    ws := &WebSocket{ conn: conn, rw: brw, done: make(chan struct{}) }
+    go ws.readLoop()
+
+    return ws, nil
+}
+
+// WriteEvent sends an event as a JSON text message.
+func (ws *WebSocket) WriteEvent(e Event) error {
+    js, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    return ws.writeFrame(opText, js)
+}
+
+// Heartbeat pings the client.
+func (ws *WebSocket) Heartbeat() error {
+    return ws.writeFrame(opPing, nil)
+}
+
+// Done is closed once the client closes the connection.
+func (ws *WebSocket) Done() <-chan struct{} {
+    return ws.done
+}
+
+// Close sends a close frame, unless the client already closed, and closes the connection.
+func (ws *WebSocket) Close() error {
+    select {
+    case <-ws.done:
+    default:
+        ws.writeFrame(opClose, []byte{0x03, 0xE8})    // 1000, normal closure
+    }
+    ws.closeOnce.Do(func() { close(ws.done) })
+    return ws.conn.Close()
+}
+
+func (ws *WebSocket) writeFrame(op byte, payload []byte) error {
+    ws.mu.Lock()
+    defer ws.mu.Unlock()
+
+    header := []byte{0x80 | op}
+    switch n := len(payload); {
+    case n < 126:
+        header = append(header, byte(n))
+    case n <= 0xFFFF:
+        header = append(header, 126, byte(n >> 8), byte(n))
+    default:
+        header = append(header, 127)
+        header = binary.BigEndian.AppendUint64(header, uint64(n))
+    }
+
+    ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+    if _, err := ws.rw.Write(header); err != nil {
+        return err
+    }
+    if _, err := ws.rw.Write(payload); err != nil {
+        return err
+    }
+    return ws.rw.Flush()
+}
+
+// readLoop reads client frames until the connection closes, answering pings and closes.
+func (ws *WebSocket) readLoop() {
+    defer ws.closeOnce.Do(func() { close(ws.done) })
+
+    for {
+        op, payload, err := ws.readFrame()
+        if err != nil {
+            return
+        }
+
+        switch op {
+        case opPing:
+            ws.writeFrame(opPong, payload)
+        case opClose:
+            ws.writeFrame(opClose, payload)
+            return
+        }
+    }
+}
+
+func (ws *WebSocket) readFrame() (byte, []byte, error) {
+    var head [2]byte
+    if _, err := io.ReadFull(ws.rw, head[:]); err != nil {
+        return 0, nil, err
+    }
+
+    op := head[0] & 0x0F
+    masked := head[1] & 0x80 != 0
+    n := uint64(head[1] & 0x7F)
+
+    switch n {
+    case 126:
+        var ext [2]byte
+        if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+            return 0, nil, err
+        }
+        n = uint64(binary.BigEndian.Uint16(ext[:]))
+    case 127:
+        var ext [8]byte
+        if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+            return 0, nil, err
+        }
+        n = binary.BigEndian.Uint64(ext[:])
+    }
+
+    // clients only need to send control frames and short messages
+    if n > 1 << 16 {
+        return 0, nil, errors.New("WebSocket frame too large")
+    }
+
+    var mask [4]byte
+    if masked {
+        if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+            return 0, nil, err
+        }
+    }
+
+    payload := make([]byte, n)
+    if _, err := io.ReadFull(ws.rw, payload); err != nil {
+        return 0, nil, err
+    }
+    if masked {
+        for i := range payload {
+            payload[i] ^= mask[i % 4]
+        }
+    }
+
+    return op, payload, nil
+}